@@ -0,0 +1,284 @@
+// Package bleve provides an embedded search engine, which stores its index
+// on disk via Bleve. It's meant for services which can't run a separate
+// search server like Elastic Search.
+package bleve
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/aslanides/gocrud/search"
+	"github.com/aslanides/gocrud/x"
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/analysis/analyzer/keyword"
+	"github.com/blevesearch/bleve/mapping"
+)
+
+var log = x.Log("bleve")
+
+// Internal fields stored along with the doc data. Data fields are indexed
+// at the top level, so they can be referred to by name, like with the
+// other engines.
+const (
+	fieldKind   = "_kind"
+	fieldKey    = "_key"    // Doc id, used to break ties while sorting.
+	fieldNames  = "_fields" // Names of the fields set, for exists filter.
+	fieldSource = "_source" // JSON encoded doc, returned with results.
+)
+
+// Bleve encapsulates the bleve index, and implements methods declared by
+// search.Engine.
+type Bleve struct {
+	sync.Mutex // Serializes version checks along with the writes.
+	index      bleve.Index
+	mapping    *mapping.IndexMappingImpl
+}
+
+// SetMapping sets the mapping used when creating a new index. Must be called
+// before Init. By default, strings are analyzed by the standard analyzer,
+// so AddExact has the same caveats as with Elastic Search. Map the field to
+// the keyword analyzer to match full strings.
+func (b *Bleve) SetMapping(m *mapping.IndexMappingImpl) {
+	b.mapping = m
+}
+
+// defaultMapping returns the mapping for internal fields, with data fields
+// being mapped dynamically.
+func defaultMapping() *mapping.IndexMappingImpl {
+	m := bleve.NewIndexMapping()
+	addInternal(m)
+	return m
+}
+
+func addInternal(m *mapping.IndexMappingImpl) {
+	kw := bleve.NewTextFieldMapping()
+	kw.Analyzer = keyword.Name
+	kw.IncludeInAll = false
+	m.DefaultMapping.AddFieldMappingsAt(fieldKind, kw)
+	m.DefaultMapping.AddFieldMappingsAt(fieldKey, kw)
+	m.DefaultMapping.AddFieldMappingsAt(fieldNames, kw)
+
+	src := bleve.NewTextFieldMapping()
+	src.Index = false
+	src.Store = true
+	src.IncludeInAll = false
+	m.DefaultMapping.AddFieldMappingsAt(fieldSource, src)
+}
+
+// Init opens the index at the directory path provided, creating it if it
+// doesn't exist.
+func (b *Bleve) Init(args ...string) {
+	if len(args) != 1 {
+		log.WithField("args", args).Fatal("Invalid arguments")
+		return
+	}
+	path := args[0]
+
+	var err error
+	if _, serr := os.Stat(path); os.IsNotExist(serr) {
+		m := b.mapping
+		if m == nil {
+			m = defaultMapping()
+		} else {
+			addInternal(m)
+		}
+		b.index, err = bleve.New(path, m)
+	} else {
+		b.index, err = bleve.Open(path)
+	}
+	if err != nil {
+		x.LogErr(log, err).WithField("path", path).Fatal("While opening index")
+		return
+	}
+	log.WithField("path", path).Debug("Opened bleve index")
+}
+
+// Close closes the index.
+func (b *Bleve) Close() error {
+	return b.index.Close()
+}
+
+func docId(kind, id string) string {
+	return kind + "/" + id
+}
+
+// version returns the timestamp stored under the internal key, or zero
+// if not found.
+func (b *Bleve) version(key string) (int64, error) {
+	val, err := b.index.GetInternal([]byte(key))
+	if err != nil || len(val) == 0 {
+		return 0, err
+	}
+	return strconv.ParseInt(string(val), 10, 64)
+}
+
+func (b *Bleve) setVersion(key string, ts int64) error {
+	return b.index.SetInternal([]byte(key), []byte(strconv.FormatInt(ts, 10)))
+}
+
+// fieldPaths returns the dotted paths of all the fields set in data.
+func fieldPaths(prefix string, data map[string]interface{}) (paths []string) {
+	for k, v := range data {
+		if v == nil {
+			continue
+		}
+		path := prefix + k
+		paths = append(paths, path)
+		if m, ok := v.(map[string]interface{}); ok {
+			paths = append(paths, fieldPaths(path+".", m)...)
+		}
+	}
+	return paths
+}
+
+// indexed converts the doc to the fields indexed by bleve.
+func indexed(doc x.Doc) (map[string]interface{}, error) {
+	src, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	fields := make(map[string]interface{})
+	if doc.Data != nil {
+		// Round trip via JSON, so structs get indexed the same as maps.
+		b, err := json.Marshal(doc.Data)
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(b, &fields); err != nil {
+			return nil, errors.New("Doc data should be an object")
+		}
+	}
+	fields[fieldNames] = fieldPaths("", fields)
+	fields[fieldKind] = doc.Kind
+	fields[fieldKey] = doc.Id
+	fields[fieldSource] = string(src)
+	return fields, nil
+}
+
+// Update indexes the doc, if it's newer than both the doc already indexed,
+// and the last delete. Versions are stored in the index as internal keys.
+func (b *Bleve) Update(doc x.Doc) error {
+	if doc.Id == "" || doc.Kind == "" || doc.NanoTs == 0 {
+		return errors.New("Invalid document")
+	}
+	fields, err := indexed(doc)
+	if err != nil {
+		x.LogErr(log, err).WithField("doc", doc).Error("While converting doc")
+		return err
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	did := docId(doc.Kind, doc.Id)
+	for _, key := range []string{"v/" + did, "d/" + did} {
+		ts, err := b.version(key)
+		if err != nil {
+			x.LogErr(log, err).WithField("key", key).Error("While reading version")
+			return err
+		}
+		if ts >= doc.NanoTs {
+			return search.ErrConflict
+		}
+	}
+
+	if err := b.index.Index(did, fields); err != nil {
+		x.LogErr(log, err).WithField("doc", doc).Error("While indexing doc")
+		return err
+	}
+	return b.setVersion("v/"+did, doc.NanoTs)
+}
+
+// remove deletes the doc, and stores a tombstone version to stop older
+// updates from bringing it back. Must be called with lock held.
+func (b *Bleve) remove(kind, id string, nanoTs int64) error {
+	did := docId(kind, id)
+	ts, err := b.version("v/" + did)
+	if err != nil {
+		return err
+	}
+	if ts >= nanoTs {
+		return search.ErrConflict
+	}
+	dts, err := b.version("d/" + did)
+	if err != nil {
+		return err
+	}
+	if dts >= nanoTs {
+		return nil
+	}
+
+	if err := b.index.Delete(did); err != nil {
+		x.LogErr(log, err).WithField("id", did).Error("While deleting doc")
+		return err
+	}
+	if err := b.index.DeleteInternal([]byte("v/" + did)); err != nil {
+		return err
+	}
+	return b.setVersion("d/"+did, nanoTs)
+}
+
+// Delete removes the doc, if nanoTs is newer than the doc indexed.
+func (b *Bleve) Delete(kind, id string, nanoTs int64) error {
+	if id == "" || kind == "" || nanoTs == 0 {
+		return errors.New("Invalid document")
+	}
+	b.Lock()
+	defer b.Unlock()
+	return b.remove(kind, id, nanoTs)
+}
+
+// Get looks up the doc via its bleve id, and returns it from the stored
+// source.
+func (b *Bleve) Get(kind, id string) (doc x.Doc, rerr error) {
+	sr := bleve.NewSearchRequest(bleve.NewDocIDQuery([]string{docId(kind, id)}))
+	sr.Fields = []string{fieldSource}
+	result, err := b.index.Search(sr)
+	if err != nil {
+		x.LogErr(log, err).WithField("kind", kind).WithField("id", id).
+			Error("While getting doc")
+		return doc, err
+	}
+	if len(result.Hits) == 0 {
+		return doc, search.ErrNotFound
+	}
+	return toDoc(result.Hits[0])
+}
+
+// DeleteByQuery runs the query, and removes all the docs found.
+func (b *Bleve) DeleteByQuery(q search.Query) error {
+	bq, ok := q.(*BleveQuery)
+	if !ok || bq.b != b {
+		return errors.New("Query not created by this engine")
+	}
+	// From, Limit, Order and cursor are ignored.
+	all := &BleveQuery{b: b, kind: bq.kind, filter: bq.filter, matches: bq.matches}
+	docs, err := all.Run()
+	if err != nil {
+		return err
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	for _, doc := range docs {
+		// Docs updated since the query ran would have higher timestamps,
+		// and would stay.
+		if err := b.remove(doc.Kind, doc.Id, doc.NanoTs+1); err != nil {
+			log.WithField("doc", doc).Debug("Doc updated, skipping delete")
+		}
+	}
+	log.WithField("num_docs", len(docs)).Debug("Deleted by query")
+	return nil
+}
+
+// NewQuery creates a new query object, to return results of type kind.
+func (b *Bleve) NewQuery(kind string) search.Query {
+	return &BleveQuery{b: b, kind: kind}
+}
+
+func init() {
+	log.Info("Initing bleve")
+	search.Register("bleve", new(Bleve))
+}
@@ -0,0 +1,125 @@
+package bleve
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aslanides/gocrud/testx"
+	"github.com/aslanides/gocrud/x"
+)
+
+func initialize(dir string) *Bleve {
+	b := new(Bleve)
+	b.Init(filepath.Join(dir, "index"))
+
+	testx.AddDocs(b)
+	return b
+}
+
+func TestNewAndFilter(t *testing.T) {
+	testx.RunAndFilter(bl, t)
+}
+
+func TestNewOrFilter(t *testing.T) {
+	testx.RunOrFilter(bl, t)
+}
+
+func TestCount(t *testing.T) {
+	testx.RunCount(bl, t)
+}
+
+func TestFrom(t *testing.T) {
+	testx.RunFromLimit(bl, t)
+}
+
+func TestRangeFilter(t *testing.T) {
+	testx.RunRangeFilter(bl, t)
+}
+
+func TestExistsFilter(t *testing.T) {
+	testx.RunExistsFilter(bl, t)
+}
+
+func TestInFilter(t *testing.T) {
+	testx.RunInFilter(bl, t)
+}
+
+func TestNotFilter(t *testing.T) {
+	testx.RunNotFilter(bl, t)
+}
+
+func TestNestedFilter(t *testing.T) {
+	testx.RunNestedFilter(bl, t)
+}
+
+func TestMatch(t *testing.T) {
+	testx.RunMatch(bl, t)
+}
+
+func TestCursor(t *testing.T) {
+	testx.RunCursor(bl, t)
+}
+
+func TestMultiOrder(t *testing.T) {
+	testx.RunMultiOrder(bl, t)
+}
+
+func TestDelete(t *testing.T) {
+	testx.RunDelete(bl, t)
+}
+
+func TestGet(t *testing.T) {
+	testx.RunGet(bl, t)
+}
+
+func TestReopen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bleve")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "index")
+	b := new(Bleve)
+	b.Init(path)
+	d := x.Doc{Kind: "Star", Id: "sun", NanoTs: 10}
+	d.Data = map[string]interface{}{"name": "sun"}
+	if err := b.Update(d); err != nil {
+		t.Fatalf("While updating: %v", err)
+	}
+	if err := b.Close(); err != nil {
+		t.Fatalf("While closing: %v", err)
+	}
+
+	b = new(Bleve)
+	b.Init(path)
+	defer b.Close()
+	docs, err := b.NewQuery("Star").Run()
+	if err != nil {
+		t.Fatalf("While running query: %v", err)
+	}
+	if len(docs) != 1 || docs[0].Id != "sun" {
+		t.Errorf("Expected doc to persist. Found: %+v", docs)
+	}
+	// Versions persist as well.
+	if err := b.Update(d); err == nil {
+		t.Error("Update with same version should fail with version conflict")
+	}
+}
+
+var bl *Bleve
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "bleve")
+	if err != nil {
+		panic(err)
+	}
+	bl = initialize(dir)
+
+	code := m.Run()
+	bl.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
@@ -0,0 +1,307 @@
+package bleve
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/aslanides/gocrud/search"
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/search/query"
+)
+
+// BleveFilter is a group of filters, and nested filter groups, which are
+// combined via conjunction or disjunction queries.
+type BleveFilter struct {
+	filterType int // 1 = AND, 2 = OR
+	negate     bool
+	queries    []query.Query
+	groups     []*BleveFilter
+	err        error // Returned when the query is run.
+}
+
+// BleveNotFilter negates the next filter added to it, before passing it
+// on to the parent BleveFilter.
+type BleveNotFilter struct {
+	parent *BleveFilter
+}
+
+func toFloat(v interface{}) (float64, bool) {
+	switch t := v.(type) {
+	case int:
+		return float64(t), true
+	case int32:
+		return float64(t), true
+	case int64:
+		return float64(t), true
+	case float32:
+		return float64(t), true
+	case float64:
+		return t, true
+	}
+	return 0, false
+}
+
+// exact generates the query matching field value, depending upon its type.
+// Numbers are indexed as numeric fields, and can't be matched by terms.
+func exact(field string, value interface{}) query.Query {
+	if f, ok := toFloat(value); ok {
+		inclusive := true
+		nq := bleve.NewNumericRangeInclusiveQuery(&f, &f, &inclusive, &inclusive)
+		nq.SetField(field)
+		return nq
+	}
+	switch t := value.(type) {
+	case bool:
+		bq := bleve.NewBoolFieldQuery(t)
+		bq.SetField(field)
+		return bq
+	case string:
+		tq := bleve.NewTermQuery(t)
+		tq.SetField(field)
+		return tq
+	}
+	tq := bleve.NewTermQuery(fmt.Sprintf("%v", value))
+	tq.SetField(field)
+	return tq
+}
+
+// rangeQuery generates numeric range query for numbers, and term range
+// query for strings.
+func rangeQuery(field, op string, value interface{}) (query.Query, error) {
+	var min, max interface{}
+	var inclusive bool
+	switch op {
+	case search.Gt:
+		min = value
+	case search.Gte:
+		min, inclusive = value, true
+	case search.Lt:
+		max = value
+	case search.Lte:
+		max, inclusive = value, true
+	default:
+		return nil, errors.New("Invalid range operator: " + op)
+	}
+
+	if f, ok := toFloat(value); ok {
+		var nq *query.NumericRangeQuery
+		if min != nil {
+			nq = bleve.NewNumericRangeInclusiveQuery(&f, nil, &inclusive, nil)
+		} else {
+			nq = bleve.NewNumericRangeInclusiveQuery(nil, &f, nil, &inclusive)
+		}
+		nq.SetField(field)
+		return nq, nil
+	}
+	s, ok := value.(string)
+	if !ok {
+		return nil, fmt.Errorf("Invalid range value: %v", value)
+	}
+	var tq *query.TermRangeQuery
+	if min != nil {
+		tq = bleve.NewTermRangeInclusiveQuery(s, "", &inclusive, nil)
+	} else {
+		tq = bleve.NewTermRangeInclusiveQuery("", s, nil, &inclusive)
+	}
+	tq.SetField(field)
+	return tq, nil
+}
+
+// exists matches docs which have the field set, via the list of field
+// names stored with each doc.
+func exists(field string) query.Query {
+	tq := bleve.NewTermQuery(field)
+	tq.SetField(fieldNames)
+	return tq
+}
+
+func missing(field string) query.Query {
+	return not(exists(field))
+}
+
+func not(q query.Query) query.Query {
+	bq := bleve.NewBooleanQuery()
+	bq.AddMust(bleve.NewMatchAllQuery())
+	bq.AddMustNot(q)
+	return bq
+}
+
+func (bf *BleveFilter) addGroup(filterType int) *BleveFilter {
+	group := &BleveFilter{filterType: filterType}
+	bf.groups = append(bf.groups, group)
+	return group
+}
+
+// And adds a nested 'and' filter group.
+func (bf *BleveFilter) And() search.FilterQuery {
+	return bf.addGroup(1)
+}
+
+// Or adds a nested 'or' filter group.
+func (bf *BleveFilter) Or() search.FilterQuery {
+	return bf.addGroup(2)
+}
+
+// build converts the filter group to bleve queries, recursively. Returns
+// false if the group, and all its nested groups, are empty.
+func (bf *BleveFilter) build() (query.Query, bool, error) {
+	if bf.filterType != 1 && bf.filterType != 2 {
+		return nil, false, errors.New("Invalid filter type")
+	}
+	if bf.err != nil {
+		return nil, false, bf.err
+	}
+
+	queries := append([]query.Query{}, bf.queries...)
+	for _, group := range bf.groups {
+		q, ok, err := group.build()
+		if err != nil {
+			return nil, false, err
+		}
+		if ok {
+			queries = append(queries, q)
+		}
+	}
+	if len(queries) == 0 {
+		return nil, false, nil
+	}
+
+	var q query.Query
+	if bf.filterType == 1 {
+		q = bleve.NewConjunctionQuery(queries...)
+	} else {
+		q = bleve.NewDisjunctionQuery(queries...)
+	}
+	if bf.negate {
+		q = not(q)
+	}
+	return q, true, nil
+}
+
+// AddExact uses term query for strings, which has the same caveats as with
+// Elastic Search. Strings need to be mapped to the keyword analyzer, for
+// full string matches to work.
+func (bf *BleveFilter) AddExact(field string,
+	value interface{}) search.FilterQuery {
+
+	bf.queries = append(bf.queries, exact(dataField(field), value))
+	return bf
+}
+
+// AddRegex uses regexp query, which runs over the terms indexed.
+func (bf *BleveFilter) AddRegex(field string,
+	value string) search.FilterQuery {
+
+	rq := bleve.NewRegexpQuery(value)
+	rq.SetField(dataField(field))
+	bf.queries = append(bf.queries, rq)
+	return bf
+}
+
+// AddRange supports numbers and strings. Any other value results in error,
+// when the query is run.
+func (bf *BleveFilter) AddRange(field string, op string,
+	value interface{}) search.FilterQuery {
+
+	rq, err := rangeQuery(dataField(field), op, value)
+	if err != nil {
+		bf.err = err
+		return bf
+	}
+	bf.queries = append(bf.queries, rq)
+	return bf
+}
+
+func (bf *BleveFilter) AddExists(field string) search.FilterQuery {
+	bf.queries = append(bf.queries, exists(dataField(field)))
+	return bf
+}
+
+func (bf *BleveFilter) AddMissing(field string) search.FilterQuery {
+	bf.queries = append(bf.queries, missing(dataField(field)))
+	return bf
+}
+
+// AddIn uses a disjunction of exact queries.
+func (bf *BleveFilter) AddIn(field string,
+	values ...interface{}) search.FilterQuery {
+
+	var queries []query.Query
+	for _, value := range values {
+		queries = append(queries, exact(dataField(field), value))
+	}
+	bf.queries = append(bf.queries, bleve.NewDisjunctionQuery(queries...))
+	return bf
+}
+
+// Not would negate the next filter added.
+func (bf *BleveFilter) Not() search.FilterQuery {
+	return &BleveNotFilter{parent: bf}
+}
+
+func (nf *BleveNotFilter) negate(before int) *BleveFilter {
+	last := len(nf.parent.queries) - 1
+	if last >= before {
+		nf.parent.queries[last] = not(nf.parent.queries[last])
+	}
+	return nf.parent
+}
+
+func (nf *BleveNotFilter) AddExact(field string,
+	value interface{}) search.FilterQuery {
+	before := len(nf.parent.queries)
+	nf.parent.AddExact(field, value)
+	return nf.negate(before)
+}
+
+func (nf *BleveNotFilter) AddRegex(field string,
+	value string) search.FilterQuery {
+	before := len(nf.parent.queries)
+	nf.parent.AddRegex(field, value)
+	return nf.negate(before)
+}
+
+func (nf *BleveNotFilter) AddRange(field string, op string,
+	value interface{}) search.FilterQuery {
+	before := len(nf.parent.queries)
+	nf.parent.AddRange(field, op, value)
+	return nf.negate(before)
+}
+
+func (nf *BleveNotFilter) AddExists(field string) search.FilterQuery {
+	before := len(nf.parent.queries)
+	nf.parent.AddExists(field)
+	return nf.negate(before)
+}
+
+func (nf *BleveNotFilter) AddMissing(field string) search.FilterQuery {
+	before := len(nf.parent.queries)
+	nf.parent.AddMissing(field)
+	return nf.negate(before)
+}
+
+func (nf *BleveNotFilter) AddIn(field string,
+	values ...interface{}) search.FilterQuery {
+	before := len(nf.parent.queries)
+	nf.parent.AddIn(field, values...)
+	return nf.negate(before)
+}
+
+// And adds a negated nested 'and' filter group.
+func (nf *BleveNotFilter) And() search.FilterQuery {
+	group := nf.parent.addGroup(1)
+	group.negate = true
+	return group
+}
+
+// Or adds a negated nested 'or' filter group.
+func (nf *BleveNotFilter) Or() search.FilterQuery {
+	group := nf.parent.addGroup(2)
+	group.negate = true
+	return group
+}
+
+// Not on a BleveNotFilter cancels out the negation.
+func (nf *BleveNotFilter) Not() search.FilterQuery {
+	return nf.parent
+}
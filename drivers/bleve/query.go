@@ -0,0 +1,315 @@
+package bleve
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+
+	"github.com/aslanides/gocrud/search"
+	"github.com/aslanides/gocrud/x"
+	"github.com/blevesearch/bleve"
+	bsearch "github.com/blevesearch/bleve/search"
+	"github.com/blevesearch/bleve/search/query"
+)
+
+// BleveQuery implements methods declared by search.Query.
+type BleveQuery struct {
+	b        *Bleve
+	kind     string
+	filter   *BleveFilter // Root filter, AND of all the filters set on query.
+	matches  []query.Query
+	order    []search.SortKey
+	missing  string
+	after    *search.Cursor
+	afterErr error
+	from     int
+	limit    int
+}
+
+// dataField strips the optional "data." prefix from field, as data fields
+// are indexed at the top level.
+func dataField(field string) string {
+	if len(field) > len("data.") && strings.ToLower(field[0:5]) == "data." {
+		return field[5:]
+	}
+	return field
+}
+
+// NewAndFilter adds a new 'and' filter group to the query. If called more
+// than once, or along with NewOrFilter, all the groups need to match.
+func (bq *BleveQuery) NewAndFilter() search.FilterQuery {
+	if bq.filter == nil {
+		bq.filter = &BleveFilter{filterType: 1}
+	}
+	return bq.filter.And()
+}
+
+// NewOrFilter adds a new 'or' filter group to the query.
+func (bq *BleveQuery) NewOrFilter() search.FilterQuery {
+	if bq.filter == nil {
+		bq.filter = &BleveFilter{filterType: 1}
+	}
+	return bq.filter.Or()
+}
+
+func (bq *BleveQuery) From(num int) search.Query {
+	bq.from = num
+	return bq
+}
+
+func (bq *BleveQuery) Limit(num int) search.Query {
+	bq.limit = num
+	return bq
+}
+
+// Match uses the match query, which analyzes text the same way as the field
+// was analyzed during indexing.
+func (bq *BleveQuery) Match(field, text string) search.Query {
+	mq := bleve.NewMatchQuery(text)
+	mq.SetField(dataField(field))
+	bq.matches = append(bq.matches, mq)
+	return bq
+}
+
+func (bq *BleveQuery) Order(fields ...string) search.Query {
+	bq.order = search.ParseOrder(fields...)
+	return bq
+}
+
+func (bq *BleveQuery) Missing(position string) search.Query {
+	bq.missing = position
+	return bq
+}
+
+func (bq *BleveQuery) missingFirst() bool {
+	return bq.missing == search.MissingFirst
+}
+
+// After sets the cursor to continue from, which gets converted to range
+// queries over the sort fields, and the doc id, which breaks ties.
+func (bq *BleveQuery) After(cursor string) search.Query {
+	c, err := search.DecodeCursor(cursor)
+	bq.after = &c
+	bq.afterErr = err
+	return bq
+}
+
+// Aggregate isn't supported by bleve, and RunAggregations would return
+// an error.
+func (bq *BleveQuery) Aggregate(name string,
+	agg *search.Aggregation) search.Query {
+	return bq
+}
+
+func (bq *BleveQuery) RunAggregations() (
+	map[string]*search.AggregationResult, error) {
+	return nil, errors.New("Aggregations aren't supported by bleve")
+}
+
+// keyQueries returns the queries matching docs with the same value as val
+// for the sort key, and the ones ordered after it. The latter is nil if
+// no doc can be ordered after val.
+func (bq *BleveQuery) keyQueries(key search.SortKey, val interface{}) (
+	same query.Query, after query.Query, rerr error) {
+
+	field := dataField(key.Field)
+	if val == nil {
+		same = missing(field)
+		if bq.missingFirst() {
+			after = exists(field)
+		}
+		return same, after, nil
+	}
+
+	same = exact(field, val)
+	op := search.Gt
+	if key.Desc {
+		op = search.Lt
+	}
+	after, err := rangeQuery(field, op, val)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !bq.missingFirst() {
+		after = bleve.NewDisjunctionQuery(after, missing(field))
+	}
+	return same, after, nil
+}
+
+// cursorQuery generates the query letting through only the docs ordered
+// after the cursor position, the same way as the Elastic Search driver.
+func (bq *BleveQuery) cursorQuery() (query.Query, error) {
+	if bq.afterErr != nil {
+		return nil, bq.afterErr
+	}
+	c := bq.after
+	if c.Kind != bq.kind {
+		return nil, search.ErrInvalidCursor
+	}
+	if len(bq.order) == 0 && len(bq.matches) > 0 {
+		return nil, search.ErrRelevanceCursor
+	}
+	if len(c.Values) != len(bq.order) {
+		return nil, search.ErrInvalidCursor
+	}
+
+	var ors []query.Query
+	var sames []query.Query
+	for i, key := range bq.order {
+		same, after, err := bq.keyQueries(key, c.Values[i])
+		if err != nil {
+			return nil, err
+		}
+		if after != nil {
+			ands := append(append([]query.Query{}, sames...), after)
+			ors = append(ors, bleve.NewConjunctionQuery(ands...))
+		}
+		sames = append(sames, same)
+	}
+	exclusive := false
+	kq := bleve.NewTermRangeInclusiveQuery(c.Id, "", &exclusive, nil)
+	kq.SetField(fieldKey)
+	ors = append(ors, bleve.NewConjunctionQuery(append(sames, kq)...))
+	return bleve.NewDisjunctionQuery(ors...), nil
+}
+
+// generateQuery combines the kind, match clauses, filters and cursor.
+func (bq *BleveQuery) generateQuery(withCursor bool) (query.Query, error) {
+	kq := bleve.NewTermQuery(bq.kind)
+	kq.SetField(fieldKind)
+	conjuncts := []query.Query{kq}
+	conjuncts = append(conjuncts, bq.matches...)
+	if bq.filter != nil {
+		f, ok, err := bq.filter.build()
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			conjuncts = append(conjuncts, f)
+		}
+	}
+	if withCursor && bq.after != nil {
+		cq, err := bq.cursorQuery()
+		if err != nil {
+			return nil, err
+		}
+		conjuncts = append(conjuncts, cq)
+	}
+	return bleve.NewConjunctionQuery(conjuncts...), nil
+}
+
+func (bq *BleveQuery) sortOrder() (order bsearch.SortOrder) {
+	missing := bsearch.SortFieldMissingLast
+	if bq.missingFirst() {
+		missing = bsearch.SortFieldMissingFirst
+	}
+	for _, key := range bq.order {
+		order = append(order, &bsearch.SortField{
+			Field:   dataField(key.Field),
+			Desc:    key.Desc,
+			Missing: missing,
+		})
+	}
+	if len(bq.order) == 0 && len(bq.matches) > 0 {
+		order = append(order, &bsearch.SortScore{Desc: true})
+	}
+	// Break ties by id, to keep pagination stable.
+	return append(order, &bsearch.SortField{Field: fieldKey})
+}
+
+// search runs the query. All docs are returned if limit isn't set.
+func (bq *BleveQuery) search() (*bleve.SearchResult, error) {
+	q, err := bq.generateQuery(true)
+	if err != nil {
+		return nil, err
+	}
+	size := bq.limit
+	if size <= 0 {
+		count, err := bq.b.index.DocCount()
+		if err != nil {
+			return nil, err
+		}
+		size = int(count)
+	}
+
+	sr := bleve.NewSearchRequestOptions(q, size, bq.from, false)
+	sr.Fields = []string{fieldSource}
+	sr.SortByCustom(bq.sortOrder())
+	result, err := bq.b.index.Search(sr)
+	if err != nil {
+		x.LogErr(log, err).Error("While running query")
+		return nil, err
+	}
+	return result, nil
+}
+
+func toDoc(hit *bsearch.DocumentMatch) (doc x.Doc, rerr error) {
+	src, ok := hit.Fields[fieldSource].(string)
+	if !ok {
+		return doc, errors.New("Source not found for doc: " + hit.ID)
+	}
+	if err := json.Unmarshal([]byte(src), &doc); err != nil {
+		x.LogErr(log, err).Error("While unmarshal hit")
+		return doc, err
+	}
+	return doc, nil
+}
+
+// Run runs the query and returns results and error, if any.
+func (bq *BleveQuery) Run() (docs []x.Doc, rerr error) {
+	result, err := bq.search()
+	if err != nil {
+		return docs, err
+	}
+	for _, hit := range result.Hits {
+		doc, err := toDoc(hit)
+		if err != nil {
+			return docs, err
+		}
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
+
+// dataValue returns the value at the dotted field path in doc data, or nil
+// if it's missing.
+func dataValue(doc x.Doc, field string) interface{} {
+	val := doc.Data
+	for _, part := range strings.Split(dataField(field), ".") {
+		m, ok := val.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		val = m[part]
+	}
+	return val
+}
+
+// RunPage runs the query, and generates the cursor from the values of the
+// sort fields in the last doc.
+func (bq *BleveQuery) RunPage() (docs []x.Doc, cursor string, rerr error) {
+	docs, err := bq.Run()
+	if err != nil || len(docs) == 0 {
+		return docs, "", err
+	}
+	last := docs[len(docs)-1]
+	c := search.Cursor{Kind: bq.kind, Id: last.Id}
+	for _, key := range bq.order {
+		c.Values = append(c.Values, dataValue(last, key.Field))
+	}
+	return docs, c.Encode(), nil
+}
+
+// Count runs the query without fetching any docs.
+func (bq *BleveQuery) Count() (rcount int64, rerr error) {
+	q, err := bq.generateQuery(false)
+	if err != nil {
+		return 0, err
+	}
+	result, err := bq.b.index.Search(bleve.NewSearchRequestOptions(q, 0, 0, false))
+	if err != nil {
+		x.LogErr(log, err).Error("While counting")
+		return 0, err
+	}
+	return int64(result.Total), nil
+}
@@ -18,6 +18,10 @@ package cassandra
 
 import (
 	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/aslanides/gocrud/store"
 	"github.com/aslanides/gocrud/x"
@@ -31,6 +35,12 @@ type Cassandra struct {
 }
 
 var kIsNew, kInsert, kSelect, kScan string
+var kInsertTime, kSinceStart, kSinceNext string
+var kScanRange, kSelectKeys, kDelete string
+
+// Instructions are also indexed by commit time, in the table
+// <tablename>_by_time, partitioned by the hour they were committed in.
+const bucketSize = int64(time.Hour)
 
 func (cs *Cassandra) SetSession(session *gocql.Session) {
 	cs.session = session
@@ -44,6 +54,20 @@ func (cs *Cassandra) setTableName(tablename string) {
 	object_id, nano_ts, source from %s where subject_id = ?`, tablename)
 	kScan = fmt.Sprintf(`select subject_type, subject_id
 	from %s where token(subject_id) > token(?) limit ?`, tablename)
+	kScanRange = fmt.Sprintf(`select subject_type, subject_id, token(subject_id)
+	from %s where token(subject_id) > ? and token(subject_id) <= ? limit ?`,
+		tablename)
+	kSelectKeys = fmt.Sprintf(`select ts, predicate, object_id, source, nano_ts from %s
+	where subject_id = ?`, tablename)
+	kDelete = fmt.Sprintf("delete from %s where subject_id = ? and ts = ?", tablename)
+
+	kInsertTime = fmt.Sprintf(`insert into %s_by_time (bucket, nano_ts, subject_id,
+	subject_type) values (?, ?, ?, ?)`, tablename)
+	kSinceStart = fmt.Sprintf(`select nano_ts, subject_id, subject_type
+	from %s_by_time where bucket = ? and nano_ts > ? limit ?`, tablename)
+	kSinceNext = fmt.Sprintf(`select nano_ts, subject_id, subject_type
+	from %s_by_time where bucket = ? and (nano_ts, subject_id) > (?, ?) limit ?`,
+		tablename)
 }
 
 func (cs *Cassandra) Init(args ...string) {
@@ -105,6 +129,8 @@ func (cs *Cassandra) Commit(its []*x.Instruction) error {
 	for _, it := range its {
 		b.Query(kInsert, it.SubjectId, it.SubjectType, it.Predicate,
 			it.Object, it.ObjectId, it.NanoTs, it.Source)
+		b.Query(kInsertTime, it.NanoTs/bucketSize, it.NanoTs, it.SubjectId,
+			it.SubjectType)
 	}
 	if err := cs.session.ExecuteBatch(b); err != nil {
 		x.LogErr(log, err).Error("While executing batch")
@@ -128,6 +154,45 @@ func (cs *Cassandra) GetEntity(subject string) (
 	return result, nil
 }
 
+// Delete looks up the ts of the matching rows, and deletes them in a batch.
+// Their entries in the time index are left as is, which at worst causes
+// the entity to be re-indexed once more.
+func (cs *Cassandra) Delete(subject string, its []x.Instruction) error {
+	type match struct {
+		pred     string
+		objectId string
+		source   string
+		ts       int64
+	}
+	drop := make(map[match]bool)
+	for _, it := range its {
+		drop[match{it.Predicate, it.ObjectId, it.Source, it.NanoTs}] = true
+	}
+
+	b := cs.session.NewBatch(gocql.LoggedBatch)
+	iter := cs.session.Query(kSelectKeys, subject).Iter()
+	var ts gocql.UUID
+	var pred, objectId, source string
+	var nanoTs int64
+	for iter.Scan(&ts, &pred, &objectId, &source, &nanoTs) {
+		if drop[match{pred, objectId, source, nanoTs}] {
+			b.Query(kDelete, subject, ts)
+		}
+	}
+	if err := iter.Close(); err != nil {
+		x.LogErr(log, err).Error("While iterating")
+		return err
+	}
+	if b.Size() == 0 {
+		return nil
+	}
+	if err := cs.session.ExecuteBatch(b); err != nil {
+		x.LogErr(log, err).Error("While deleting")
+		return err
+	}
+	return nil
+}
+
 func (cs *Cassandra) Iterate(fromId string, num int,
 	ch chan x.Entity) (rnum int, rlast x.Entity, rerr error) {
 
@@ -154,6 +219,143 @@ func (cs *Cassandra) Iterate(fromId string, num int,
 	return rnum, rlast, nil
 }
 
+// sinceCursor is the position in the time index, encoded as
+// "<bucket> <nano_ts> <subject_id>".
+type sinceCursor struct {
+	bucket int64
+	nanoTs int64
+	id     string
+}
+
+func parseSinceCursor(cursor string) (c sinceCursor, rerr error) {
+	parts := strings.SplitN(cursor, " ", 3)
+	if len(parts) != 3 {
+		return c, fmt.Errorf("Invalid cursor: %v", cursor)
+	}
+	if c.bucket, rerr = strconv.ParseInt(parts[0], 10, 64); rerr != nil {
+		return
+	}
+	if c.nanoTs, rerr = strconv.ParseInt(parts[1], 10, 64); rerr != nil {
+		return
+	}
+	c.id = parts[2]
+	return c, nil
+}
+
+func (c sinceCursor) String() string {
+	return fmt.Sprintf("%d %d %s", c.bucket, c.nanoTs, c.id)
+}
+
+// IterateSince walks the time index one bucket at a time, from the bucket
+// of nanoTs, to the current one. So nanoTs shouldn't be too far back, for
+// e.g. use Iterate for a full scan, instead of nanoTs as zero.
+func (cs *Cassandra) IterateSince(nanoTs int64, cursor string, num int,
+	ch chan x.Entity) (rnum int, rnext string, rerr error) {
+
+	pos := sinceCursor{bucket: nanoTs / bucketSize, nanoTs: nanoTs}
+	if len(cursor) > 0 {
+		if pos, rerr = parseSinceCursor(cursor); rerr != nil {
+			return 0, cursor, rerr
+		}
+	}
+	rnext = cursor
+	now := time.Now().UnixNano() / bucketSize
+	handled := make(map[x.Entity]bool)
+	for pos.bucket <= now && rnum < num {
+		var q *gocql.Query
+		if len(pos.id) == 0 {
+			q = cs.session.Query(kSinceStart, pos.bucket, pos.nanoTs, num)
+		} else {
+			q = cs.session.Query(kSinceNext, pos.bucket, pos.nanoTs, pos.id, num)
+		}
+		iter := q.Iter()
+		var ts int64
+		var e x.Entity
+		rows := 0
+		for rnum < num && iter.Scan(&ts, &e.Id, &e.Kind) {
+			rows += 1
+			pos.nanoTs, pos.id = ts, e.Id
+			rnext = pos.String()
+			if _, present := handled[e]; present {
+				continue
+			}
+			ch <- e
+			handled[e] = true
+			rnum += 1
+		}
+		if err := iter.Close(); err != nil {
+			x.LogErr(log, err).Error("While closing iterator")
+			return rnum, rnext, err
+		}
+		// A full page may have more rows in the same bucket, past the limit.
+		if rnum < num && rows < num {
+			pos = sinceCursor{bucket: pos.bucket + 1}
+		}
+	}
+	return rnum, rnext, nil
+}
+
+// Partitions splits the Murmur3 token range into n equal ranges, encoded
+// as decimal tokens. Start is exclusive, and End inclusive.
+func (cs *Cassandra) Partitions(n int) ([]store.Partition, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("Invalid number of partitions: %v", n)
+	}
+	step := uint64(math.MaxUint64) / uint64(n)
+	parts := make([]store.Partition, n)
+	start := int64(math.MinInt64)
+	for i := range parts {
+		end := start + int64(step)
+		if i == n-1 {
+			end = math.MaxInt64
+		}
+		parts[i].Start = strconv.FormatInt(start, 10)
+		parts[i].End = strconv.FormatInt(end, 10)
+		start = end
+	}
+	return parts, nil
+}
+
+// IteratePartition scans over the token range of p, using the last token
+// returned as the cursor. As all the instructions for an entity share a
+// token, entities are returned once per partition.
+func (cs *Cassandra) IteratePartition(p store.Partition, cursor string, num int,
+	ch chan x.Entity) (rnum int, rnext string, rerr error) {
+
+	from := p.Start
+	if len(cursor) > 0 {
+		from = cursor
+	}
+	start, err := strconv.ParseInt(from, 10, 64)
+	if err != nil {
+		return 0, cursor, err
+	}
+	end, err := strconv.ParseInt(p.End, 10, 64)
+	if err != nil {
+		return 0, cursor, err
+	}
+
+	rnext = cursor
+	iter := cs.session.Query(kScanRange, start, end, num).Iter()
+	var e x.Entity
+	var token int64
+	handled := make(map[x.Entity]bool)
+	for rnum < num && iter.Scan(&e.Kind, &e.Id, &token) {
+		rnext = strconv.FormatInt(token, 10)
+		if _, present := handled[e]; present {
+			continue
+		}
+		ch <- e
+		handled[e] = true
+		rnum += 1
+	}
+	if err := iter.Close(); err != nil {
+		x.LogErr(log, err).Error("While closing iterator")
+		return rnum, rnext, err
+	}
+	return rnum, rnext, nil
+}
+
 func init() {
 	log.Info("Initing cassandra")
 	store.Register("cassandra", new(Cassandra))
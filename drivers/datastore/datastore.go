@@ -102,6 +102,116 @@ func (ds *Datastore) GetEntity(subject string) (reply []x.Instruction, rerr erro
 	return
 }
 
+// Delete looks up the keys of the matching instructions, and deletes them.
+func (ds *Datastore) Delete(subject string, its []x.Instruction) error {
+	type match struct {
+		pred     string
+		objectId string
+		source   string
+		ts       int64
+	}
+	drop := make(map[match]bool)
+	for _, i := range its {
+		drop[match{i.Predicate, i.ObjectId, i.Source, i.NanoTs}] = true
+	}
+
+	client, err := datastore.NewClient(ds.ctx, ds.projectId)
+	if err != nil {
+		x.LogErr(log, err).Error("While creating client")
+		return err
+	}
+	skey := datastore.NewKey(ds.ctx, ds.tablePrefix+"Entity", subject, 0, nil)
+	q := datastore.NewQuery(ds.tablePrefix + "Instruction").Ancestor(skey)
+	var reply []x.Instruction
+	dkeys, err := client.GetAll(ds.ctx, q, &reply)
+	if err != nil {
+		x.LogErr(log, err).Error("While GetAll")
+		return err
+	}
+	var keys []*datastore.Key
+	for idx, i := range reply {
+		if drop[match{i.Predicate, i.ObjectId, i.Source, i.NanoTs}] {
+			keys = append(keys, dkeys[idx])
+		}
+	}
+	if err := ds.deleteKeys(client, keys); err != nil {
+		return err
+	}
+	log.Debugf("%d Instructions deleted", len(keys))
+	return nil
+}
+
+// PurgeSource pages over the instructions written by source, deleting
+// each page before fetching the next.
+func (ds *Datastore) PurgeSource(source string) ([]x.Entity, int, error) {
+	client, err := datastore.NewClient(ds.ctx, ds.projectId)
+	if err != nil {
+		x.LogErr(log, err).Error("While creating client")
+		return nil, 0, err
+	}
+
+	var entities []x.Entity
+	handled := make(map[x.Entity]bool)
+	removed := 0
+	q := datastore.NewQuery(ds.tablePrefix+"Instruction").
+		Filter("Source =", source).Limit(maxDeleteKeys)
+	for {
+		t := client.Run(ds.ctx, q)
+		var keys []*datastore.Key
+		for {
+			var i x.Instruction
+			key, err := t.Next(&i)
+			if err == datastore.Done {
+				break
+			}
+			if err != nil {
+				x.LogErr(log, err).Error("While iterating")
+				return entities, removed, err
+			}
+			keys = append(keys, key)
+			e := x.Entity{Kind: i.SubjectType, Id: i.SubjectId}
+			if !handled[e] {
+				entities = append(entities, e)
+				handled[e] = true
+			}
+		}
+		if len(keys) == 0 {
+			return entities, removed, nil
+		}
+		cursor, err := t.Cursor()
+		if err != nil {
+			x.LogErr(log, err).Error("While getting cursor")
+			return entities, removed, err
+		}
+		if err := ds.deleteKeys(client, keys); err != nil {
+			return entities, removed, err
+		}
+		removed += len(keys)
+		if len(keys) < maxDeleteKeys {
+			return entities, removed, nil
+		}
+		q = q.Start(cursor)
+	}
+}
+
+// Datastore caps the number of keys per DeleteMulti call.
+const maxDeleteKeys = 500
+
+func (ds *Datastore) deleteKeys(client *datastore.Client, keys []*datastore.Key) error {
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > maxDeleteKeys {
+			n = maxDeleteKeys
+		}
+		if err := client.DeleteMulti(ds.ctx, keys[:n]); err != nil {
+			x.LogErr(log, err).Error("While deleting instructions")
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
 func (ds *Datastore) Iterate(fromId string, num int, ch chan x.Entity) (found int, last x.Entity, err error) {
 	log.Fatal("Not implemented")
 	return
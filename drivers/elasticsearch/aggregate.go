@@ -0,0 +1,187 @@
+package elasticsearch
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/aslanides/gocrud/search"
+	"github.com/aslanides/gocrud/x"
+	"gopkg.in/olivere/elastic.v2"
+)
+
+// Aggregate adds the aggregation, which would be mapped onto the
+// corresponding Elastic Search aggregation when run.
+func (eq *ElasticQuery) Aggregate(name string,
+	agg *search.Aggregation) search.Query {
+
+	if eq.aggs == nil {
+		eq.aggs = make(map[string]*search.Aggregation)
+	}
+	eq.aggs[name] = agg
+	return eq
+}
+
+// RunAggregations runs the query without fetching any docs, and converts
+// the aggregation results back.
+func (eq *ElasticQuery) RunAggregations() (
+	map[string]*search.AggregationResult, error) {
+
+	ss := eq.client.Search(eq.index).Type(eq.kind).Size(0)
+	if eq.hasQuery() {
+		q, err := eq.generateQuery()
+		if err != nil {
+			return nil, err
+		}
+		ss = ss.Query(q)
+	}
+	for name, agg := range eq.aggs {
+		ea, err := toElasticAgg(agg)
+		if err != nil {
+			return nil, err
+		}
+		ss = ss.Aggregation(name, ea)
+	}
+
+	result, err := ss.Do()
+	if err != nil {
+		x.LogErr(log, err).Error("While running aggregations")
+		return nil, err
+	}
+	return fromElasticAggs(result.Aggregations, eq.aggs)
+}
+
+func toElasticSubs(agg *search.Aggregation) (map[string]elastic.Aggregation, error) {
+	subs := make(map[string]elastic.Aggregation)
+	for name, sub := range agg.Subs {
+		ea, err := toElasticAgg(sub)
+		if err != nil {
+			return nil, err
+		}
+		subs[name] = ea
+	}
+	return subs, nil
+}
+
+func toElasticAgg(agg *search.Aggregation) (elastic.Aggregation, error) {
+	subs, err := toElasticSubs(agg)
+	if err != nil {
+		return nil, err
+	}
+
+	switch agg.Type {
+	case search.AggStats:
+		return elastic.NewStatsAggregation().Field(agg.Field), nil
+
+	case search.AggTerms:
+		ea := elastic.NewTermsAggregation().Field(agg.Field)
+		if agg.Size > 0 {
+			ea = ea.Size(agg.Size)
+		}
+		for name, sub := range subs {
+			ea = ea.SubAggregation(name, sub)
+		}
+		return ea, nil
+
+	case search.AggHistogram:
+		ea := elastic.NewHistogramAggregation().Field(agg.Field).
+			Interval(agg.Interval)
+		for name, sub := range subs {
+			ea = ea.SubAggregation(name, sub)
+		}
+		return ea, nil
+
+	case search.AggDateHistogram:
+		ms := int64(agg.Period / time.Millisecond)
+		ea := elastic.NewDateHistogramAggregation().Field(agg.Field).
+			Interval(fmt.Sprintf("%dms", ms))
+		for name, sub := range subs {
+			ea = ea.SubAggregation(name, sub)
+		}
+		return ea, nil
+	}
+	return nil, errors.New("Invalid aggregation type: " + agg.Type)
+}
+
+func fromElasticAggs(ea elastic.Aggregations,
+	aggs map[string]*search.Aggregation) (
+	map[string]*search.AggregationResult, error) {
+
+	if len(aggs) == 0 {
+		return nil, nil
+	}
+	results := make(map[string]*search.AggregationResult)
+	for name, agg := range aggs {
+		r, err := fromElasticAgg(ea, name, agg)
+		if err != nil {
+			return nil, err
+		}
+		results[name] = r
+	}
+	return results, nil
+}
+
+func value(f *float64) float64 {
+	if f == nil {
+		return 0
+	}
+	return *f
+}
+
+func fromElasticAgg(ea elastic.Aggregations, name string,
+	agg *search.Aggregation) (*search.AggregationResult, error) {
+
+	result := new(search.AggregationResult)
+	switch agg.Type {
+	case search.AggStats:
+		st, found := ea.Stats(name)
+		if !found {
+			return nil, errors.New("Aggregation not found: " + name)
+		}
+		result.Stats = &search.StatsResult{
+			Count: st.Count,
+			Min:   value(st.Min),
+			Max:   value(st.Max),
+			Avg:   value(st.Avg),
+			Sum:   value(st.Sum),
+		}
+
+	case search.AggTerms:
+		items, found := ea.Terms(name)
+		if !found {
+			return nil, errors.New("Aggregation not found: " + name)
+		}
+		for _, item := range items.Buckets {
+			subs, err := fromElasticAggs(item.Aggregations, agg.Subs)
+			if err != nil {
+				return nil, err
+			}
+			result.Buckets = append(result.Buckets,
+				search.Bucket{Key: item.Key, Count: item.DocCount, Subs: subs})
+		}
+
+	case search.AggHistogram, search.AggDateHistogram:
+		var items *elastic.AggregationBucketHistogramItems
+		var found bool
+		if agg.Type == search.AggHistogram {
+			items, found = ea.Histogram(name)
+		} else {
+			items, found = ea.DateHistogram(name)
+		}
+		if !found {
+			return nil, errors.New("Aggregation not found: " + name)
+		}
+		for _, item := range items.Buckets {
+			subs, err := fromElasticAggs(item.Aggregations, agg.Subs)
+			if err != nil {
+				return nil, err
+			}
+			result.Buckets = append(result.Buckets,
+				search.Bucket{Key: item.Key, Count: item.DocCount, Subs: subs})
+		}
+
+	default:
+		return nil, errors.New("Invalid aggregation type: " + agg.Type)
+	}
+	return result, nil
+}
@@ -1,8 +1,12 @@
 package elasticsearch
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
 	"reflect"
+	"strings"
+	"sync"
 
 	"github.com/aslanides/gocrud/search"
 	"github.com/aslanides/gocrud/x"
@@ -14,28 +18,48 @@ var log = x.Log("elasticsearch")
 // Elastic encapsulates elastic search client, and implements methods declared
 // by search.Engine.
 type Elastic struct {
-	client *elastic.Client
+	sync.Mutex
+	client   *elastic.Client
+	prefix   string
+	mappings map[string]map[string]interface{} // kind -> mapping.
+	kinds    map[string]*kindIndex             // Guarded by mutex.
 }
 
 // ElasticQuery implements methods declared by search.Query.
 type ElasticQuery struct {
-	client     *elastic.Client
-	sort       string
-	from       int
-	limit      int
-	kind       string
-	filter     *ElasticFilter
-	filterType int // 0 = no filter, 1 = AND, 2 = OR
+	client   *elastic.Client
+	index    string // Alias for the index of kind.
+	order    []search.SortKey
+	missing  string
+	from     int
+	limit    int
+	kind     string
+	filter   *ElasticFilter // Root filter, AND of all the filters set on query.
+	matches  []elastic.Query
+	aggs     map[string]*search.Aggregation
+	after    *search.Cursor
+	afterErr error
 }
 
+// ElasticFilter is a group of filters, and nested filter groups, which are
+// combined via 'and' or 'or' directives.
 type ElasticFilter struct {
-	filters []elastic.Filter
+	filterType int // 1 = AND, 2 = OR
+	negate     bool
+	filters    []elastic.Filter
+	groups     []*ElasticFilter
+	err        error // Set by invalid filters, returned once query runs.
 }
 
-// Init initializes connection to Elastic Search instance, checks for
-// existence of "gocrud" index and creates it, if missing. Note that
-// Init does NOT do mapping necessary to do exact-value term matching
-// for strings etc. That needs to be done externally.
+// ElasticNotFilter wraps the next filter added to it in a 'not' directive,
+// before passing it on to the parent ElasticFilter.
+type ElasticNotFilter struct {
+	parent *ElasticFilter
+}
+
+// Init initializes connection to Elastic Search instance, and sets up the
+// indices for all the kinds with mappings registered via SetMapping. Other
+// kinds get their indices created on first use, with dynamic mapping.
 func (es *Elastic) Init(args ...string) {
 	if len(args) != 1 {
 		log.WithField("args", args).Fatal("Invalid arguments")
@@ -59,32 +83,69 @@ func (es *Elastic) Init(args ...string) {
 	}
 	log.WithField("version", version).Debug("ElasticSearch version")
 
-	// Use the IndexExists service to check if a specified index exists.
-	exists, err := client.IndexExists("gocrud").Do()
-	if err != nil {
-		x.LogErr(log, err).Fatal("Unable to query index existence.")
-		return
+	es.client = client
+	if len(es.prefix) == 0 {
+		es.prefix = "gocrud"
 	}
-	if !exists {
-		// Create a new index.
-		createIndex, err := client.CreateIndex("gocrud").Do()
-		if err != nil {
-			x.LogErr(log, err).Fatal("Unable to create index.")
+	es.kinds = make(map[string]*kindIndex)
+	for kind := range es.mappings {
+		if err := es.ensureIndex(kind); err != nil {
+			x.LogErr(log, err).WithField("kind", kind).Fatal("Unable to set up index.")
 			return
 		}
-		if !createIndex.Acknowledged {
-			// Not acknowledged
-			log.Errorf("Create index not acknowledged. Not sure what that means...")
-		}
 	}
-	es.client = client
 	log.Debug("Connected with ElasticSearch")
 }
 
-// DropIndex is useful for testing purposes.
-func (es *Elastic) DropIndex() error {
-	_, err := es.client.DeleteIndex("gocrud").Do()
-	return err
+// DropIndex deletes the indices behind the aliases of the given kinds, and
+// all the kinds used, or with a mapping registered. Indices of other
+// prefixes are left alone. Useful for testing purposes.
+func (es *Elastic) DropIndex(extra ...string) error {
+	kinds := make(map[string]bool)
+	for _, kind := range extra {
+		kinds[kind] = true
+	}
+	es.Lock()
+	for kind := range es.kinds {
+		kinds[kind] = true
+	}
+	for kind := range es.mappings {
+		kinds[kind] = true
+	}
+	es.Unlock()
+
+	var rerr error
+	for kind := range kinds {
+		if err := es.dropIndex(kind); err != nil {
+			x.LogErr(log, err).WithField("kind", kind).Error("While dropping index")
+			rerr = err
+		}
+	}
+	return rerr
+}
+
+// dropIndex deletes the indices behind the alias for kind, so it gets set
+// up again on next use.
+func (es *Elastic) dropIndex(kind string) error {
+	ki := es.indexFor(kind)
+	ki.setup.Lock()
+	defer ki.setup.Unlock()
+	ki.ready = false
+
+	exists, err := es.client.IndexExists(es.alias(kind)).Do()
+	if err != nil || !exists {
+		return err
+	}
+	names, err := es.aliasedIndices(kind)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if _, err := es.client.DeleteIndex(name).Do(); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 // Update checks the validify of given document, and the.
@@ -94,8 +155,25 @@ func (es *Elastic) Update(doc x.Doc) error {
 		return errors.New("Invalid document")
 	}
 
-	result, err := es.client.Index().Index("gocrud").Type(doc.Kind).Id(doc.Id).
+	if err := es.ensureIndex(doc.Kind); err != nil {
+		return err
+	}
+	targets, unlock := es.lockWrites(doc.Kind)
+	defer unlock()
+	if target := targets[doc.Kind]; len(target) > 0 {
+		if err := es.index(target, doc); err != nil && err != search.ErrConflict {
+			return err
+		}
+	}
+	return es.index(es.alias(doc.Kind), doc)
+}
+
+func (es *Elastic) index(index string, doc x.Doc) error {
+	result, err := es.client.Index().Index(index).Type(doc.Kind).Id(doc.Id).
 		VersionType("external").Version(doc.NanoTs).BodyJson(doc).Do()
+	if isConflict(err) {
+		return search.ErrConflict
+	}
 	if err != nil {
 		x.LogErr(log, err).WithField("doc", doc).Error("While indexing doc")
 		return err
@@ -104,18 +182,260 @@ func (es *Elastic) Update(doc x.Doc) error {
 	return nil
 }
 
-func (eq *ElasticQuery) NewAndFilter() search.FilterQuery {
-	eq.filter = new(ElasticFilter)
-	eq.filterType = 1
+// isConflict returns true if err is due to a version conflict.
+func isConflict(err error) bool {
+	if e, ok := err.(*elastic.Error); ok {
+		return e.Status == 409
+	}
+	return false
+}
+
+// Delete removes the doc, using external versioning via nanoTs. Note that
+// Elastic Search only retains versions of deleted docs for a while
+// (index.gc_deletes), after which an older update could bring it back.
+func (es *Elastic) Delete(kind, id string, nanoTs int64) error {
+	if id == "" || kind == "" || nanoTs == 0 {
+		return errors.New("Invalid document")
+	}
 
-	return eq.filter
+	if err := es.ensureIndex(kind); err != nil {
+		return err
+	}
+	targets, unlock := es.lockWrites(kind)
+	defer unlock()
+	if target := targets[kind]; len(target) > 0 {
+		err := es.delete(target, kind, id, nanoTs)
+		if err != nil && err != search.ErrConflict {
+			return err
+		}
+	}
+	return es.delete(es.alias(kind), kind, id, nanoTs)
+}
+
+func (es *Elastic) delete(index, kind, id string, nanoTs int64) error {
+	result, err := es.client.Delete().Index(index).Type(kind).Id(id).
+		VersionType("external").Version(nanoTs).Do()
+	if isConflict(err) {
+		return search.ErrConflict
+	}
+	if err != nil {
+		x.LogErr(log, err).WithField("kind", kind).WithField("id", id).
+			Error("While deleting doc")
+		return err
+	}
+	log.Debug("delete_result", result)
+	return nil
+}
+
+func (es *Elastic) Get(kind, id string) (doc x.Doc, rerr error) {
+	if err := es.ensureIndex(kind); err != nil {
+		return doc, err
+	}
+	result, err := es.client.Get().Index(es.alias(kind)).Type(kind).Id(id).Do()
+	if e, ok := err.(*elastic.Error); ok && e.Status == 404 {
+		return doc, search.ErrNotFound
+	}
+	if err != nil {
+		x.LogErr(log, err).WithField("kind", kind).WithField("id", id).
+			Error("While getting doc")
+		return doc, err
+	}
+	if !result.Found || result.Source == nil {
+		return doc, search.ErrNotFound
+	}
+	err = json.Unmarshal(*result.Source, &doc)
+	return doc, err
+}
+
+// bulkRequest returns the bulk request to update doc in index, or delete
+// it if marked deleted. Both use external versioning via NanoTs.
+func bulkRequest(index string, doc x.Doc) elastic.BulkableRequest {
+	if doc.Deleted {
+		return elastic.NewBulkDeleteRequest().Index(index).Type(doc.Kind).
+			Id(doc.Id).VersionType("external").Version(doc.NanoTs)
+	}
+	return elastic.NewBulkIndexRequest().Index(index).Type(doc.Kind).
+		Id(doc.Id).VersionType("external").Version(doc.NanoTs).Doc(doc)
 }
 
+// UpdateMany uses the bulk api to update the docs, or delete the ones
+// marked deleted. While a kind is being reindexed, docs are written to
+// the new index as well.
+func (es *Elastic) UpdateMany(docs []x.Doc) []error {
+	errs := make([]error, len(docs))
+	var kinds []string
+	for i, doc := range docs {
+		if doc.Id == "" || doc.Kind == "" || doc.NanoTs == 0 {
+			errs[i] = errors.New("Invalid document")
+			continue
+		}
+		if err := es.ensureIndex(doc.Kind); err != nil {
+			errs[i] = err
+			continue
+		}
+		kinds = append(kinds, doc.Kind)
+	}
+	targets, unlock := es.lockWrites(kinds...)
+	defer unlock()
+
+	bulk := es.client.Bulk()
+	var owners []int // Position of doc, for each request in bulk.
+	for i, doc := range docs {
+		if errs[i] != nil {
+			continue
+		}
+		if target := targets[doc.Kind]; len(target) > 0 {
+			bulk = bulk.Add(bulkRequest(target, doc))
+			owners = append(owners, -i-1) // Negative for the new index.
+		}
+		bulk = bulk.Add(bulkRequest(es.alias(doc.Kind), doc))
+		owners = append(owners, i)
+	}
+	if len(owners) == 0 {
+		return errs
+	}
+
+	resp, err := bulk.Do()
+	if err != nil {
+		x.LogErr(log, err).WithField("num_docs", len(docs)).
+			Error("While bulk indexing docs")
+		for _, i := range owners {
+			if i >= 0 {
+				errs[i] = err
+			}
+		}
+		return errs
+	}
+	for idx, item := range resp.Items {
+		if idx >= len(owners) {
+			break
+		}
+		i := owners[idx]
+		primary := i >= 0
+		if !primary {
+			i = -i - 1
+		}
+		for _, result := range item {
+			if result.Status >= 200 && result.Status < 300 {
+				continue
+			}
+			if result.Status == 404 && docs[i].Deleted {
+				continue // Doc wasn't indexed yet.
+			}
+			if result.Status == 409 {
+				// For the new index, doc was already copied over with
+				// a newer version.
+				if primary {
+					errs[i] = search.ErrConflict
+				}
+				continue
+			}
+			errs[i] = fmt.Errorf("Status %d: %v", result.Status, result.Error)
+		}
+	}
+	return errs
+}
+
+// DeleteByQuery uses the delete by query api, over the docs of the
+// query kind.
+func (es *Elastic) DeleteByQuery(q search.Query) error {
+	eq, ok := q.(*ElasticQuery)
+	if !ok {
+		return errors.New("Query not created by this engine")
+	}
+
+	targets, unlock := es.lockWrites(eq.kind)
+	defer unlock()
+	indices := []string{eq.index}
+	if target := targets[eq.kind]; len(target) > 0 {
+		indices = append(indices, target)
+	}
+	ds := es.client.DeleteByQuery().Index(indices...).Type(eq.kind)
+	if eq.hasQuery() {
+		fq, err := eq.generateQuery()
+		if err != nil {
+			return err
+		}
+		ds = ds.Query(fq)
+	} else {
+		ds = ds.Query(elastic.NewMatchAllQuery())
+	}
+	result, err := ds.Do()
+	if err != nil {
+		x.LogErr(log, err).WithField("kind", eq.kind).Error("While deleting by query")
+		return err
+	}
+	log.Debug("delete_by_query_result", result)
+	return nil
+}
+
+// NewAndFilter adds a new 'and' filter group to the query. If called more
+// than once, or along with NewOrFilter, all the groups need to match.
+func (eq *ElasticQuery) NewAndFilter() search.FilterQuery {
+	if eq.filter == nil {
+		eq.filter = &ElasticFilter{filterType: 1}
+	}
+	return eq.filter.And()
+}
+
+// NewOrFilter adds a new 'or' filter group to the query.
 func (eq *ElasticQuery) NewOrFilter() search.FilterQuery {
-	eq.filter = new(ElasticFilter)
-	eq.filterType = 2
+	if eq.filter == nil {
+		eq.filter = &ElasticFilter{filterType: 1}
+	}
+	return eq.filter.Or()
+}
 
-	return eq.filter
+func (ef *ElasticFilter) addGroup(filterType int) *ElasticFilter {
+	group := &ElasticFilter{filterType: filterType}
+	ef.groups = append(ef.groups, group)
+	return group
+}
+
+// And adds a nested 'and' filter group.
+func (ef *ElasticFilter) And() search.FilterQuery {
+	return ef.addGroup(1)
+}
+
+// Or adds a nested 'or' filter group.
+func (ef *ElasticFilter) Or() search.FilterQuery {
+	return ef.addGroup(2)
+}
+
+// build converts the filter group to elastic filter directives, recursively.
+// Returns false if the group, and all its nested groups, are empty.
+func (ef *ElasticFilter) build() (elastic.Filter, bool, error) {
+	if ef.filterType != 1 && ef.filterType != 2 {
+		return nil, false, errors.New("Invalid filter type")
+	}
+	if ef.err != nil {
+		return nil, false, ef.err
+	}
+
+	filters := append([]elastic.Filter{}, ef.filters...)
+	for _, group := range ef.groups {
+		f, ok, err := group.build()
+		if err != nil {
+			return nil, false, err
+		}
+		if ok {
+			filters = append(filters, f)
+		}
+	}
+	if len(filters) == 0 {
+		return nil, false, nil
+	}
+
+	var f elastic.Filter
+	if ef.filterType == 1 {
+		f = elastic.NewAndFilter(filters...)
+	} else {
+		f = elastic.NewOrFilter(filters...)
+	}
+	if ef.negate {
+		f = elastic.NewNotFilter(f)
+	}
+	return f, true, nil
 }
 
 // AddExact implemented by ElasticSearch uses the 'term' directive.
@@ -141,12 +461,144 @@ func (ef *ElasticFilter) AddRegex(field string,
 	return ef
 }
 
-// Order sorts the results for the given field.
-func (eq *ElasticQuery) Order(field string) search.Query {
-	eq.sort = field
+// AddRange uses range filter directive.
+func (ef *ElasticFilter) AddRange(field string, op string,
+	value interface{}) search.FilterQuery {
+
+	rf := elastic.NewRangeFilter(field)
+	switch op {
+	case search.Gt:
+		rf = rf.Gt(value)
+	case search.Gte:
+		rf = rf.Gte(value)
+	case search.Lt:
+		rf = rf.Lt(value)
+	case search.Lte:
+		rf = rf.Lte(value)
+	default:
+		ef.err = errors.New("Invalid range operator: " + op)
+		return ef
+	}
+	ef.filters = append(ef.filters, rf)
+	return ef
+}
+
+// AddExists uses exists filter directive.
+func (ef *ElasticFilter) AddExists(field string) search.FilterQuery {
+	ef.filters = append(ef.filters, elastic.NewExistsFilter(field))
+	return ef
+}
+
+// AddMissing uses missing filter directive.
+func (ef *ElasticFilter) AddMissing(field string) search.FilterQuery {
+	ef.filters = append(ef.filters, elastic.NewMissingFilter(field))
+	return ef
+}
+
+// AddIn uses the 'terms' directive. The same caveats regarding string
+// mappings apply here, as they do for AddExact.
+func (ef *ElasticFilter) AddIn(field string,
+	values ...interface{}) search.FilterQuery {
+
+	ef.filters = append(ef.filters, elastic.NewTermsFilter(field, values...))
+	return ef
+}
+
+// Not would wrap the next filter added in a 'not' directive.
+func (ef *ElasticFilter) Not() search.FilterQuery {
+	return &ElasticNotFilter{parent: ef}
+}
+
+func (nf *ElasticNotFilter) negate() *ElasticFilter {
+	last := len(nf.parent.filters) - 1
+	if last >= 0 {
+		nf.parent.filters[last] = elastic.NewNotFilter(nf.parent.filters[last])
+	}
+	return nf.parent
+}
+
+func (nf *ElasticNotFilter) AddExact(field string,
+	value interface{}) search.FilterQuery {
+	nf.parent.AddExact(field, value)
+	return nf.negate()
+}
+
+func (nf *ElasticNotFilter) AddRegex(field string,
+	value string) search.FilterQuery {
+	nf.parent.AddRegex(field, value)
+	return nf.negate()
+}
+
+func (nf *ElasticNotFilter) AddRange(field string, op string,
+	value interface{}) search.FilterQuery {
+	before := len(nf.parent.filters)
+	nf.parent.AddRange(field, op, value)
+	if len(nf.parent.filters) == before {
+		return nf.parent // Invalid range, nothing to negate.
+	}
+	return nf.negate()
+}
+
+func (nf *ElasticNotFilter) AddExists(field string) search.FilterQuery {
+	nf.parent.AddExists(field)
+	return nf.negate()
+}
+
+func (nf *ElasticNotFilter) AddMissing(field string) search.FilterQuery {
+	nf.parent.AddMissing(field)
+	return nf.negate()
+}
+
+func (nf *ElasticNotFilter) AddIn(field string,
+	values ...interface{}) search.FilterQuery {
+	nf.parent.AddIn(field, values...)
+	return nf.negate()
+}
+
+// And adds a negated nested 'and' filter group.
+func (nf *ElasticNotFilter) And() search.FilterQuery {
+	group := nf.parent.addGroup(1)
+	group.negate = true
+	return group
+}
+
+// Or adds a negated nested 'or' filter group.
+func (nf *ElasticNotFilter) Or() search.FilterQuery {
+	group := nf.parent.addGroup(2)
+	group.negate = true
+	return group
+}
+
+// Not on an ElasticNotFilter cancels out the negation.
+func (nf *ElasticNotFilter) Not() search.FilterQuery {
+	return nf.parent
+}
+
+// Match uses the 'match' query directive, which analyzes text the same way
+// as the field was analyzed during indexing. Multiple Match calls are
+// combined via a 'bool' query, which must match all of them.
+func (eq *ElasticQuery) Match(field, text string) search.Query {
+	eq.matches = append(eq.matches, elastic.NewMatchQuery(field, text))
+	return eq
+}
+
+// Order sorts the results by the given fields.
+func (eq *ElasticQuery) Order(fields ...string) search.Query {
+	eq.order = search.ParseOrder(fields...)
+	return eq
+}
+
+// Missing maps onto the 'missing' sort option, which takes the same
+// "_first" and "_last" values.
+func (eq *ElasticQuery) Missing(position string) search.Query {
+	eq.missing = position
 	return eq
 }
 
+func (eq *ElasticQuery) missingFirst() bool {
+	return eq.missing == search.MissingFirst
+}
+
 // From sets the offset.
 func (eq *ElasticQuery) From(num int) search.Query {
 	eq.from = num
@@ -159,34 +611,124 @@ func (eq *ElasticQuery) Limit(num int) search.Query {
 	return eq
 }
 
-func (eq *ElasticQuery) generateQuery() (rq elastic.FilteredQuery, rerr error) {
-	rq = elastic.NewFilteredQuery(elastic.NewMatchAllQuery())
-	if eq.filterType == 0 {
-		return rq, errors.New("Filter present, but not set")
-
-	} else if eq.filterType == 1 {
-		af := elastic.NewAndFilter(eq.filter.filters...)
-		rq = rq.Filter(af)
+func (eq *ElasticQuery) hasQuery() bool {
+	return eq.filter != nil || len(eq.matches) > 0
+}
 
-	} else if eq.filterType == 2 {
-		of := elastic.NewOrFilter(eq.filter.filters...)
-		rq = rq.Filter(of)
+// generateQuery converts the match clauses and filters to a filtered query.
+// Any extra filters provided are required to match as well.
+func (eq *ElasticQuery) generateQuery(extra ...elastic.Filter) (
+	rq elastic.FilteredQuery, rerr error) {
 
+	if len(eq.matches) > 0 {
+		rq = elastic.NewFilteredQuery(elastic.NewBoolQuery().Must(eq.matches...))
 	} else {
-		return rq, errors.New("Invalid filter type")
+		rq = elastic.NewFilteredQuery(elastic.NewMatchAllQuery())
+	}
+	filters := extra
+	if eq.filter != nil {
+		f, ok, err := eq.filter.build()
+		if err != nil {
+			return rq, err
+		}
+		if ok {
+			filters = append(filters, f)
+		}
+	}
+	if len(filters) == 1 {
+		rq = rq.Filter(filters[0])
+	} else if len(filters) > 1 {
+		rq = rq.Filter(elastic.NewAndFilter(filters...))
 	}
 	return rq, nil
 }
 
-// Run runs the query and returns results and error, if any.
-func (eq *ElasticQuery) Run() (docs []x.Doc, rerr error) {
-	ss := eq.client.Search("gocrud").Type(eq.kind)
-	if len(eq.sort) > 0 {
-		if eq.sort[:1] == "-" {
-			ss = ss.Sort(eq.sort[1:], false)
-		} else {
-			ss = ss.Sort(eq.sort, true)
+// After sets the cursor to continue from. As Elastic Search 1.x doesn't
+// support search_after, the cursor is converted to range filters over
+// the sort fields, and the _uid field, which breaks ties.
+func (eq *ElasticQuery) After(cursor string) search.Query {
+	c, err := search.DecodeCursor(cursor)
+	eq.after = &c
+	eq.afterErr = err
+	return eq
+}
+
+// keyFilters returns the filters matching docs with the same value as val
+// for the sort key, and the ones ordered after it. The latter is nil if
+// no doc can be ordered after val.
+func (eq *ElasticQuery) keyFilters(key search.SortKey, val interface{}) (
+	same elastic.Filter, after elastic.Filter) {
+
+	if val == nil {
+		same = elastic.NewMissingFilter(key.Field)
+		if eq.missingFirst() {
+			after = elastic.NewExistsFilter(key.Field)
+		}
+		return same, after
+	}
+
+	same = elastic.NewTermFilter(key.Field, val)
+	rf := elastic.NewRangeFilter(key.Field)
+	if key.Desc {
+		rf = rf.Lt(val)
+	} else {
+		rf = rf.Gt(val)
+	}
+	if eq.missingFirst() {
+		return same, rf
+	}
+	return same, elastic.NewOrFilter(rf, elastic.NewMissingFilter(key.Field))
+}
+
+// cursorFilter generates the filter letting through only the docs ordered
+// after the cursor position. For keys k1, k2 that's:
+// after(k1) OR (same(k1) AND after(k2)) OR (same(k1) AND same(k2) AND _uid > id)
+func (eq *ElasticQuery) cursorFilter() (elastic.Filter, error) {
+	if eq.afterErr != nil {
+		return nil, eq.afterErr
+	}
+	c := eq.after
+	if c.Kind != eq.kind {
+		return nil, search.ErrInvalidCursor
+	}
+	if len(eq.order) == 0 && len(eq.matches) > 0 {
+		return nil, search.ErrRelevanceCursor
+	}
+	if len(c.Values) != len(eq.order) {
+		return nil, search.ErrInvalidCursor
+	}
+
+	var ors []elastic.Filter
+	var sames []elastic.Filter
+	for i, key := range eq.order {
+		same, after := eq.keyFilters(key, c.Values[i])
+		if after != nil {
+			ands := append(append([]elastic.Filter{}, sames...), after)
+			ors = append(ors, elastic.NewAndFilter(ands...))
 		}
+		sames = append(sames, same)
+	}
+	uf := elastic.NewRangeFilter("_uid").Gt(c.Kind + "#" + c.Id)
+	ors = append(ors, elastic.NewAndFilter(append(sames, uf)...))
+	return elastic.NewOrFilter(ors...), nil
+}
+
+func (eq *ElasticQuery) search() (*elastic.SearchResult, error) {
+	ss := eq.client.Search(eq.index).Type(eq.kind)
+	missing := search.MissingLast
+	if eq.missingFirst() {
+		missing = search.MissingFirst
+	}
+	for _, key := range eq.order {
+		ss = ss.SortWithInfo(elastic.SortInfo{
+			Field:     key.Field,
+			Ascending: !key.Desc,
+			Missing:   missing,
+		})
+	}
+	if len(eq.order) > 0 || len(eq.matches) == 0 {
+		// Break ties by kind and id, to keep pagination stable.
+		ss = ss.Sort("_uid", true)
 	}
 	if eq.from > 0 {
 		ss = ss.From(eq.from)
@@ -195,10 +737,18 @@ func (eq *ElasticQuery) Run() (docs []x.Doc, rerr error) {
 		ss = ss.Size(eq.limit)
 	}
 
-	if eq.filter != nil {
-		q, err := eq.generateQuery()
+	var extra []elastic.Filter
+	if eq.after != nil {
+		cf, err := eq.cursorFilter()
 		if err != nil {
-			return docs, err
+			return nil, err
+		}
+		extra = append(extra, cf)
+	}
+	if eq.hasQuery() || len(extra) > 0 {
+		q, err := eq.generateQuery(extra...)
+		if err != nil {
+			return nil, err
 		}
 
 		ss = ss.Query(q)
@@ -207,6 +757,15 @@ func (eq *ElasticQuery) Run() (docs []x.Doc, rerr error) {
 	result, err := ss.Do()
 	if err != nil {
 		x.LogErr(log, err).Error("While running query")
+		return nil, err
+	}
+	return result, nil
+}
+
+// Run runs the query and returns results and error, if any.
+func (eq *ElasticQuery) Run() (docs []x.Doc, rerr error) {
+	result, err := eq.search()
+	if err != nil {
 		return docs, err
 	}
 	if result.Hits == nil {
@@ -222,9 +781,80 @@ func (eq *ElasticQuery) Run() (docs []x.Doc, rerr error) {
 	return docs, nil
 }
 
+// sourceValue returns the value at the dotted field path in the source of
+// a hit, or nil if it's missing. Top level keys are matched ignoring case,
+// as x.Doc fields are stored capitalized.
+func sourceValue(source map[string]interface{}, field string) interface{} {
+	var val interface{} = source
+	for _, part := range strings.Split(field, ".") {
+		m, ok := val.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		v, present := m[part]
+		if !present {
+			for k, kv := range m {
+				if strings.EqualFold(k, part) {
+					v, present = kv, true
+					break
+				}
+			}
+		}
+		if !present {
+			return nil
+		}
+		val = v
+	}
+	return val
+}
+
+func unmarshal(hit *elastic.SearchHit, v interface{}) error {
+	if hit.Source == nil {
+		return errors.New("Source not found for doc: " + hit.Id)
+	}
+	if err := json.Unmarshal(*hit.Source, v); err != nil {
+		x.LogErr(log, err).Error("While unmarshal hit")
+		return err
+	}
+	return nil
+}
+
+// RunPage runs the query, and generates the cursor from the values of the
+// sort fields in the last hit.
+func (eq *ElasticQuery) RunPage() (docs []x.Doc, cursor string, rerr error) {
+	result, err := eq.search()
+	if err != nil {
+		return docs, "", err
+	}
+	if result.Hits == nil || len(result.Hits.Hits) == 0 {
+		log.Debug("No results found")
+		return docs, "", nil
+	}
+
+	for _, hit := range result.Hits.Hits {
+		var d x.Doc
+		if err := unmarshal(hit, &d); err != nil {
+			return docs, "", err
+		}
+		docs = append(docs, d)
+	}
+	last := result.Hits.Hits[len(result.Hits.Hits)-1]
+	c := search.Cursor{Kind: eq.kind, Id: last.Id}
+	if len(eq.order) > 0 {
+		var source map[string]interface{}
+		if err := unmarshal(last, &source); err != nil {
+			return docs, "", err
+		}
+		for _, key := range eq.order {
+			c.Values = append(c.Values, sourceValue(source, key.Field))
+		}
+	}
+	return docs, c.Encode(), nil
+}
+
 func (eq *ElasticQuery) Count() (rcount int64, rerr error) {
-	cs := eq.client.Count("gocrud").Type(eq.kind)
-	if eq.filter != nil {
+	cs := eq.client.Count(eq.index).Type(eq.kind)
+	if eq.hasQuery() {
 		q, err := eq.generateQuery()
 		if err != nil {
 			return 0, err
@@ -235,9 +865,15 @@ func (eq *ElasticQuery) Count() (rcount int64, rerr error) {
 }
 
 // NewQuery creates a new query object, to return results of type kind.
+// The index for kind gets created if missing, so queries over kinds not
+// indexed yet return no results, instead of failing.
 func (es *Elastic) NewQuery(kind string) search.Query {
+	if err := es.ensureIndex(kind); err != nil {
+		x.LogErr(log, err).WithField("kind", kind).Error("While setting up index")
+	}
 	eq := new(ElasticQuery)
 	eq.client = es.client
+	eq.index = es.alias(kind)
 	eq.kind = kind
 	return eq
 }
@@ -22,7 +22,7 @@ func initialize() *Elastic {
 
 	es := new(Elastic)
 	es.Init("http://" + addr + ":9200")
-	es.DropIndex()
+	es.DropIndex("Galaxy", "Star", "Planet") // Left over from earlier runs.
 	testx.AddDocs(es)
 	return es
 }
@@ -59,6 +59,122 @@ func TestFrom(t *testing.T) {
 	testx.RunFromLimit(es, t)
 }
 
+func TestRangeFilter(t *testing.T) {
+	if es == nil {
+		t.Log("Elastic Search environment vars not set")
+		return
+	}
+	testx.RunRangeFilter(es, t)
+}
+
+func TestInvalidRange(t *testing.T) {
+	eq := &ElasticQuery{kind: "Galaxy"}
+	eq.NewAndFilter().Not().AddRange("data.pos", "between", 3)
+	if _, err := eq.generateQuery(); err == nil {
+		t.Error("Expected error for invalid range operator")
+	}
+}
+
+func TestExistsFilter(t *testing.T) {
+	if es == nil {
+		t.Log("Elastic Search environment vars not set")
+		return
+	}
+	testx.RunExistsFilter(es, t)
+}
+
+func TestInFilter(t *testing.T) {
+	if es == nil {
+		t.Log("Elastic Search environment vars not set")
+		return
+	}
+	testx.RunInFilter(es, t)
+}
+
+func TestNotFilter(t *testing.T) {
+	if es == nil {
+		t.Log("Elastic Search environment vars not set")
+		return
+	}
+	testx.RunNotFilter(es, t)
+}
+
+func TestNestedFilter(t *testing.T) {
+	if es == nil {
+		t.Log("Elastic Search environment vars not set")
+		return
+	}
+	testx.RunNestedFilter(es, t)
+}
+
+func TestMatch(t *testing.T) {
+	if es == nil {
+		t.Log("Elastic Search environment vars not set")
+		return
+	}
+	testx.RunMatch(es, t)
+}
+
+func TestCursor(t *testing.T) {
+	if es == nil {
+		t.Log("Elastic Search environment vars not set")
+		return
+	}
+	testx.RunCursor(es, t)
+}
+
+func TestMultiOrder(t *testing.T) {
+	if es == nil {
+		t.Log("Elastic Search environment vars not set")
+		return
+	}
+	testx.RunMultiOrder(es, t)
+}
+
+func TestDelete(t *testing.T) {
+	if es == nil {
+		t.Log("Elastic Search environment vars not set")
+		return
+	}
+	testx.RunDelete(es, t)
+}
+
+func TestGet(t *testing.T) {
+	if es == nil {
+		t.Log("Elastic Search environment vars not set")
+		return
+	}
+	testx.RunGet(es, t)
+}
+
+func TestAggregate(t *testing.T) {
+	if es == nil {
+		t.Log("Elastic Search environment vars not set")
+		return
+	}
+	testx.RunAggregate(es, t)
+}
+
+func TestReindex(t *testing.T) {
+	if es == nil {
+		t.Log("Elastic Search environment vars not set")
+		return
+	}
+	before, err := es.aliasedIndices("Galaxy")
+	if err != nil || len(before) != 1 {
+		t.Fatalf("Expected one index behind alias. Found: %v, %v", before, err)
+	}
+	if err := es.Reindex("Galaxy"); err != nil {
+		t.Fatalf("While reindexing: %v", err)
+	}
+	after, err := es.aliasedIndices("Galaxy")
+	if err != nil || len(after) != 1 || after[0] == before[0] {
+		t.Fatalf("Expected alias to point to new index. Found: %v, %v", after, err)
+	}
+	time.Sleep(2 * time.Second) // To allow copied docs to become searchable.
+	testx.RunCount(es, t)
+}
+
 var es *Elastic
 
 func init() {
@@ -0,0 +1,304 @@
+package elasticsearch
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aslanides/gocrud/x"
+	"gopkg.in/olivere/elastic.v2"
+)
+
+// Docs of each kind are stored in their own index, which is only ever
+// referred to via an alias named <prefix>_<kind>. The index behind it is
+// named <alias>_<unix nano ts>, so Reindex can build a new one, and swap
+// the alias over atomically.
+
+// SetIndexPrefix sets the prefix for index names. Defaults to "gocrud".
+// Must be called before Init.
+func (es *Elastic) SetIndexPrefix(prefix string) {
+	es.prefix = prefix
+}
+
+// SetMapping registers the mapping for docs of kind, as would be provided
+// under the type name to the put mapping api. For e.g. exact-value term
+// matching over name needs {"properties": {"Data": {"properties": {"name":
+// {"type": "string", "index": "not_analyzed"}}}}}.
+// Must be called before Init, which creates or updates the indices for
+// all the kinds registered. Changes which Elastic Search can't apply over
+// existing fields require a Reindex.
+func (es *Elastic) SetMapping(kind string, mapping map[string]interface{}) {
+	if es.mappings == nil {
+		es.mappings = make(map[string]map[string]interface{})
+	}
+	es.mappings[kind] = mapping
+}
+
+// alias returns the name via which the index for kind is accessed.
+func (es *Elastic) alias(kind string) string {
+	return es.prefix + "_" + strings.ToLower(kind)
+}
+
+func (es *Elastic) newIndexName(kind string) string {
+	return fmt.Sprintf("%s_%d", es.alias(kind), time.Now().UnixNano())
+}
+
+// indexBody returns the settings to create the index for kind with.
+func (es *Elastic) indexBody(kind string) map[string]interface{} {
+	body := make(map[string]interface{})
+	if mapping, present := es.mappings[kind]; present {
+		body["mappings"] = map[string]interface{}{kind: mapping}
+	}
+	return body
+}
+
+// aliasedIndices returns the indices the alias for kind points to.
+func (es *Elastic) aliasedIndices(kind string) ([]string, error) {
+	alias := es.alias(kind)
+	result, err := es.client.Aliases().Index(alias).Do()
+	if err != nil {
+		return nil, err
+	}
+	return result.IndicesByAlias(alias), nil
+}
+
+// createIndex creates a new index for kind, with the registered mapping,
+// and returns its name.
+func (es *Elastic) createIndex(kind string) (string, error) {
+	name := es.newIndexName(kind)
+	result, err := es.client.CreateIndex(name).BodyJson(es.indexBody(kind)).Do()
+	if err != nil {
+		x.LogErr(log, err).WithField("index", name).Error("While creating index")
+		return "", err
+	}
+	if !result.Acknowledged {
+		log.WithField("index", name).Error("Create index not acknowledged")
+	}
+	return name, nil
+}
+
+// setupIndex creates the index and alias for kind, if missing. Otherwise,
+// it applies the registered mapping over the existing index.
+func (es *Elastic) setupIndex(kind string) error {
+	alias := es.alias(kind)
+	exists, err := es.client.IndexExists(alias).Do()
+	if err != nil {
+		x.LogErr(log, err).WithField("alias", alias).Error("While checking index")
+		return err
+	}
+
+	if !exists {
+		name, err := es.createIndex(kind)
+		if err != nil {
+			return err
+		}
+		if _, err := es.client.Alias().Add(name, alias).Do(); err != nil {
+			x.LogErr(log, err).WithField("alias", alias).Error("While adding alias")
+			return err
+		}
+		log.WithField("index", name).WithField("alias", alias).Debug("Created index")
+		return nil
+	}
+
+	mapping, present := es.mappings[kind]
+	if !present {
+		return nil
+	}
+	_, err = es.client.PutMapping().Index(alias).Type(kind).
+		BodyJson(map[string]interface{}{kind: mapping}).Do()
+	if err != nil {
+		x.LogErr(log, err).WithField("kind", kind).
+			Error("While updating mapping. Reindex might be needed")
+		return err
+	}
+	return nil
+}
+
+// kindIndex holds the state of the index for a kind. Writes hold it for
+// reading, from the time they look up the reindex target until they're
+// done, so Reindex can wait for writes which missed the target, by
+// holding it for writing while setting it.
+type kindIndex struct {
+	sync.RWMutex
+	target string     // New index, while kind is being reindexed.
+	setup  sync.Mutex // Guards ready.
+	ready  bool       // Index has been set up.
+}
+
+// indexFor returns the index state for kind.
+func (es *Elastic) indexFor(kind string) *kindIndex {
+	es.Lock()
+	defer es.Unlock()
+	ki, present := es.kinds[kind]
+	if !present {
+		ki = new(kindIndex)
+		es.kinds[kind] = ki
+	}
+	return ki
+}
+
+// ensureIndex sets up the index for kind, the first time it's used.
+// Kinds are set up independently, so a slow setup only blocks its own
+// kind.
+func (es *Elastic) ensureIndex(kind string) error {
+	ki := es.indexFor(kind)
+	ki.setup.Lock()
+	defer ki.setup.Unlock()
+	if ki.ready {
+		return nil
+	}
+	if err := es.setupIndex(kind); err != nil {
+		return err
+	}
+	ki.ready = true
+	return nil
+}
+
+// lockWrites holds the index states for kinds for reading, in sorted
+// order so concurrent Reindex calls can't deadlock writes across kinds.
+// Returns the reindex target of each kind, and the func to release them.
+func (es *Elastic) lockWrites(kinds ...string) (map[string]string, func()) {
+	sorted := make([]string, 0, len(kinds))
+	seen := make(map[string]bool)
+	for _, kind := range kinds {
+		if !seen[kind] {
+			seen[kind] = true
+			sorted = append(sorted, kind)
+		}
+	}
+	sort.Strings(sorted)
+
+	targets := make(map[string]string)
+	locked := make([]*kindIndex, 0, len(sorted))
+	for _, kind := range sorted {
+		ki := es.indexFor(kind)
+		ki.RLock()
+		locked = append(locked, ki)
+		if len(ki.target) > 0 {
+			targets[kind] = ki.target
+		}
+	}
+	return targets, func() {
+		for _, ki := range locked {
+			ki.RUnlock()
+		}
+	}
+}
+
+// copyDocs copies all the docs of kind from the current index to target,
+// retaining their versions.
+func (es *Elastic) copyDocs(kind, target string) (int, error) {
+	cursor, err := es.client.Scan(es.alias(kind)).Type(kind).Size(500).Do()
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+	for {
+		result, err := cursor.Next()
+		if err == elastic.EOS {
+			return count, nil
+		}
+		if err != nil {
+			return count, err
+		}
+		if result.Hits == nil || len(result.Hits.Hits) == 0 {
+			continue
+		}
+
+		bulk := es.client.Bulk()
+		for _, hit := range result.Hits.Hits {
+			var doc x.Doc
+			if err := unmarshal(hit, &doc); err != nil {
+				return count, err
+			}
+			bulk = bulk.Add(elastic.NewBulkIndexRequest().Index(target).
+				Type(kind).Id(doc.Id).VersionType("external").
+				Version(doc.NanoTs).Doc(doc))
+		}
+		resp, err := bulk.Do()
+		if err != nil {
+			return count, err
+		}
+		// Version conflicts mean the doc was already updated in target,
+		// via the writes done during reindexing.
+		for _, item := range resp.Failed() {
+			if item.Status != 409 {
+				return count, fmt.Errorf("While copying doc %v: %v",
+					item.Id, item.Error)
+			}
+		}
+		count += len(result.Hits.Hits)
+	}
+}
+
+// Reindex creates a new index for kind, with the mapping currently
+// registered, and copies all the docs over. Updates and deletes done in
+// the meantime are written to both the indices. The alias is then
+// atomically swapped over to the new index, and the old index deleted,
+// so queries keep working throughout.
+func (es *Elastic) Reindex(kind string) error {
+	if err := es.ensureIndex(kind); err != nil {
+		return err
+	}
+	alias := es.alias(kind)
+	old, err := es.aliasedIndices(kind)
+	if err != nil {
+		x.LogErr(log, err).WithField("alias", alias).Error("While fetching alias")
+		return err
+	}
+	target, err := es.createIndex(kind)
+	if err != nil {
+		return err
+	}
+
+	// Waits for writes which didn't see the target. The ones after are
+	// written to both the indices.
+	ki := es.indexFor(kind)
+	ki.Lock()
+	if len(ki.target) > 0 {
+		ki.Unlock()
+		es.client.DeleteIndex(target).Do()
+		return fmt.Errorf("Reindex already running for kind: %v", kind)
+	}
+	ki.target = target
+	ki.Unlock()
+	defer func() {
+		ki.Lock()
+		ki.target = ""
+		ki.Unlock()
+	}()
+
+	// Scan only sees the docs since the last refresh.
+	if _, err := es.client.Refresh(alias).Do(); err != nil {
+		x.LogErr(log, err).WithField("alias", alias).Error("While refreshing index")
+		es.client.DeleteIndex(target).Do()
+		return err
+	}
+	count, err := es.copyDocs(kind, target)
+	if err != nil {
+		x.LogErr(log, err).WithField("index", target).Error("While copying docs")
+		es.client.DeleteIndex(target).Do()
+		return err
+	}
+
+	as := es.client.Alias().Add(target, alias)
+	for _, name := range old {
+		as = as.Remove(name, alias)
+	}
+	if _, err := as.Do(); err != nil {
+		x.LogErr(log, err).WithField("alias", alias).Error("While swapping alias")
+		es.client.DeleteIndex(target).Do()
+		return err
+	}
+	for _, name := range old {
+		if _, err := es.client.DeleteIndex(name).Do(); err != nil {
+			x.LogErr(log, err).WithField("index", name).Error("While deleting old index")
+		}
+	}
+	log.WithField("kind", kind).WithField("index", target).
+		WithField("num_docs", count).Info("Reindexed")
+	return nil
+}
@@ -1,6 +1,10 @@
 package leveldb
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 
@@ -14,6 +18,34 @@ import (
 
 var log = x.Log("leveldb")
 
+// Instructions are also indexed by commit time, under keys starting with
+// timePrefix, followed by the big endian nano ts and the instruction key.
+// As 0xff can't appear in entity ids, these sort after all instructions.
+var timePrefix = []byte{0xff, 't'}
+
+func timeKey(nanoTs int64, key []byte) []byte {
+	buf := make([]byte, len(timePrefix)+8+len(key))
+	n := copy(buf, timePrefix)
+	binary.BigEndian.PutUint64(buf[n:], uint64(nanoTs))
+	copy(buf[n+8:], key)
+	return buf
+}
+
+// Instructions are also indexed by source, under keys starting with
+// sourcePrefix, followed by the source, a zero byte, the big endian nano ts
+// and the instruction key. These sort after the time index.
+var sourcePrefix = []byte{0xff, 'u'}
+
+func sourceKey(source string, nanoTs int64, key []byte) []byte {
+	buf := make([]byte, len(sourcePrefix)+len(source)+1+8+len(key))
+	n := copy(buf, sourcePrefix)
+	n += copy(buf[n:], source)
+	buf[n] = 0
+	binary.BigEndian.PutUint64(buf[n+1:], uint64(nanoTs))
+	copy(buf[n+9:], key)
+	return buf
+}
+
 type Leveldb struct {
 	db  *leveldb.DB
 	opt *opt.Options
@@ -92,6 +124,14 @@ func (l *Leveldb) Commit(its []*x.Instruction) error {
 			return err
 		}
 		b.Put(key, buf)
+
+		ebuf, err := json.Marshal(x.Entity{Kind: it.SubjectType, Id: it.SubjectId})
+		if err != nil {
+			x.LogErr(log, err).Error("While encoding")
+			return err
+		}
+		b.Put(timeKey(it.NanoTs, key), ebuf)
+		b.Put(sourceKey(it.Source, it.NanoTs, key), nil)
 	}
 	if err := l.db.Write(b, nil); err != nil {
 		x.LogErr(log, err).Error("While writing to db")
@@ -133,6 +173,9 @@ func (l *Leveldb) Iterate(fromId string, num int,
 	rnum = 0
 	handled := make(map[x.Entity]bool)
 	for iter.Next() {
+		if bytes.Compare(iter.Key(), timePrefix) >= 0 {
+			break // Reached the time and source indices.
+		}
 		buf := iter.Value()
 		if buf == nil {
 			break
@@ -162,6 +205,234 @@ func (l *Leveldb) Iterate(fromId string, num int,
 	return rnum, rlast, err
 }
 
+// IterateSince pages over the time index. Instructions committed before the
+// index was introduced aren't covered, so run a full Iterate over them once.
+func (l *Leveldb) IterateSince(nanoTs int64, cursor string, num int,
+	ch chan x.Entity) (rnum int, rnext string, rerr error) {
+
+	start := timeKey(nanoTs+1, nil)
+	if len(cursor) > 0 {
+		last, err := hex.DecodeString(cursor)
+		if err != nil {
+			return 0, cursor, err
+		}
+		start = append(last, 0) // Right after the last key.
+	}
+	slice := util.Range{Start: start, Limit: util.BytesPrefix(timePrefix).Limit}
+	iter := l.db.NewIterator(&slice, nil)
+	defer iter.Release()
+
+	rnext = cursor
+	handled := make(map[x.Entity]bool)
+	for rnum < num && iter.Next() {
+		rnext = hex.EncodeToString(iter.Key())
+		var e x.Entity
+		if err := json.Unmarshal(iter.Value(), &e); err != nil {
+			x.LogErr(log, err).Error("While decoding")
+			return rnum, rnext, err
+		}
+		if _, present := handled[e]; present {
+			continue
+		}
+		ch <- e
+		handled[e] = true
+		rnum += 1
+	}
+	err := iter.Error()
+	if err != nil {
+		x.LogErr(log, err).Error("While iterating")
+	}
+	return rnum, rnext, err
+}
+
+// IterateSource looks up the instructions via the source index. Only
+// instructions committed since the index was added are found.
+func (l *Leveldb) IterateSource(source string, from, to int64, cursor string,
+	num int, ch chan x.Instruction) (rnum int, rnext string, rerr error) {
+
+	start := sourceKey(source, from, nil)
+	if len(cursor) > 0 {
+		last, err := hex.DecodeString(cursor)
+		if err != nil {
+			return 0, cursor, err
+		}
+		start = append(last, 0) // Right after the last key.
+	}
+	slice := util.Range{Start: start, Limit: sourceKey(source, to, nil)}
+	iter := l.db.NewIterator(&slice, nil)
+	defer iter.Release()
+
+	rnext = cursor
+	prefix := len(sourceKey(source, 0, nil))
+	for rnum < num && iter.Next() {
+		rnext = hex.EncodeToString(iter.Key())
+		buf, err := l.db.Get(iter.Key()[prefix:], nil)
+		if err == leveldb.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			x.LogErr(log, err).Error("While getting instruction")
+			return rnum, rnext, err
+		}
+		var i x.Instruction
+		if err := i.GobDecode(buf); err != nil {
+			x.LogErr(log, err).Error("While decoding")
+			return rnum, rnext, err
+		}
+		ch <- i
+		rnum += 1
+	}
+	err := iter.Error()
+	if err != nil {
+		x.LogErr(log, err).Error("While iterating")
+	}
+	return rnum, rnext, err
+}
+
+// Delete removes the matching instructions, along with their entries in
+// the time and source indices.
+func (l *Leveldb) Delete(id string, its []x.Instruction) error {
+	type match struct {
+		pred     string
+		objectId string
+		source   string
+		ts       int64
+	}
+	drop := make(map[match]bool)
+	for _, it := range its {
+		drop[match{it.Predicate, it.ObjectId, it.Source, it.NanoTs}] = true
+	}
+
+	b := new(leveldb.Batch)
+	iter := l.db.NewIterator(util.BytesPrefix([]byte(id+"_")), nil)
+	for iter.Next() {
+		var i x.Instruction
+		if err := i.GobDecode(iter.Value()); err != nil {
+			iter.Release()
+			x.LogErr(log, err).Error("While decoding")
+			return err
+		}
+		if i.SubjectId != id || !drop[match{i.Predicate, i.ObjectId, i.Source, i.NanoTs}] {
+			continue
+		}
+		key := append([]byte(nil), iter.Key()...)
+		b.Delete(key)
+		b.Delete(timeKey(i.NanoTs, key))
+		b.Delete(sourceKey(i.Source, i.NanoTs, key))
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		x.LogErr(log, err).Error("While iterating")
+		return err
+	}
+	if err := l.db.Write(b, nil); err != nil {
+		x.LogErr(log, err).Error("While deleting from db")
+		return err
+	}
+	log.Debugf("%d instructions deleted", b.Len()/3)
+	return nil
+}
+
+// entityId returns the entity id from the instruction key, as generated by
+// Commit.
+func entityId(key []byte) string {
+	if len(key) < 6 {
+		return string(key)
+	}
+	return string(key[:len(key)-6])
+}
+
+// Partitions splits the instruction keys into n ranges with about the same
+// number of keys. This goes over the keys twice, without reading the
+// values, so it's still much faster than a full Iterate. Partitions are
+// bounded by entity ids, with Start inclusive and End exclusive.
+func (l *Leveldb) Partitions(n int) ([]store.Partition, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("Invalid number of partitions: %v", n)
+	}
+	all := util.Range{Limit: timePrefix}
+	count := 0
+	iter := l.db.NewIterator(&all, nil)
+	for iter.Next() {
+		count += 1
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		x.LogErr(log, err).Error("While counting keys")
+		return nil, err
+	}
+	if count == 0 {
+		return nil, nil
+	}
+
+	per := (count + n - 1) / n
+	var bounds []string
+	iter = l.db.NewIterator(&all, nil)
+	for i := 0; iter.Next(); i++ {
+		if i == 0 || i%per != 0 {
+			continue
+		}
+		id := entityId(iter.Key())
+		if len(bounds) == 0 || bounds[len(bounds)-1] != id {
+			bounds = append(bounds, id)
+		}
+	}
+	iter.Release()
+	if err := iter.Error(); err != nil {
+		x.LogErr(log, err).Error("While splitting keys")
+		return nil, err
+	}
+
+	parts := make([]store.Partition, len(bounds)+1)
+	for i, b := range bounds {
+		parts[i].End = b
+		parts[i+1].Start = b
+	}
+	return parts, nil
+}
+
+// IteratePartition goes over the keys in partition p, using the last entity
+// id returned as the cursor.
+func (l *Leveldb) IteratePartition(p store.Partition, cursor string, num int,
+	ch chan x.Entity) (rnum int, rnext string, rerr error) {
+
+	slice := util.Range{Start: []byte(p.Start), Limit: timePrefix}
+	if len(cursor) > 0 {
+		slice.Start = []byte(cursor)
+	}
+	if len(p.End) > 0 {
+		slice.Limit = []byte(p.End)
+	}
+	iter := l.db.NewIterator(&slice, nil)
+	defer iter.Release()
+
+	rnext = cursor
+	handled := make(map[x.Entity]bool)
+	for rnum < num && iter.Next() {
+		var i x.Instruction
+		if err := i.GobDecode(iter.Value()); err != nil {
+			x.LogErr(log, err).Error("While decoding")
+			return rnum, rnext, err
+		}
+		e := x.Entity{Kind: i.SubjectType, Id: i.SubjectId}
+		if e.Id == cursor {
+			continue // Already returned by the previous call.
+		}
+		if _, present := handled[e]; present {
+			continue
+		}
+		ch <- e
+		handled[e] = true
+		rnum += 1
+		rnext = e.Id
+	}
+	err := iter.Error()
+	if err != nil {
+		x.LogErr(log, err).Error("While iterating")
+	}
+	return rnum, rnext, err
+}
+
 func init() {
 	log.Info("Initing leveldb")
 	l := new(Leveldb)
@@ -0,0 +1,223 @@
+package memsearch
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"sort"
+	"time"
+
+	"github.com/aslanides/gocrud/search"
+	"github.com/aslanides/gocrud/x"
+)
+
+func (mq *MemQuery) Aggregate(name string, agg *search.Aggregation) search.Query {
+	if mq.aggs == nil {
+		mq.aggs = make(map[string]*search.Aggregation)
+	}
+	mq.aggs[name] = agg
+	return mq
+}
+
+func (mq *MemQuery) RunAggregations() (map[string]*search.AggregationResult, error) {
+	if err := mq.collect(); err != nil {
+		return nil, err
+	}
+	return aggregateAll(mq.Docs, mq.aggs)
+}
+
+func aggregateAll(docs []x.Doc, aggs map[string]*search.Aggregation) (
+	map[string]*search.AggregationResult, error) {
+
+	results := make(map[string]*search.AggregationResult)
+	for name, agg := range aggs {
+		r, err := aggregate(docs, agg)
+		if err != nil {
+			return nil, err
+		}
+		results[name] = r
+	}
+	return results, nil
+}
+
+func aggregate(docs []x.Doc, agg *search.Aggregation) (
+	*search.AggregationResult, error) {
+
+	switch agg.Type {
+	case search.AggStats:
+		return &search.AggregationResult{Stats: stats(docs, agg.Field)}, nil
+	case search.AggTerms:
+		return terms(docs, agg)
+	case search.AggHistogram:
+		if agg.Interval <= 0 {
+			return nil, errors.New("Invalid histogram interval")
+		}
+		return histogram(docs, agg, agg.Interval)
+	case search.AggDateHistogram:
+		period := int64(agg.Period / time.Millisecond)
+		if period <= 0 {
+			return nil, errors.New("Invalid date histogram period")
+		}
+		return histogram(docs, agg, period)
+	}
+	return nil, errors.New("Invalid aggregation type: " + agg.Type)
+}
+
+// fieldValues returns the field value, or its elements if it's a list.
+func fieldValues(doc x.Doc, field string) (vals []interface{}) {
+	val, present := fieldValue(doc, field)
+	if !present || val == nil {
+		return vals
+	}
+	rv := reflect.ValueOf(val)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return append(vals, val)
+	}
+	for i := 0; i < rv.Len(); i++ {
+		vals = append(vals, rv.Index(i).Interface())
+	}
+	return vals
+}
+
+// numbers returns numeric field values. For date histograms, strings in
+// RFC3339 format are converted to milliseconds since epoch as well.
+func numbers(doc x.Doc, field string, dates bool) (nums []float64) {
+	for _, val := range fieldValues(doc, field) {
+		if f, ok := toFloat(val); ok {
+			nums = append(nums, f)
+			continue
+		}
+		if s, ok := val.(string); ok && dates {
+			if t, err := time.Parse(time.RFC3339, s); err == nil {
+				nums = append(nums, float64(t.UnixNano()/int64(time.Millisecond)))
+			}
+		}
+	}
+	return nums
+}
+
+func stats(docs []x.Doc, field string) *search.StatsResult {
+	s := new(search.StatsResult)
+	for _, doc := range docs {
+		for _, f := range numbers(doc, field, false) {
+			if s.Count == 0 || f < s.Min {
+				s.Min = f
+			}
+			if s.Count == 0 || f > s.Max {
+				s.Max = f
+			}
+			s.Sum += f
+			s.Count += 1
+		}
+	}
+	if s.Count > 0 {
+		s.Avg = s.Sum / float64(s.Count)
+	}
+	return s
+}
+
+// bucket collects docs for one bucket. A doc with multiple values
+// falling in the same bucket is only counted once.
+type bucket struct {
+	key  interface{}
+	sort string
+	docs []x.Doc
+	seen map[string]bool
+}
+
+func (b *bucket) add(doc x.Doc) {
+	if b.seen[doc.Id] {
+		return
+	}
+	b.seen[doc.Id] = true
+	b.docs = append(b.docs, doc)
+}
+
+func toResult(buckets []*bucket, agg *search.Aggregation) (
+	*search.AggregationResult, error) {
+
+	result := new(search.AggregationResult)
+	for _, b := range buckets {
+		rb := search.Bucket{Key: b.key, Count: int64(len(b.docs))}
+		if len(agg.Subs) > 0 {
+			subs, err := aggregateAll(b.docs, agg.Subs)
+			if err != nil {
+				return nil, err
+			}
+			rb.Subs = subs
+		}
+		result.Buckets = append(result.Buckets, rb)
+	}
+	return result, nil
+}
+
+// byCount sorts term buckets by descending doc count, then by key.
+type byCount []*bucket
+
+func (b byCount) Len() int      { return len(b) }
+func (b byCount) Swap(i, j int) { b[i], b[j] = b[j], b[i] }
+func (b byCount) Less(i, j int) bool {
+	if len(b[i].docs) != len(b[j].docs) {
+		return len(b[i].docs) > len(b[j].docs)
+	}
+	return b[i].sort < b[j].sort
+}
+
+func terms(docs []x.Doc, agg *search.Aggregation) (
+	*search.AggregationResult, error) {
+
+	byKey := make(map[string]*bucket)
+	var buckets []*bucket
+	for _, doc := range docs {
+		for _, val := range fieldValues(doc, agg.Field) {
+			key, ok := valueKey(val)
+			if !ok {
+				continue
+			}
+			b, present := byKey[key]
+			if !present {
+				if f, ok := toFloat(val); ok {
+					val = f
+				}
+				b = &bucket{key: val, sort: key, seen: make(map[string]bool)}
+				byKey[key] = b
+				buckets = append(buckets, b)
+			}
+			b.add(doc)
+		}
+	}
+	sort.Sort(byCount(buckets))
+	if agg.Size > 0 && len(buckets) > agg.Size {
+		buckets = buckets[:agg.Size]
+	}
+	return toResult(buckets, agg)
+}
+
+// byKey sorts histogram buckets by ascending key.
+type byKey []*bucket
+
+func (b byKey) Len() int           { return len(b) }
+func (b byKey) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byKey) Less(i, j int) bool { return b[i].key.(int64) < b[j].key.(int64) }
+
+func histogram(docs []x.Doc, agg *search.Aggregation, interval int64) (
+	*search.AggregationResult, error) {
+
+	dates := agg.Type == search.AggDateHistogram
+	byStart := make(map[int64]*bucket)
+	var buckets []*bucket
+	for _, doc := range docs {
+		for _, f := range numbers(doc, agg.Field, dates) {
+			start := int64(math.Floor(f/float64(interval))) * interval
+			b, present := byStart[start]
+			if !present {
+				b = &bucket{key: start, seen: make(map[string]bool)}
+				byStart[start] = b
+				buckets = append(buckets, b)
+			}
+			b.add(doc)
+		}
+	}
+	sort.Sort(byKey(buckets))
+	return toResult(buckets, agg)
+}
@@ -0,0 +1,141 @@
+package memsearch
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+
+	"github.com/aslanides/gocrud/x"
+)
+
+// exactIndex maps kind and field to the ids of docs holding each value,
+// so exact and in filters don't need to scan all the docs of a kind.
+type exactIndex map[string]map[string]map[string]bool
+
+// valueKey converts a scalar value to the key used in exact index.
+// Numbers of different types map to the same key, as they're compared
+// numerically by filters. Returns false if value can't be indexed.
+func valueKey(value interface{}) (string, bool) {
+	if f, ok := toFloat(value); ok {
+		return "n:" + strconv.FormatFloat(f, 'g', -1, 64), true
+	}
+	switch t := value.(type) {
+	case string:
+		return "s:" + t, true
+	case bool:
+		return fmt.Sprintf("b:%v", t), true
+	}
+	return "", false
+}
+
+// valueKeys returns the keys for value, and for each element of value,
+// if value is a list.
+func valueKeys(value interface{}) (keys []string) {
+	if key, ok := valueKey(value); ok {
+		return append(keys, key)
+	}
+	rv := reflect.ValueOf(value)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return keys
+	}
+	for i := 0; i < rv.Len(); i++ {
+		keys = append(keys, valueKeys(rv.Index(i).Interface())...)
+	}
+	return keys
+}
+
+func (ms *MemSearch) indexExact(doc x.Doc) {
+	fields, ok := doc.Data.(map[string]interface{})
+	if !ok {
+		return
+	}
+	for field, val := range fields {
+		fkey := postingsKey(doc.Kind, field)
+		for _, key := range valueKeys(val) {
+			values, present := ms.exact[fkey]
+			if !present {
+				values = make(map[string]map[string]bool)
+				ms.exact[fkey] = values
+			}
+			if _, present := values[key]; !present {
+				values[key] = make(map[string]bool)
+			}
+			values[key][doc.Id] = true
+		}
+	}
+}
+
+func (ms *MemSearch) unindexExact(doc x.Doc) {
+	fields, ok := doc.Data.(map[string]interface{})
+	if !ok {
+		return
+	}
+	for field, val := range fields {
+		fkey := postingsKey(doc.Kind, field)
+		values, present := ms.exact[fkey]
+		if !present {
+			continue
+		}
+		for _, key := range valueKeys(val) {
+			delete(values[key], doc.Id)
+			if len(values[key]) == 0 {
+				delete(values, key)
+			}
+		}
+		if len(values) == 0 {
+			delete(ms.exact, fkey)
+		}
+	}
+}
+
+// lookup returns the ids of docs which could match filter f, using the
+// exact index. Returns false if the index can't serve the filter.
+func (ms *MemSearch) lookup(kind string, f Filter) (map[string]bool, bool) {
+	if f.Negate || len(f.Regex) > 0 {
+		return nil, false
+	}
+	var values []interface{}
+	switch f.Op {
+	case "":
+		values = append(values, f.Value)
+	case opIn:
+		values = f.Values
+	default:
+		return nil, false
+	}
+
+	ids := make(map[string]bool)
+	index := ms.exact[postingsKey(kind, dataField(f.Field))]
+	for _, value := range values {
+		key, ok := valueKey(value)
+		if !ok {
+			return nil, false
+		}
+		for id := range index[key] {
+			ids[id] = true
+		}
+	}
+	return ids, true
+}
+
+// required returns the smallest set of doc ids, any match of the filter
+// group must come from. Only AND groups can narrow down the results this
+// way. Returns false if no such set can be found via the exact index.
+func (mf *MemFilter) required(ms *MemSearch, kind string) (best map[string]bool,
+	found bool) {
+
+	if mf.filterType != 1 || mf.negate {
+		return nil, false
+	}
+	for _, f := range mf.filters {
+		if ids, ok := ms.lookup(kind, f); ok && (!found || len(ids) < len(best)) {
+			best, found = ids, true
+		}
+	}
+	for _, group := range mf.groups {
+		if ids, ok := group.required(ms, kind); ok && (!found || len(ids) < len(best)) {
+			best, found = ids, true
+		}
+	}
+	return best, found
+}
@@ -7,82 +7,304 @@ import (
 	"regexp"
 	"sort"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/Sirupsen/logrus"
 	"github.com/aslanides/gocrud/search"
 	"github.com/aslanides/gocrud/x"
 )
 
 var log = x.Log("memsearch")
 
+// MemSearch is an in-memory search engine, safe for concurrent use.
+// Docs are kept per kind, along with secondary indexes for exact value
+// and full text matches.
 type MemSearch struct {
-	docs map[string]x.Doc
+	sync.RWMutex
+	docs     map[string]map[string]x.Doc     // kind -> id -> doc.
+	deleted  map[string]map[string]tombstone // kind -> id -> tombstone.
+	gcAfter  time.Duration                   // Zero for the default.
+	lastGC   time.Time
+	exact    exactIndex
+	text     textIndex
+	stemmer  func(string) string
+	snapshot string
 }
 
 type MemQuery struct {
-	kind       string
-	Docs       []x.Doc
-	filter     *MemFilter
-	filterType int // 0 = no filter, 1 = AND, 2 = OR
-	from       int
-	limit      int
-	order      string
+	ms       *MemSearch
+	kind     string
+	Docs     []x.Doc    // Populated from the engine when the query is run.
+	filter   *MemFilter // Root filter, AND of all the filters set on query.
+	matches  []matchClause
+	scores   map[string]float64 // doc id -> relevance score.
+	aggs     map[string]*search.Aggregation
+	after    *search.Cursor
+	afterErr error
+	from     int
+	limit    int
+	order    []search.SortKey
+	missing  string
 }
 
 type Filter struct {
-	Field string
-	Value interface{}
-	Regex string
+	Field  string
+	Value  interface{}
+	Regex  string
+	Op     string // One of search.Gt, Gte, Lt, Lte, or exists, missing, in.
+	Values []interface{}
+	Negate bool
+
+	re *regexp.Regexp // Compiled once from Regex, instead of per doc.
 }
 
+// MemFilter is a group of filters, and nested filter groups, which are
+// combined via AND or OR operation.
 type MemFilter struct {
-	filters []Filter
+	filterType int // 1 = AND, 2 = OR
+	negate     bool
+	filters    []Filter
+	groups     []*MemFilter
 }
 
+// NotFilter negates the next filter added to it, before passing
+// it on to the parent MemFilter.
+type NotFilter struct {
+	parent *MemFilter
+}
+
+const (
+	opExists  = "exists"
+	opMissing = "missing"
+	opIn      = "in"
+)
+
+// Init resets the engine. If a snapshot file has been set, docs are
+// loaded back from it.
 func (ms *MemSearch) Init(args ...string) {
-	ms.docs = make(map[string]x.Doc)
+	ms.Lock()
+	ms.docs = make(map[string]map[string]x.Doc)
+	ms.deleted = make(map[string]map[string]tombstone)
+	ms.lastGC = time.Now()
+	ms.exact = make(exactIndex)
+	ms.text = make(textIndex)
+	ms.Unlock()
+
+	if len(ms.snapshot) == 0 {
+		return
+	}
+	if err := ms.load(); err != nil {
+		x.LogErr(log, err).WithField("file", ms.snapshot).
+			Fatal("While loading snapshot")
+	}
 }
 
 func (ms *MemSearch) All() []x.Doc {
+	ms.RLock()
+	defer ms.RUnlock()
+
 	var dup []x.Doc
-	for _, doc := range ms.docs {
-		dup = append(dup, doc)
+	for _, docs := range ms.docs {
+		for _, doc := range docs {
+			dup = append(dup, doc)
+		}
 	}
 	return dup
 }
 
 func (ms *MemSearch) NewQuery(kind string) search.Query {
 	mq := new(MemQuery)
-	for _, doc := range ms.docs {
-		if doc.Kind != kind {
-			continue
-		}
-		mq.Docs = append(mq.Docs, doc)
-	}
+	mq.ms = ms
+	mq.kind = kind
 	return mq
 }
 
 func (ms *MemSearch) Update(doc x.Doc) error {
-	key := doc.Kind + ":" + doc.Id
-	if pdoc, present := ms.docs[key]; present {
+	ms.Lock()
+	defer ms.Unlock()
+	return ms.update(doc)
+}
+
+// UpdateMany updates the docs, or removes the ones marked deleted, taking
+// the write lock only once.
+func (ms *MemSearch) UpdateMany(docs []x.Doc) []error {
+	ms.Lock()
+	defer ms.Unlock()
+
+	errs := make([]error, len(docs))
+	for i, doc := range docs {
+		if doc.Deleted {
+			errs[i] = ms.remove(doc.Kind, doc.Id, doc.NanoTs)
+		} else {
+			errs[i] = ms.update(doc)
+		}
+	}
+	return errs
+}
+
+// update must be called with write lock held.
+func (ms *MemSearch) update(doc x.Doc) error {
+	docs, present := ms.docs[doc.Kind]
+	if !present {
+		docs = make(map[string]x.Doc)
+		ms.docs[doc.Kind] = docs
+	}
+	if pdoc, present := docs[doc.Id]; present {
 		if pdoc.NanoTs >= doc.NanoTs {
-			return errors.New("version conflict")
+			return search.ErrConflict
+		}
+		ms.unindexExact(pdoc)
+		ms.unindexText(pdoc)
+	}
+	if ts, present := ms.deleted[doc.Kind][doc.Id]; present {
+		if ts.nanoTs >= doc.NanoTs {
+			return search.ErrConflict
 		}
+		delete(ms.deleted[doc.Kind], doc.Id)
 	}
-	ms.docs[key] = doc
+	docs[doc.Id] = doc
+	ms.indexExact(doc)
+	ms.indexText(doc)
 	return nil
 }
 
+// tombstone is kept for a deleted doc, to stop older updates from
+// bringing it back.
+type tombstone struct {
+	nanoTs int64
+	at     time.Time // When the doc was deleted.
+}
+
+// defaultGCDeletes matches index.gc_deletes of Elastic Search.
+const defaultGCDeletes = time.Minute
+
+// SetGCDeletes sets how long tombstones of deleted docs are kept. Older
+// updates to a doc arriving after that could bring it back. Defaults to
+// a minute.
+func (ms *MemSearch) SetGCDeletes(d time.Duration) {
+	if d <= 0 {
+		log.WithField("duration", d).Fatal("Invalid gc deletes duration")
+		return
+	}
+	ms.Lock()
+	defer ms.Unlock()
+	ms.gcAfter = d
+}
+
+// gcDeletes drops the expired tombstones, sweeping at most once per
+// expiry duration. Must be called with write lock held.
+func (ms *MemSearch) gcDeletes(now time.Time) {
+	after := ms.gcAfter
+	if after == 0 {
+		after = defaultGCDeletes
+	}
+	if now.Sub(ms.lastGC) < after {
+		return
+	}
+	ms.lastGC = now
+	for kind, ids := range ms.deleted {
+		for id, ts := range ids {
+			if now.Sub(ts.at) >= after {
+				delete(ids, id)
+			}
+		}
+		if len(ids) == 0 {
+			delete(ms.deleted, kind)
+		}
+	}
+}
+
+// remove deletes the doc, and keeps a tombstone to stop older updates
+// from bringing it back. Must be called with write lock held.
+func (ms *MemSearch) remove(kind, id string, nanoTs int64) error {
+	now := time.Now()
+	ms.gcDeletes(now)
+
+	if pdoc, present := ms.docs[kind][id]; present {
+		if pdoc.NanoTs >= nanoTs {
+			return search.ErrConflict
+		}
+		ms.unindexExact(pdoc)
+		ms.unindexText(pdoc)
+		delete(ms.docs[kind], id)
+	}
+	if ts, present := ms.deleted[kind][id]; present && ts.nanoTs >= nanoTs {
+		return nil
+	}
+	if _, present := ms.deleted[kind]; !present {
+		ms.deleted[kind] = make(map[string]tombstone)
+	}
+	ms.deleted[kind][id] = tombstone{nanoTs: nanoTs, at: now}
+	return nil
+}
+
+func (ms *MemSearch) Delete(kind, id string, nanoTs int64) error {
+	ms.Lock()
+	defer ms.Unlock()
+	return ms.remove(kind, id, nanoTs)
+}
+
+func (ms *MemSearch) Get(kind, id string) (x.Doc, error) {
+	ms.RLock()
+	defer ms.RUnlock()
+	doc, present := ms.docs[kind][id]
+	if !present {
+		return doc, search.ErrNotFound
+	}
+	return doc, nil
+}
+
+func (ms *MemSearch) DeleteByQuery(q search.Query) error {
+	mq, ok := q.(*MemQuery)
+	if !ok || mq.ms != ms {
+		return errors.New("Query not created by this engine")
+	}
+	if err := mq.collect(); err != nil {
+		return err
+	}
+
+	ms.Lock()
+	defer ms.Unlock()
+	for _, doc := range mq.Docs {
+		// Docs updated since collect would have higher timestamps,
+		// and would stay.
+		if err := ms.remove(doc.Kind, doc.Id, doc.NanoTs+1); err != nil {
+			log.WithField("doc", doc).Debug("Doc updated, skipping delete")
+		}
+	}
+	log.WithField("num_docs", len(mq.Docs)).Debug("Deleted by query")
+	return nil
+}
+
+// NewAndFilter adds a new AND filter group to the query. If called more
+// than once, or along with NewOrFilter, all the groups need to match.
 func (mq *MemQuery) NewAndFilter() search.FilterQuery {
-	mq.filter = new(MemFilter)
-	mq.filterType = 1 // AND
-	return mq.filter
+	if mq.filter == nil {
+		mq.filter = &MemFilter{filterType: 1}
+	}
+	return mq.filter.And()
 }
 
+// NewOrFilter adds a new OR filter group to the query.
 func (mq *MemQuery) NewOrFilter() search.FilterQuery {
-	mq.filter = new(MemFilter)
-	mq.filterType = 2 // OR
-	return mq.filter
+	if mq.filter == nil {
+		mq.filter = &MemFilter{filterType: 1}
+	}
+	return mq.filter.Or()
+}
+
+func (mf *MemFilter) addGroup(filterType int) *MemFilter {
+	group := &MemFilter{filterType: filterType}
+	mf.groups = append(mf.groups, group)
+	return group
+}
+
+func (mf *MemFilter) And() search.FilterQuery {
+	return mf.addGroup(1)
+}
+
+func (mf *MemFilter) Or() search.FilterQuery {
+	return mf.addGroup(2)
 }
 
 func (mf *MemFilter) AddExact(field string,
@@ -97,41 +319,265 @@ func (mf *MemFilter) AddRegex(field string,
 	value string) search.FilterQuery {
 
 	filter := Filter{Field: field, Regex: value}
+	re, err := regexp.Compile(value)
+	if err != nil {
+		x.LogErr(log, err).WithField("regex", value).Error("While compiling regex")
+	}
+	filter.re = re
 	mf.filters = append(mf.filters, filter)
 	return mf
 }
 
-func matchExact(doc x.Doc, field string, value interface{}) bool {
+func (mf *MemFilter) AddRange(field string, op string,
+	value interface{}) search.FilterQuery {
+
+	filter := Filter{Field: field, Op: op, Value: value}
+	mf.filters = append(mf.filters, filter)
+	return mf
+}
+
+func (mf *MemFilter) AddExists(field string) search.FilterQuery {
+	filter := Filter{Field: field, Op: opExists}
+	mf.filters = append(mf.filters, filter)
+	return mf
+}
+
+func (mf *MemFilter) AddMissing(field string) search.FilterQuery {
+	filter := Filter{Field: field, Op: opMissing}
+	mf.filters = append(mf.filters, filter)
+	return mf
+}
+
+func (mf *MemFilter) AddIn(field string,
+	values ...interface{}) search.FilterQuery {
+
+	filter := Filter{Field: field, Op: opIn, Values: values}
+	mf.filters = append(mf.filters, filter)
+	return mf
+}
+
+func (mf *MemFilter) Not() search.FilterQuery {
+	return &NotFilter{parent: mf}
+}
+
+func (nf *NotFilter) negate() *MemFilter {
+	last := len(nf.parent.filters) - 1
+	nf.parent.filters[last].Negate = true
+	return nf.parent
+}
+
+func (nf *NotFilter) AddExact(field string,
+	value interface{}) search.FilterQuery {
+	nf.parent.AddExact(field, value)
+	return nf.negate()
+}
+
+func (nf *NotFilter) AddRegex(field string,
+	value string) search.FilterQuery {
+	nf.parent.AddRegex(field, value)
+	return nf.negate()
+}
+
+func (nf *NotFilter) AddRange(field string, op string,
+	value interface{}) search.FilterQuery {
+	nf.parent.AddRange(field, op, value)
+	return nf.negate()
+}
+
+func (nf *NotFilter) AddExists(field string) search.FilterQuery {
+	nf.parent.AddExists(field)
+	return nf.negate()
+}
+
+func (nf *NotFilter) AddMissing(field string) search.FilterQuery {
+	nf.parent.AddMissing(field)
+	return nf.negate()
+}
+
+func (nf *NotFilter) AddIn(field string,
+	values ...interface{}) search.FilterQuery {
+	nf.parent.AddIn(field, values...)
+	return nf.negate()
+}
+
+func (nf *NotFilter) And() search.FilterQuery {
+	group := nf.parent.addGroup(1)
+	group.negate = true
+	return group
+}
+
+func (nf *NotFilter) Or() search.FilterQuery {
+	group := nf.parent.addGroup(2)
+	group.negate = true
+	return group
+}
+
+// Not on a NotFilter cancels out the negation.
+func (nf *NotFilter) Not() search.FilterQuery {
+	return nf.parent
+}
+
+// dataField strips the optional "data." prefix from field.
+func dataField(field string) string {
 	if len(field) > len("data.") && strings.ToLower(field[0:5]) == "data." {
-		field = field[5:]
+		return field[5:]
+	}
+	return field
+}
+
+func fieldValue(doc x.Doc, field string) (interface{}, bool) {
+	field = dataField(field)
+	fields, ok := doc.Data.(map[string]interface{})
+	if !ok {
+		return nil, false
 	}
+	val, present := fields[field]
+	return val, present
+}
 
-	fields := doc.Data.(map[string]interface{})
-	if val, present := fields[field]; present {
-		if match := reflect.DeepEqual(val, value); match {
+// equal compares val against value. If val is a list, any of the elements
+// being equal to value counts as a match, similar to how search engines
+// treat array fields.
+func equal(val, value interface{}) bool {
+	if reflect.DeepEqual(val, value) {
+		return true
+	}
+	if c, ok := compare(val, value); ok && c == 0 {
+		return true
+	}
+	rv := reflect.ValueOf(val)
+	if rv.Kind() != reflect.Slice && rv.Kind() != reflect.Array {
+		return false
+	}
+	for i := 0; i < rv.Len(); i++ {
+		if equal(rv.Index(i).Interface(), value) {
 			return true
 		}
 	}
 	return false
 }
 
-func matchRegex(doc x.Doc, field, value string) bool {
-	re := regexp.MustCompile(value)
-	if len(field) > len("data.") && strings.ToLower(field[0:5]) == "data." {
-		field = field[5:]
+func toFloat(v interface{}) (float64, bool) {
+	switch t := v.(type) {
+	case int:
+		return float64(t), true
+	case int32:
+		return float64(t), true
+	case int64:
+		return float64(t), true
+	case float32:
+		return float64(t), true
+	case float64:
+		return t, true
+	}
+	return 0, false
+}
+
+// compare returns -1, 0 or 1 depending upon whether a is less than, equal to
+// or greater than b. Numbers of different types are compared numerically.
+// Returns false if the two values can't be compared.
+func compare(a, b interface{}) (int, bool) {
+	if fa, ok := toFloat(a); ok {
+		fb, ok := toFloat(b)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case fa < fb:
+			return -1, true
+		case fa > fb:
+			return 1, true
+		}
+		return 0, true
+	}
+	sa, ok := a.(string)
+	if !ok {
+		return 0, false
+	}
+	sb, ok := b.(string)
+	if !ok {
+		return 0, false
+	}
+	return strings.Compare(sa, sb), true
+}
+
+func matchExact(doc x.Doc, field string, value interface{}) bool {
+	if val, present := fieldValue(doc, field); present {
+		return equal(val, value)
+	}
+	return false
+}
+
+func matchRegex(doc x.Doc, field string, re *regexp.Regexp) bool {
+	if val, present := fieldValue(doc, field); present {
+		if vals, ok := val.(string); ok {
+			return re.MatchString(vals)
+		}
 	}
+	return false
+}
 
-	fields := doc.Data.(map[string]interface{})
-	if val, present := fields[field]; present {
-		vals := val.(string)
+func matchRange(doc x.Doc, field, op string, value interface{}) bool {
+	val, present := fieldValue(doc, field)
+	if !present {
+		return false
+	}
+	c, ok := compare(val, value)
+	if !ok {
+		return false
+	}
+	switch op {
+	case search.Gt:
+		return c > 0
+	case search.Gte:
+		return c >= 0
+	case search.Lt:
+		return c < 0
+	case search.Lte:
+		return c <= 0
+	}
+	return false
+}
 
-		if re.MatchString(vals) {
+func matchIn(doc x.Doc, field string, values []interface{}) bool {
+	for _, value := range values {
+		if matchExact(doc, field, value) {
 			return true
 		}
 	}
 	return false
 }
 
+func matchFilter(doc x.Doc, f Filter) (bool, error) {
+	if len(f.Field) == 0 {
+		return false, errors.New("Invalid field")
+	}
+
+	var m bool
+	switch {
+	case len(f.Regex) > 0:
+		if f.re == nil {
+			return false, errors.New("Invalid regex: " + f.Regex)
+		}
+		m = matchRegex(doc, f.Field, f.re)
+	case f.Op == opExists:
+		_, m = fieldValue(doc, f.Field)
+	case f.Op == opMissing:
+		_, present := fieldValue(doc, f.Field)
+		m = !present
+	case f.Op == opIn:
+		m = matchIn(doc, f.Field, f.Values)
+	case f.Op == search.Gt || f.Op == search.Gte ||
+		f.Op == search.Lt || f.Op == search.Lte:
+		m = matchRange(doc, f.Field, f.Op, f.Value)
+	case len(f.Op) > 0:
+		return false, errors.New("Invalid filter op: " + f.Op)
+	default:
+		m = matchExact(doc, f.Field, f.Value)
+	}
+	return m != f.Negate, nil
+}
+
 func (mq *MemQuery) From(num int) search.Query {
 	mq.from = num
 	return mq
@@ -142,182 +588,360 @@ func (mq *MemQuery) Limit(num int) search.Query {
 	return mq
 }
 
-func (mq *MemQuery) Order(field string) search.Query {
-	mq.order = field
+// Match runs full text search for text over field, using the same
+// tokenization and stemming as used while indexing. Results are ordered
+// by BM25 relevance, unless Order is set.
+func (mq *MemQuery) Match(field, text string) search.Query {
+	mc := matchClause{field: field, terms: mq.ms.analyze(text)}
+	mq.matches = append(mq.matches, mc)
+	return mq
+}
+
+// Order sorts docs by the fields, in ascending order unless prefixed by
+// "-". Numbers of different types are compared numerically.
+func (mq *MemQuery) Order(fields ...string) search.Query {
+	mq.order = search.ParseOrder(fields...)
+	return mq
+}
+
+func (mq *MemQuery) Missing(position string) search.Query {
+	mq.missing = position
 	return mq
 }
 
 type Docs struct {
-	data  []x.Doc
-	field string
-	fn    func(i, j x.Doc)
+	data         []x.Doc
+	keys         []search.SortKey
+	missingFirst bool
 }
 
 func (d Docs) Len() int      { return len(d.data) }
 func (d Docs) Swap(i, j int) { d.data[i], d.data[j] = d.data[j], d.data[i] }
-func (d Docs) Get(i int) (val interface{}) {
-	di := d.data[i]
-	fi := di.Data.(map[string]interface{})
-	vi, pi := fi[d.field]
-	if !pi {
-		log.WithFields(logrus.Fields{
-			"field": d.field,
-			"data":  fi,
-		}).Fatal("Field not found for sorting")
-		return nil
-	}
-	return vi
+func (d Docs) Get(i int, field string) interface{} {
+	val, _ := fieldValue(d.data[i], field)
+	return val
 }
 func (d Docs) Less(i, j int) bool {
-	vi := d.Get(i)
-	vj := d.Get(j)
-	if reflect.TypeOf(vi) != reflect.TypeOf(vj) {
-		log.WithFields(logrus.Fields{
-			"vi":    vi,
-			"vj":    vj,
-			"field": d.field,
-		}).Fatal("Different types")
-		return false
+	for _, key := range d.keys {
+		c := d.compareKey(key, d.Get(i, key.Field), d.Get(j, key.Field))
+		if c != 0 {
+			return c < 0
+		}
+	}
+	// Break ties by id, to keep pagination stable.
+	return d.data[i].Id < d.data[j].Id
+}
+
+// compareKey compares the values of a sort key, taking the sort direction
+// into account. Nil values, which includes missing ones, are placed first
+// or last, irrespective of the direction.
+func (d Docs) compareKey(key search.SortKey, vi, vj interface{}) int {
+	switch {
+	case vi == nil && vj == nil:
+		return 0
+	case vi == nil:
+		if d.missingFirst {
+			return -1
+		}
+		return 1
+	case vj == nil:
+		if d.missingFirst {
+			return 1
+		}
+		return -1
+	}
+	c := order(vi, vj)
+	if key.Desc {
+		return -c
+	}
+	return c
+}
+
+// order is like compare, but orders any two values. Values which can't be
+// compared are ordered by type: numbers, strings, bools, and then the rest.
+// Values of the same type are then ordered by their string representation.
+func order(a, b interface{}) int {
+	if c, ok := compare(a, b); ok {
+		return c
+	}
+	ra, rb := typeRank(a), typeRank(b)
+	switch {
+	case ra < rb:
+		return -1
+	case ra > rb:
+		return 1
 	}
-	switch t := vi.(type) {
+	if ba, ok := a.(bool); ok {
+		bb := b.(bool)
+		switch {
+		case ba == bb:
+			return 0
+		case bb:
+			return -1
+		}
+		return 1
+	}
+	return strings.Compare(fmt.Sprintf("%v", a), fmt.Sprintf("%v", b))
+}
+
+func typeRank(v interface{}) int {
+	if _, ok := toFloat(v); ok {
+		return 0
+	}
+	switch v.(type) {
 	case string:
-		return vi.(string) < vj.(string)
-	case int64:
-		return vi.(int64) < vj.(int64)
-	case int32:
-		return vi.(int32) < vj.(int32)
-	case int:
-		return vi.(int) < vj.(int)
-	case float64:
-		return vi.(float64) < vj.(float64)
-	default:
-		log.WithFields(logrus.Fields{
-			"vi":         vi,
-			"vj":         vj,
-			"field":      d.field,
-			"type_found": fmt.Sprintf("%T", t),
-		}).Fatal("Invalid type")
+		return 1
+	case bool:
+		return 2
 	}
+	return 3
+}
 
-	return false
+// byScore sorts docs by descending relevance score.
+type byScore struct {
+	data   []x.Doc
+	scores map[string]float64
 }
 
-func (mq *MemQuery) bringOrder(field string) search.Query {
-	reverse := false
-	if strings.HasPrefix(field, "-") {
-		reverse = true
-		field = field[1:]
+func (d byScore) Len() int      { return len(d.data) }
+func (d byScore) Swap(i, j int) { d.data[i], d.data[j] = d.data[j], d.data[i] }
+func (d byScore) Less(i, j int) bool {
+	si := d.scores[d.data[i].Id]
+	sj := d.scores[d.data[j].Id]
+	if si != sj {
+		return si > sj
 	}
-	if len(field) > len("data.") && strings.ToLower(field[0:5]) == "data." {
-		field = field[5:]
+	return d.data[i].Id < d.data[j].Id
+}
+
+func (mq *MemQuery) sorter() Docs {
+	return Docs{
+		data:         mq.Docs,
+		keys:         mq.order,
+		missingFirst: mq.missing == search.MissingFirst,
 	}
+}
+
+func (mq *MemQuery) bringOrder() {
+	sort.Sort(mq.sorter())
+}
 
-	eligible := mq.Docs[:0]
+// byId sorts docs by id, when no other order is requested.
+type byId []x.Doc
+
+func (d byId) Len() int           { return len(d) }
+func (d byId) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+func (d byId) Less(i, j int) bool { return d[i].Id < d[j].Id }
+
+// After decodes the cursor. Any error is returned when the query is run.
+func (mq *MemQuery) After(cursor string) search.Query {
+	c, err := search.DecodeCursor(cursor)
+	mq.after = &c
+	mq.afterErr = err
+	return mq
+}
+
+// sortValues returns the values the doc is ordered by, which get stored
+// in the cursor, along with the doc id. Missing values are stored as nil.
+func (mq *MemQuery) sortValues(doc x.Doc) (vals []interface{}) {
+	for _, key := range mq.order {
+		val, _ := fieldValue(doc, key.Field)
+		vals = append(vals, val)
+	}
+	return vals
+}
+
+// isAfter returns true if doc would be ordered after the cursor position.
+func (mq *MemQuery) isAfter(doc x.Doc, c *search.Cursor) bool {
+	keys := mq.order
+	d := mq.sorter()
+	vals := mq.sortValues(doc)
+	for i := 0; i < len(keys) && i < len(vals) && i < len(c.Values); i++ {
+		if cmp := d.compareKey(keys[i], vals[i], c.Values[i]); cmp != 0 {
+			return cmp > 0
+		}
+	}
+	return doc.Id > c.Id
+}
+
+func (mq *MemQuery) runAfter() error {
+	if mq.afterErr != nil {
+		return mq.afterErr
+	}
+	if mq.after.Kind != mq.kind {
+		return search.ErrInvalidCursor
+	}
+	if len(mq.order) == 0 && len(mq.matches) > 0 {
+		return search.ErrRelevanceCursor
+	}
+	filtered := mq.Docs[:0]
 	for _, doc := range mq.Docs {
-		fi := doc.Data.(map[string]interface{})
-		if _, pi := fi[field]; pi {
-			eligible = append(eligible, doc)
+		if mq.isAfter(doc, mq.after) {
+			filtered = append(filtered, doc)
 		}
 	}
-	mq.Docs = eligible
+	mq.Docs = filtered
+	return nil
+}
 
-	docs := Docs{data: mq.Docs, field: field}
-	if reverse {
-		sort.Sort(sort.Reverse(docs))
-	} else {
-		sort.Sort(docs)
+// matches runs the filters and nested filter groups over the doc. Empty
+// groups are ignored.
+func (mf *MemFilter) matches(doc x.Doc) (bool, error) {
+	if mf.filterType != 1 && mf.filterType != 2 {
+		return false, errors.New("Invalid filter type")
 	}
-	return mq
+	if mf.empty() {
+		return true, nil
+	}
+
+	// AND stops at the first mismatch, OR stops at the first match.
+	and := mf.filterType == 1
+	for _, f := range mf.filters {
+		m, err := matchFilter(doc, f)
+		if err != nil {
+			return false, err
+		}
+		if m != and {
+			return m != mf.negate, nil
+		}
+	}
+	for _, group := range mf.groups {
+		if group.empty() {
+			continue
+		}
+		m, err := group.matches(doc)
+		if err != nil {
+			return false, err
+		}
+		if m != and {
+			return m != mf.negate, nil
+		}
+	}
+	return and != mf.negate, nil
 }
 
-func (mq *MemQuery) runAndFilter(filters []Filter) error {
+func (mf *MemFilter) empty() bool {
+	if len(mf.filters) > 0 {
+		return false
+	}
+	for _, group := range mf.groups {
+		if !group.empty() {
+			return false
+		}
+	}
+	return true
+}
+
+func (mq *MemQuery) runFilter() error {
 	docs := mq.Docs
 	filtered := docs[:0]
 	for _, doc := range docs {
-
-		for _, f := range filters {
-			if len(f.Field) == 0 {
-				return errors.New("Invalid field")
-			}
-
-			if len(f.Regex) > 0 {
-				if m := matchRegex(doc, f.Field, f.Regex); m {
-					filtered = append(filtered, doc)
-					break // from filters.
-				}
-			} else {
-				if m := matchExact(doc, f.Field, f.Value); m {
-					filtered = append(filtered, doc)
-					break // from filters.
-				}
-			}
+		m, err := mq.filter.matches(doc)
+		if err != nil {
+			return err
+		}
+		if m {
+			filtered = append(filtered, doc)
 		}
 	}
 	mq.Docs = filtered
 	return nil
 }
 
-func (mq *MemQuery) runOrFilter(filters []Filter) error {
+// runMatch drops docs which don't match all the match clauses, and
+// stores the relevance scores of the remaining ones.
+func (mq *MemQuery) runMatch() {
+	mq.ms.RLock()
+	defer mq.ms.RUnlock()
+
+	mq.scores = make(map[string]float64)
 	docs := mq.Docs
 	filtered := docs[:0]
 	for _, doc := range docs {
-
-		match := false
-		for _, f := range filters {
-			if len(f.Field) == 0 {
-				return errors.New("Invalid field")
-			}
-
-			if len(f.Regex) > 0 {
-				if matchRegex(doc, f.Field, f.Regex) {
-					match = true
-					break // from filters
-				}
-			} else {
-				if matchExact(doc, f.Field, f.Value) {
-					match = true
-					break // from filters
-				}
+		var total float64
+		match := true
+		for _, mc := range mq.matches {
+			score, found := mq.ms.score(doc, mc)
+			if !found {
+				match = false
+				break
 			}
+			total += score
 		}
-
 		if match {
+			mq.scores[doc.Id] = total
 			filtered = append(filtered, doc)
 		}
 	}
 	mq.Docs = filtered
-	return nil
 }
 
-func (mq *MemQuery) runFilter() error {
-	if mq.filterType == 0 {
-		return errors.New("Filter present, but not set")
+// bringRelevance sorts docs by descending score, breaking ties by id
+// to keep results stable.
+func (mq *MemQuery) bringRelevance() {
+	sort.Sort(byScore{data: mq.Docs, scores: mq.scores})
+}
 
-	} else if mq.filterType == 1 {
-		if err := mq.runAndFilter(mq.filter.filters); err != nil {
-			return err
+// load copies the docs which could match the query from the engine,
+// narrowing them down via exact index where possible.
+func (mq *MemQuery) load() {
+	mq.ms.RLock()
+	defer mq.ms.RUnlock()
+
+	docs := mq.ms.docs[mq.kind]
+	mq.Docs = nil
+	if mq.filter != nil {
+		if ids, ok := mq.filter.required(mq.ms, mq.kind); ok {
+			for id := range ids {
+				if doc, present := docs[id]; present {
+					mq.Docs = append(mq.Docs, doc)
+				}
+			}
+			return
 		}
-	} else if mq.filterType == 2 {
-		if err := mq.runOrFilter(mq.filter.filters); err != nil {
+	}
+	for _, doc := range docs {
+		mq.Docs = append(mq.Docs, doc)
+	}
+}
+
+// collect loads the docs, and keeps only the ones matching filters and
+// match clauses.
+func (mq *MemQuery) collect() error {
+	mq.load()
+	if mq.filter != nil {
+		if err := mq.runFilter(); err != nil {
 			return err
 		}
-	} else {
-		return errors.New("Invalid filter type")
+	}
+	if len(mq.matches) > 0 {
+		mq.runMatch()
 	}
 	return nil
 }
 
 func (mq *MemQuery) Run() (docs []x.Doc, rerr error) {
-	if mq.filter != nil {
-		if err := mq.runFilter(); err != nil {
-			return docs, err
-		}
+	if err := mq.collect(); err != nil {
+		return docs, err
 	}
 	if len(mq.order) > 0 {
-		mq.bringOrder(mq.order)
+		mq.bringOrder()
+	} else if len(mq.matches) > 0 {
+		mq.bringRelevance()
+	} else {
+		sort.Sort(byId(mq.Docs))
 	}
-	if mq.from > 0 && mq.from < len(mq.Docs) {
-		mq.Docs = mq.Docs[mq.from:]
+	if mq.after != nil {
+		if err := mq.runAfter(); err != nil {
+			return docs, err
+		}
+	}
+	if mq.from > 0 {
+		if mq.from < len(mq.Docs) {
+			mq.Docs = mq.Docs[mq.from:]
+		} else {
+			mq.Docs = mq.Docs[:0]
+		}
 	}
 	if mq.limit > 0 && len(mq.Docs) > mq.limit {
 		mq.Docs = mq.Docs[0:mq.limit]
@@ -325,11 +949,19 @@ func (mq *MemQuery) Run() (docs []x.Doc, rerr error) {
 	return mq.Docs, nil
 }
 
+func (mq *MemQuery) RunPage() (docs []x.Doc, cursor string, rerr error) {
+	docs, err := mq.Run()
+	if err != nil || len(docs) == 0 {
+		return docs, "", err
+	}
+	last := docs[len(docs)-1]
+	c := search.Cursor{Values: mq.sortValues(last), Kind: last.Kind, Id: last.Id}
+	return docs, c.Encode(), nil
+}
+
 func (mq *MemQuery) Count() (rcount int64, rerr error) {
-	if mq.filter != nil {
-		if err := mq.runFilter(); err != nil {
-			return 0, err
-		}
+	if err := mq.collect(); err != nil {
+		return 0, err
 	}
 	return int64(len(mq.Docs)), nil
 }
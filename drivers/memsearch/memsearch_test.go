@@ -1,9 +1,18 @@
 package memsearch
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/aslanides/gocrud/search"
 	"github.com/aslanides/gocrud/testx"
+	"github.com/aslanides/gocrud/x"
 )
 
 func initialize() *MemSearch {
@@ -39,6 +48,292 @@ func TestFrom(t *testing.T) {
 	testx.RunFromLimit(ms, t)
 }
 
+func TestRangeFilter(t *testing.T) {
+	testx.RunRangeFilter(ms, t)
+}
+
+func TestExistsFilter(t *testing.T) {
+	testx.RunExistsFilter(ms, t)
+}
+
+func TestInFilter(t *testing.T) {
+	testx.RunInFilter(ms, t)
+}
+
+func TestNotFilter(t *testing.T) {
+	testx.RunNotFilter(ms, t)
+}
+
+func TestNestedFilter(t *testing.T) {
+	testx.RunNestedFilter(ms, t)
+}
+
+func TestMatch(t *testing.T) {
+	testx.RunMatch(ms, t)
+}
+
+func TestMatchStemmer(t *testing.T) {
+	m := new(MemSearch)
+	m.SetStemmer(func(token string) string {
+		if strings.HasSuffix(token, "ies") {
+			return token[:len(token)-3] + "y"
+		}
+		return strings.TrimSuffix(token, "s")
+	})
+	m.Init()
+
+	bodies := []string{"Spiral galaxies", "A galaxy far away", "Nebulas"}
+	for idx, body := range bodies {
+		d := x.Doc{Kind: "Post", Id: x.UniqueString(5), NanoTs: time.Now().UnixNano()}
+		d.Data = map[string]interface{}{"body": body, "pos": idx}
+		if err := m.Update(d); err != nil {
+			t.Fatalf("While updating: %v", err)
+		}
+	}
+
+	docs, err := m.NewQuery("Post").Match("data.body", "GALAXIES").Order("pos").Run()
+	if err != nil {
+		t.Fatalf("While running query: %v", err)
+	}
+	if len(docs) != 2 {
+		t.Fatalf("Number of docs should be 2. Found: %v", len(docs))
+	}
+	for idx, doc := range docs {
+		body := doc.Data.(map[string]interface{})["body"]
+		if body != bodies[idx] {
+			t.Errorf("Expected: %v. Found: %v", bodies[idx], body)
+		}
+	}
+}
+
+func TestMatchUpdate(t *testing.T) {
+	m := new(MemSearch)
+	m.Init()
+	for i, body := range []string{"Red apple", "Green apple"} {
+		d := x.Doc{Kind: "Post", Id: fmt.Sprintf("p%d", i), NanoTs: 1}
+		d.Data = map[string]interface{}{"body": body}
+		if err := m.Update(d); err != nil {
+			t.Fatalf("While updating: %v", err)
+		}
+	}
+	d := x.Doc{Kind: "Post", Id: "p0", NanoTs: 2}
+	d.Data = map[string]interface{}{"body": "Blue sky"}
+	if err := m.Update(d); err != nil {
+		t.Fatalf("While updating: %v", err)
+	}
+
+	for text, expected := range map[string]int64{"apple": 1, "red": 0, "sky": 1} {
+		count, err := m.NewQuery("Post").Match("data.body", text).Count()
+		if err != nil {
+			t.Fatalf("While running query: %v", err)
+		}
+		if count != expected {
+			t.Errorf("Expected %v docs matching %q. Found: %v", expected, text, count)
+		}
+	}
+	p := m.text[postingsKey("Post", "body")]
+	if _, present := p.terms["red"]; present || p.total != 4 {
+		t.Errorf("Expected postings of old doc to be removed. Found: %+v", p)
+	}
+}
+
+func TestConcurrentUpdates(t *testing.T) {
+	m := new(MemSearch)
+	m.Init()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				id := fmt.Sprintf("like_%d_%d", i, j)
+				d := x.Doc{Kind: "Like", Id: id, NanoTs: time.Now().UnixNano()}
+				d.Data = map[string]interface{}{"routine": i, "tags": []string{"hot"}}
+				if err := m.Update(d); err != nil {
+					t.Errorf("While updating: %v", err)
+				}
+				q := m.NewQuery("Like")
+				q.NewAndFilter().AddExact("routine", i)
+				if _, err := q.Run(); err != nil {
+					t.Errorf("While running query: %v", err)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	q := m.NewQuery("Like")
+	q.NewAndFilter().AddExact("routine", 3.0).AddExact("tags", "hot")
+	count, err := q.Count()
+	if err != nil {
+		t.Fatalf("While running query: %v", err)
+	}
+	if count != 50 {
+		t.Errorf("Count of results should be 50. Found: %v", count)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "memsearch_")
+	if err != nil {
+		t.Fatalf("While creating temp dir: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "snapshot.json")
+
+	m := new(MemSearch)
+	m.SetSnapshotFile(path)
+	m.Init()
+	testx.AddDocs(m)
+	if err := m.Snapshot(); err != nil {
+		t.Fatalf("While writing snapshot: %v", err)
+	}
+
+	loaded := new(MemSearch)
+	loaded.SetSnapshotFile(path)
+	loaded.Init()
+	if len(loaded.All()) != len(m.All()) {
+		t.Errorf("Expected %v docs. Found: %v", len(m.All()), len(loaded.All()))
+	}
+	testx.RunAndFilter(loaded, t)
+	testx.RunOrFilter(loaded, t)
+	testx.RunMatch(loaded, t)
+}
+
+func TestCursor(t *testing.T) {
+	testx.RunCursor(ms, t)
+}
+
+func TestMultiOrder(t *testing.T) {
+	testx.RunMultiOrder(ms, t)
+}
+
+func TestOrderMixedTypes(t *testing.T) {
+	m := new(MemSearch)
+	m.Init()
+	// Numbers of different types, as found after JSON decoding, along
+	// with values which can't be compared numerically.
+	vals := []interface{}{int64(3), 2.5, 1, "abc", nil, true}
+	for idx, val := range vals {
+		d := x.Doc{Kind: "Score", Id: fmt.Sprintf("s%d", idx), NanoTs: 1}
+		d.Data = map[string]interface{}{"score": val}
+		if err := m.Update(d); err != nil {
+			t.Fatalf("While updating: %v", err)
+		}
+	}
+	d := x.Doc{Kind: "Score", Id: "s9", NanoTs: 1}
+	d.Data = map[string]interface{}{}
+	if err := m.Update(d); err != nil {
+		t.Fatalf("While updating: %v", err)
+	}
+
+	docs, err := m.NewQuery("Score").Order("score").Run()
+	if err != nil {
+		t.Fatalf("While running query: %v", err)
+	}
+	var ids []string
+	for _, doc := range docs {
+		ids = append(ids, doc.Id)
+	}
+	expected := "s2 s1 s0 s3 s5 s4 s9"
+	if strings.Join(ids, " ") != expected {
+		t.Errorf("Expected: %v. Found: %v", expected, ids)
+	}
+}
+
+func TestGet(t *testing.T) {
+	testx.RunGet(ms, t)
+}
+
+func TestDelete(t *testing.T) {
+	testx.RunDelete(ms, t)
+
+	m := new(MemSearch)
+	m.Init()
+	testx.AddDocs(m)
+	q := m.NewQuery("Galaxy")
+	q.NewOrFilter().AddRegex("name", ".*galaxy.*")
+	if err := m.DeleteByQuery(q); err != nil {
+		t.Fatalf("While deleting by query: %v", err)
+	}
+	count, err := m.NewQuery("Galaxy").Count()
+	if err != nil {
+		t.Fatalf("While running query: %v", err)
+	}
+	if count != 6 {
+		t.Errorf("Count of results should be 6. Found: %v", count)
+	}
+	count, err = m.NewQuery("Galaxy").Match("name", "galaxy").Count()
+	if err != nil {
+		t.Fatalf("While running query: %v", err)
+	}
+	if count != 0 {
+		t.Errorf("Deleted docs should be removed from text index. Found: %v", count)
+	}
+}
+
+func TestGCDeletes(t *testing.T) {
+	m := new(MemSearch)
+	m.Init()
+	m.SetGCDeletes(10 * time.Millisecond)
+	if err := m.Delete("Post", "p1", 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Update(x.Doc{Kind: "Post", Id: "p1", NanoTs: 4}); err != search.ErrConflict {
+		t.Errorf("Expected conflict with tombstone. Got: %v", err)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	if err := m.Delete("Post", "p2", 5); err != nil {
+		t.Fatal(err)
+	}
+	if _, present := m.deleted["Post"]["p1"]; present {
+		t.Error("Expected expired tombstone to be dropped")
+	}
+	if _, present := m.deleted["Post"]["p2"]; !present {
+		t.Error("Expected tombstone for p2")
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	testx.RunAggregate(ms, t)
+}
+
+func TestDateHistogram(t *testing.T) {
+	m := new(MemSearch)
+	m.Init()
+	day := int64(24 * time.Hour / time.Millisecond)
+	times := []int64{day + 10, day + 20, 3*day + 5}
+	for idx, ts := range times {
+		d := x.Doc{Kind: "Post", Id: fmt.Sprintf("p%d", idx), NanoTs: 1}
+		d.Data = map[string]interface{}{"creation_ms": ts, "activity": idx * 10}
+		if err := m.Update(d); err != nil {
+			t.Fatalf("While updating: %v", err)
+		}
+	}
+
+	aggs, err := m.NewQuery("Post").Aggregate("per_day",
+		search.DateHistogram("creation_ms", 24*time.Hour).
+			Sub("activity", search.Stats("activity"))).RunAggregations()
+	if err != nil {
+		t.Fatalf("While running aggregations: %v", err)
+	}
+	buckets := aggs["per_day"].Buckets
+	if len(buckets) != 2 {
+		t.Fatalf("Expected 2 buckets. Found: %+v", buckets)
+	}
+	if buckets[0].Key != day || buckets[0].Count != 2 {
+		t.Errorf("Unexpected bucket: %+v", buckets[0])
+	}
+	if buckets[1].Key != 3*day || buckets[1].Count != 1 {
+		t.Errorf("Unexpected bucket: %+v", buckets[1])
+	}
+	if avg := buckets[0].Subs["activity"].Stats.Avg; avg != 5 {
+		t.Errorf("Expected avg activity 5. Found: %v", avg)
+	}
+}
+
 var ms *MemSearch
 
 func init() {
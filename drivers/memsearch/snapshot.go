@@ -0,0 +1,78 @@
+package memsearch
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/aslanides/gocrud/x"
+)
+
+var ErrNoSnapshotFile = errors.New("No snapshot file set")
+
+// SetSnapshotFile sets the file docs would be written to by Snapshot, and
+// loaded back from by Init, if the file exists. SetSnapshotFile should be
+// called before Init.
+func (ms *MemSearch) SetSnapshotFile(path string) {
+	ms.snapshot = path
+}
+
+// Snapshot writes all the docs to the snapshot file, in JSON format. The
+// file is written to a temporary location first, and then renamed, so a
+// crash during Snapshot doesn't corrupt the existing snapshot.
+func (ms *MemSearch) Snapshot() error {
+	if len(ms.snapshot) == 0 {
+		return ErrNoSnapshotFile
+	}
+	data, err := json.Marshal(ms.All())
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(ms.snapshot), "memsearch_")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), ms.snapshot); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	log.WithField("file", ms.snapshot).Debug("Snapshot written")
+	return nil
+}
+
+// load reads docs back from the snapshot file, if it exists. Note that
+// numbers in docs would be loaded as float64, as for any JSON decoding.
+func (ms *MemSearch) load() error {
+	data, err := ioutil.ReadFile(ms.snapshot)
+	if os.IsNotExist(err) {
+		log.WithField("file", ms.snapshot).Debug("No snapshot found")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var docs []x.Doc
+	if err := json.Unmarshal(data, &docs); err != nil {
+		return err
+	}
+	for _, doc := range docs {
+		if err := ms.Update(doc); err != nil {
+			return err
+		}
+	}
+	log.WithField("num_docs", len(docs)).Debug("Snapshot loaded")
+	return nil
+}
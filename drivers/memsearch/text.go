@@ -0,0 +1,184 @@
+package memsearch
+
+import (
+	"math"
+	"strings"
+	"unicode"
+
+	"github.com/aslanides/gocrud/x"
+)
+
+// BM25 parameters. k1 controls term frequency saturation, and b controls
+// how much the field length normalizes the score.
+const (
+	bm25K1 = 1.2
+	bm25B  = 0.75
+)
+
+// postings stores the inverted index for one field, across all docs of
+// one kind.
+type postings struct {
+	terms   map[string]map[string]int // term -> doc id -> term frequency.
+	lengths map[string]int            // doc id -> number of terms in field.
+	total   int                       // Sum of all lengths.
+}
+
+// textIndex maps kind and field to the postings for that field.
+type textIndex map[string]*postings
+
+// matchClause stores the analyzed terms for a Match call on query.
+type matchClause struct {
+	field string
+	terms []string
+}
+
+func postingsKey(kind, field string) string {
+	return kind + ":" + field
+}
+
+// SetStemmer sets the function used to reduce each lowercased token to its
+// stem, both while indexing docs and while running Match queries. For e.g.
+// a porter stemmer would map "galaxies" to "galaxi". SetStemmer should be
+// called before any docs are added.
+func (ms *MemSearch) SetStemmer(stemmer func(token string) string) {
+	ms.stemmer = stemmer
+}
+
+// analyze splits text into lowercased tokens on non alphanumeric runes,
+// and runs them via the stemmer, if set.
+func (ms *MemSearch) analyze(text string) []string {
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+	if ms.stemmer == nil {
+		return words
+	}
+	terms := words[:0]
+	for _, w := range words {
+		if t := ms.stemmer(w); len(t) > 0 {
+			terms = append(terms, t)
+		}
+	}
+	return terms
+}
+
+// textOf returns the strings held by val, if val is a string or a list
+// of strings. Other types aren't indexed for full text search.
+func textOf(val interface{}) (texts []string) {
+	switch t := val.(type) {
+	case string:
+		texts = append(texts, t)
+	case []string:
+		texts = append(texts, t...)
+	case []interface{}:
+		for _, v := range t {
+			if s, ok := v.(string); ok {
+				texts = append(texts, s)
+			}
+		}
+	}
+	return texts
+}
+
+func (ms *MemSearch) indexText(doc x.Doc) {
+	fields, ok := doc.Data.(map[string]interface{})
+	if !ok {
+		return
+	}
+	for field, val := range fields {
+		var terms []string
+		for _, text := range textOf(val) {
+			terms = append(terms, ms.analyze(text)...)
+		}
+		if len(terms) == 0 {
+			continue
+		}
+
+		key := postingsKey(doc.Kind, field)
+		p, present := ms.text[key]
+		if !present {
+			p = &postings{
+				terms:   make(map[string]map[string]int),
+				lengths: make(map[string]int),
+			}
+			ms.text[key] = p
+		}
+		for _, term := range terms {
+			if _, present := p.terms[term]; !present {
+				p.terms[term] = make(map[string]int)
+			}
+			p.terms[term][doc.Id] += 1
+		}
+		p.lengths[doc.Id] = len(terms)
+		p.total += len(terms)
+	}
+}
+
+// unindexText removes the doc from the postings, by analyzing its fields
+// again, so it only costs as much as indexing it did. The doc must be the
+// one which was indexed.
+func (ms *MemSearch) unindexText(doc x.Doc) {
+	fields, ok := doc.Data.(map[string]interface{})
+	if !ok {
+		return
+	}
+	for field, val := range fields {
+		key := postingsKey(doc.Kind, field)
+		p, present := ms.text[key]
+		if !present {
+			continue
+		}
+		length, present := p.lengths[doc.Id]
+		if !present {
+			continue
+		}
+		for _, text := range textOf(val) {
+			for _, term := range ms.analyze(text) {
+				docs, present := p.terms[term]
+				if !present {
+					continue
+				}
+				delete(docs, doc.Id)
+				if len(docs) == 0 {
+					delete(p.terms, term)
+				}
+			}
+		}
+		delete(p.lengths, doc.Id)
+		p.total -= length
+		if len(p.lengths) == 0 {
+			delete(ms.text, key)
+		}
+	}
+}
+
+// score computes the BM25 relevance of doc for the given match clause.
+// Returns false if none of the terms are present in the doc field.
+func (ms *MemSearch) score(doc x.Doc, mc matchClause) (float64, bool) {
+	p, present := ms.text[postingsKey(doc.Kind, dataField(mc.field))]
+	if !present {
+		return 0, false
+	}
+	length, present := p.lengths[doc.Id]
+	if !present {
+		return 0, false
+	}
+
+	n := float64(len(p.lengths))
+	avg := float64(p.total) / n
+	var score float64
+	found := false
+	for _, term := range mc.terms {
+		docs := p.terms[term]
+		tf := float64(docs[doc.Id])
+		if tf == 0 {
+			continue
+		}
+		found = true
+		df := float64(len(docs))
+		idf := math.Log(1 + (n-df+0.5)/(df+0.5))
+		norm := bm25K1 * (1 - bm25B + bm25B*float64(length)/avg)
+		score += idf * tf * (bm25K1 + 1) / (tf + norm)
+	}
+	return score, found
+}
@@ -90,6 +90,55 @@ func (mdb *MongoDB) GetEntity(subject string) (result []x.Instruction, err error
 	return result, err
 }
 
+// Delete removes the documents matching the instructions.
+func (mdb *MongoDB) Delete(subject string, its []x.Instruction) error {
+	c := mdb.session.DB(mdb.database).C(mdb.collection)
+
+	for _, i := range its {
+		_, err := c.RemoveAll(bson.M{
+			"subjectid": subject,
+			"predicate": i.Predicate,
+			"nanots":    i.NanoTs,
+			"objectid":  i.ObjectId,
+			"source":    i.Source,
+		})
+		if err != nil {
+			x.LogErr(log, err).Error("While removing")
+			return err
+		}
+	}
+	return nil
+}
+
+// PurgeSource removes all documents written by source.
+func (mdb *MongoDB) PurgeSource(source string) ([]x.Entity, int, error) {
+	c := mdb.session.DB(mdb.database).C(mdb.collection)
+
+	var its []x.Instruction
+	err := c.Find(bson.M{"source": source}).
+		Select(bson.M{"subjectid": 1, "subjecttype": 1}).All(&its)
+	if err != nil {
+		x.LogErr(log, err).Error("While running query")
+		return nil, 0, err
+	}
+	var entities []x.Entity
+	handled := make(map[x.Entity]bool)
+	for _, i := range its {
+		e := x.Entity{Kind: i.SubjectType, Id: i.SubjectId}
+		if !handled[e] {
+			entities = append(entities, e)
+			handled[e] = true
+		}
+	}
+
+	info, err := c.RemoveAll(bson.M{"source": source})
+	if err != nil {
+		x.LogErr(log, err).Error("While removing")
+		return nil, 0, err
+	}
+	return entities, info.Removed, nil
+}
+
 func (mdb *MongoDB) Iterate(fromId string, num int, ch chan x.Entity) (found int, last x.Entity, err error) {
 	log.Fatal("Not implemented")
 	return
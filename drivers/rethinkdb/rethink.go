@@ -103,6 +103,61 @@ func (rdb *RethinkDB) GetEntity(subject string) (
 	return result, nil
 }
 
+// Delete removes the documents matching the instructions, looked up via
+// the SubjectId index.
+func (rdb *RethinkDB) Delete(subject string, its []x.Instruction) error {
+	for _, i := range its {
+		_, err := r.Table(rdb.table).GetAllByIndex("SubjectId", subject).
+			Filter(map[string]interface{}{
+				"Predicate": i.Predicate,
+				"NanoTs":    i.NanoTs,
+				"ObjectId":  i.ObjectId,
+				"Source":    i.Source,
+			}).Delete().RunWrite(rdb.session)
+		if err != nil {
+			x.LogErr(log, err).Error("While deleting")
+			return err
+		}
+	}
+	return nil
+}
+
+// PurgeSource filters over the whole table, as there's no index by source.
+func (rdb *RethinkDB) PurgeSource(source string) ([]x.Entity, int, error) {
+	filter := map[string]interface{}{"Source": source}
+	iter, err := r.Table(rdb.table).Filter(filter).
+		Pluck("SubjectId", "SubjectType").Run(rdb.session)
+	if err != nil {
+		x.LogErr(log, err).Error("While running query")
+		return nil, 0, err
+	}
+	var its []x.Instruction
+	if err := iter.All(&its); err != nil {
+		x.LogErr(log, err).Error("While iterating")
+		return nil, 0, err
+	}
+	if err := iter.Close(); err != nil {
+		x.LogErr(log, err).Error("While closing iterator")
+		return nil, 0, err
+	}
+	var entities []x.Entity
+	handled := make(map[x.Entity]bool)
+	for _, i := range its {
+		e := x.Entity{Kind: i.SubjectType, Id: i.SubjectId}
+		if !handled[e] {
+			entities = append(entities, e)
+			handled[e] = true
+		}
+	}
+
+	res, err := r.Table(rdb.table).Filter(filter).Delete().RunWrite(rdb.session)
+	if err != nil {
+		x.LogErr(log, err).Error("While deleting")
+		return nil, 0, err
+	}
+	return entities, res.Deleted, nil
+}
+
 func (rdb *RethinkDB) Iterate(fromId string, num int, ch chan x.Entity) (found int, last x.Entity, err error) {
 	log.Fatal("Not implemented")
 	return
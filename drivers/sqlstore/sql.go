@@ -3,6 +3,7 @@ package sqlstore
 import (
 	"database/sql"
 	"fmt"
+	"strconv"
 
 	"github.com/aslanides/gocrud/store"
 	"github.com/aslanides/gocrud/x"
@@ -15,7 +16,8 @@ type Sql struct {
 }
 
 var sqlInsert *sql.Stmt
-var sqlIsNew, sqlSelect string
+var sqlIsNew, sqlSelect, sqlSince, sqlBounds, sqlRange, sqlDelete string
+var sqlBySource, sqlDeleteSource, sqlSource string
 
 func (s *Sql) Init(args ...string) {
 	if len(args) != 3 {
@@ -48,6 +50,20 @@ func (s *Sql) Init(args ...string) {
 			tablename)
 		sqlSelect = fmt.Sprintf(`select subject_id, subject_type, predicate,
 	object, object_id, nano_ts, source from %s where subject_id = $1`, tablename)
+		sqlSince = fmt.Sprintf(`select id, subject_type, subject_id from %s
+	where nano_ts > $1 and id > $2 order by id limit $3`, tablename)
+		sqlRange = fmt.Sprintf(`select id, subject_type, subject_id from %s
+	where id > $1 and id <= $2 order by id limit $3`, tablename)
+		sqlDelete = fmt.Sprintf(`delete from %s
+	where subject_id = $1 and predicate = $2 and nano_ts = $3
+	and object_id = $4 and source = $5`, tablename)
+		sqlBySource = fmt.Sprintf(`select distinct subject_type, subject_id
+	from %s where source = $1`, tablename)
+		sqlDeleteSource = fmt.Sprintf("delete from %s where source = $1", tablename)
+		sqlSource = fmt.Sprintf(`select id, subject_id, subject_type, predicate,
+	object, object_id, nano_ts, source from %s
+	where source = $1 and nano_ts >= $2 and nano_ts < $3 and id > $4
+	order by id limit $5`, tablename)
 
 	default:
 		insert = fmt.Sprintf(`insert into %s (subject_id, subject_type, predicate,
@@ -56,9 +72,25 @@ func (s *Sql) Init(args ...string) {
 			tablename)
 		sqlSelect = fmt.Sprintf(`select subject_id, subject_type, predicate,
 	object, object_id, nano_ts, source from %s where subject_id = ?`, tablename)
+		sqlSince = fmt.Sprintf(`select id, subject_type, subject_id from %s
+	where nano_ts > ? and id > ? order by id limit ?`, tablename)
+		sqlRange = fmt.Sprintf(`select id, subject_type, subject_id from %s
+	where id > ? and id <= ? order by id limit ?`, tablename)
+		sqlDelete = fmt.Sprintf(`delete from %s
+	where subject_id = ? and predicate = ? and nano_ts = ?
+	and object_id = ? and source = ?`, tablename)
+		sqlBySource = fmt.Sprintf(`select distinct subject_type, subject_id
+	from %s where source = ?`, tablename)
+		sqlDeleteSource = fmt.Sprintf("delete from %s where source = ?", tablename)
+		sqlSource = fmt.Sprintf(`select id, subject_id, subject_type, predicate,
+	object, object_id, nano_ts, source from %s
+	where source = ? and nano_ts >= ? and nano_ts < ? and id > ?
+	order by id limit ?`, tablename)
 
 	}
 
+	sqlBounds = fmt.Sprintf("select min(id), max(id) from %s", tablename)
+
 	sqlInsert, err = s.db.Prepare(insert)
 	if err != nil {
 		panic(err)
@@ -130,11 +162,240 @@ func (s *Sql) GetEntity(subject string) (
 	return result, nil
 }
 
+// IterateSource relies on the index over source and nano_ts, and pages by
+// the row id.
+func (s *Sql) IterateSource(source string, from, to int64, cursor string,
+	num int, ch chan x.Instruction) (rnum int, rnext string, rerr error) {
+
+	var after int64
+	if len(cursor) > 0 {
+		var err error
+		if after, err = strconv.ParseInt(cursor, 10, 64); err != nil {
+			return 0, cursor, err
+		}
+	}
+	rows, err := s.db.Query(sqlSource, source, from, to, after, num)
+	if err != nil {
+		x.LogErr(log, err).Error("While querying by source")
+		return 0, cursor, err
+	}
+	defer rows.Close()
+
+	rnext = cursor
+	for rows.Next() {
+		var id int64
+		var i x.Instruction
+		err := rows.Scan(&id, &i.SubjectId, &i.SubjectType, &i.Predicate,
+			&i.Object, &i.ObjectId, &i.NanoTs, &i.Source)
+		if err != nil {
+			x.LogErr(log, err).Error("While scanning")
+			return rnum, rnext, err
+		}
+		rnext = strconv.FormatInt(id, 10)
+		ch <- i
+		rnum += 1
+	}
+	if err = rows.Err(); err != nil {
+		x.LogErr(log, err).Error("While iterating")
+		return rnum, rnext, err
+	}
+	return rnum, rnext, nil
+}
+
+// Delete removes the matching rows in a single transaction.
+func (s *Sql) Delete(subject string, its []x.Instruction) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		x.LogErr(log, err).Error("While starting transaction")
+		return err
+	}
+	for _, it := range its {
+		if _, err := tx.Exec(sqlDelete, subject, it.Predicate, it.NanoTs,
+			it.ObjectId, it.Source); err != nil {
+			x.LogErr(log, err).Error("While deleting rows in sql")
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// PurgeSource finds the entities, and deletes the rows written by source,
+// in a single transaction.
+func (s *Sql) PurgeSource(source string) (entities []x.Entity, n int, rerr error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		x.LogErr(log, err).Error("While starting transaction")
+		return nil, 0, err
+	}
+	defer func() {
+		if rerr != nil {
+			tx.Rollback()
+		}
+	}()
+
+	rows, err := tx.Query(sqlBySource, source)
+	if err != nil {
+		x.LogErr(log, err).Error("While querying by source")
+		return nil, 0, err
+	}
+	for rows.Next() {
+		var e x.Entity
+		if err := rows.Scan(&e.Kind, &e.Id); err != nil {
+			rows.Close()
+			x.LogErr(log, err).Error("While scanning")
+			return nil, 0, err
+		}
+		entities = append(entities, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		x.LogErr(log, err).Error("While iterating")
+		return nil, 0, err
+	}
+
+	res, err := tx.Exec(sqlDeleteSource, source)
+	if err != nil {
+		x.LogErr(log, err).Error("While deleting rows in sql")
+		return nil, 0, err
+	}
+	num, err := res.RowsAffected()
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, 0, err
+	}
+	return entities, int(num), nil
+}
+
 func (s *Sql) Iterate(fromId string, num int, ch chan x.Entity) (found int, last x.Entity, err error) {
 	log.Fatal("Not implemented")
 	return
 }
 
+// IterateSince relies on the index over nano_ts, and pages by the row id.
+func (s *Sql) IterateSince(nanoTs int64, cursor string, num int,
+	ch chan x.Entity) (rnum int, rnext string, rerr error) {
+
+	var from int64
+	if len(cursor) > 0 {
+		var err error
+		if from, err = strconv.ParseInt(cursor, 10, 64); err != nil {
+			return 0, cursor, err
+		}
+	}
+	rows, err := s.db.Query(sqlSince, nanoTs, from, num)
+	if err != nil {
+		x.LogErr(log, err).Error("While querying since")
+		return 0, cursor, err
+	}
+	defer rows.Close()
+
+	rnext = cursor
+	handled := make(map[x.Entity]bool)
+	for rows.Next() {
+		var id int64
+		var e x.Entity
+		if err := rows.Scan(&id, &e.Kind, &e.Id); err != nil {
+			x.LogErr(log, err).Error("While scanning")
+			return rnum, rnext, err
+		}
+		rnext = strconv.FormatInt(id, 10)
+		if _, present := handled[e]; present {
+			continue
+		}
+		ch <- e
+		handled[e] = true
+		rnum += 1
+	}
+	if err = rows.Err(); err != nil {
+		x.LogErr(log, err).Error("While iterating")
+		return rnum, rnext, err
+	}
+	return rnum, rnext, nil
+}
+
+// Partitions splits the row ids into n equal ranges. Start is exclusive,
+// and End inclusive.
+func (s *Sql) Partitions(n int) ([]store.Partition, error) {
+	if n <= 0 {
+		return nil, fmt.Errorf("Invalid number of partitions: %v", n)
+	}
+	var lo, hi sql.NullInt64
+	if err := s.db.QueryRow(sqlBounds).Scan(&lo, &hi); err != nil {
+		x.LogErr(log, err).Error("While querying id bounds")
+		return nil, err
+	}
+	if !lo.Valid {
+		return nil, nil // Empty table.
+	}
+	start := lo.Int64 - 1
+	step := (hi.Int64 - start + int64(n) - 1) / int64(n)
+	var parts []store.Partition
+	for start < hi.Int64 {
+		end := start + step
+		if end > hi.Int64 {
+			end = hi.Int64
+		}
+		parts = append(parts, store.Partition{
+			Start: strconv.FormatInt(start, 10),
+			End:   strconv.FormatInt(end, 10),
+		})
+		start = end
+	}
+	return parts, nil
+}
+
+// IteratePartition pages over the row ids in p, using the last id as the
+// cursor. Rows inserted after Partitions was called, are left out of the
+// last partition.
+func (s *Sql) IteratePartition(p store.Partition, cursor string, num int,
+	ch chan x.Entity) (rnum int, rnext string, rerr error) {
+
+	from := p.Start
+	if len(cursor) > 0 {
+		from = cursor
+	}
+	start, err := strconv.ParseInt(from, 10, 64)
+	if err != nil {
+		return 0, cursor, err
+	}
+	end, err := strconv.ParseInt(p.End, 10, 64)
+	if err != nil {
+		return 0, cursor, err
+	}
+	rows, err := s.db.Query(sqlRange, start, end, num)
+	if err != nil {
+		x.LogErr(log, err).Error("While querying range")
+		return 0, cursor, err
+	}
+	defer rows.Close()
+
+	rnext = cursor
+	handled := make(map[x.Entity]bool)
+	for rows.Next() {
+		var id int64
+		var e x.Entity
+		if err := rows.Scan(&id, &e.Kind, &e.Id); err != nil {
+			x.LogErr(log, err).Error("While scanning")
+			return rnum, rnext, err
+		}
+		rnext = strconv.FormatInt(id, 10)
+		if _, present := handled[e]; present {
+			continue
+		}
+		ch <- e
+		handled[e] = true
+		rnum += 1
+	}
+	if err = rows.Err(); err != nil {
+		x.LogErr(log, err).Error("While iterating")
+		return rnum, rnext, err
+	}
+	return rnum, rnext, nil
+}
+
 func init() {
 	log.Info("Initing sqlstore")
 	store.Register("sqlstore", new(Sql))
@@ -7,3 +7,6 @@ create table instructions (
 	nano_ts bigint,
 	source text,
 	id serial primary key);
+
+create index instructions_nano_ts on instructions (nano_ts);
+create index instructions_source on instructions (source, nano_ts);
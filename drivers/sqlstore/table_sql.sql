@@ -10,3 +10,6 @@ create table instructions (
 	id integer auto_increment,
 	primary key (id)
 );
+
+create index instructions_nano_ts on instructions (nano_ts);
+create index instructions_source on instructions (source(255), nano_ts);
@@ -74,7 +74,19 @@ func (si SimpleIndexer) OnUpdate(e x.Entity) (result []x.Entity) {
 	return
 }
 
+// Regenerate wraps RegenerateE for callers of the plain Indexer interface,
+// marking the doc Deleted on ErrDeleted, and logging any other error.
 func (si SimpleIndexer) Regenerate(e x.Entity) (rdoc x.Doc) {
+	rdoc, err := si.RegenerateE(e)
+	if err == indexer.ErrDeleted {
+		rdoc.Deleted = true
+	} else if err != nil {
+		x.LogErr(log, err).Error("While regenerating doc")
+	}
+	return rdoc
+}
+
+func (si SimpleIndexer) RegenerateE(e x.Entity) (rdoc x.Doc, rerr error) {
 	rdoc.Id = e.Id
 	rdoc.Kind = e.Kind
 	rdoc.NanoTs = time.Now().UnixNano()
@@ -83,8 +95,11 @@ func (si SimpleIndexer) Regenerate(e x.Entity) (rdoc x.Doc) {
 		// If Post, figure out the total activity on it, so we can sort by that.
 		result, err := store.NewQuery(e.Id).UptoDepth(1).Run()
 		if err != nil {
-			x.LogErr(log, err).Fatal("While querying db")
-			return rdoc
+			return rdoc, err
+		}
+		if len(result.Id) == 0 {
+			// Marked deleted, remove from search.
+			return rdoc, indexer.ErrDeleted
 		}
 		data := result.ToMap()
 		data["activity"] = len(result.Children)
@@ -93,13 +108,15 @@ func (si SimpleIndexer) Regenerate(e x.Entity) (rdoc x.Doc) {
 	} else {
 		result, err := store.NewQuery(e.Id).UptoDepth(0).Run()
 		if err != nil {
-			x.LogErr(log, err).Fatal("While querying db")
-			return rdoc
+			return rdoc, err
+		}
+		if len(result.Id) == 0 {
+			return rdoc, indexer.ErrDeleted
 		}
 		rdoc.Data = result.ToMap()
 	}
 
-	return
+	return rdoc, nil
 }
 
 func newUser() string {
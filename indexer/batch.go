@@ -0,0 +1,151 @@
+package indexer
+
+import (
+	"time"
+
+	"github.com/aslanides/gocrud/search"
+	"github.com/aslanides/gocrud/x"
+)
+
+// SetBatch sets the batch settings of the Default pipeline.
+func SetBatch(size int, wait time.Duration) {
+	Default.SetBatch(size, wait)
+}
+
+// SetBatch sets the max number of docs sent to the search engine in one
+// batch, and the max duration a doc waits for the batch to fill up.
+// Batching is only done if the search engine implements search.BulkEngine.
+// Must be called before Start or NewServer.
+func (p *Pipeline) SetBatch(size int, wait time.Duration) {
+	if size <= 0 || wait <= 0 {
+		log.WithField("size", size).WithField("wait", wait).
+			Fatal("Invalid batch settings")
+		return
+	}
+	p.conf.Lock()
+	defer p.conf.Unlock()
+	p.batchSize = size
+	p.batchWait = wait
+}
+
+// batcher collects regenerated docs, and sends them to the search engine
+// in batches, once enough docs are pending, or the oldest pending doc has
+// waited long enough.
+type batcher struct {
+	engine search.Engine
+	bulk   search.BulkEngine // Nil, if engine doesn't support bulk updates.
+	ch     chan pendingDoc
+	kick   chan struct{}
+	size   int
+	wait   time.Duration
+	retry  retryConf
+	done   chan struct{}
+}
+
+// newBatcher starts a batcher, if the search engine supports bulk updates.
+// Otherwise, docs are indexed one by one.
+func newBatcher(engine search.Engine, size int, wait time.Duration,
+	rc retryConf) *batcher {
+	b := &batcher{engine: engine, retry: rc}
+	bulk, ok := engine.(search.BulkEngine)
+	if !ok {
+		return b
+	}
+	b.bulk = bulk
+	b.ch = make(chan pendingDoc, size)
+	b.kick = make(chan struct{}, 1)
+	b.size = size
+	b.wait = wait
+	b.done = make(chan struct{})
+	go b.run()
+	return b
+}
+
+// pendingDoc is a doc waiting to be indexed, along with the groups waiting
+// on it.
+type pendingDoc struct {
+	doc    x.Doc
+	groups []*group
+}
+
+// index queues the doc, or indexes it right away if engine doesn't support
+// bulk updates. The groups are marked done once the doc is indexed.
+func (b *batcher) index(doc x.Doc, groups []*group) {
+	if b.bulk == nil {
+		indexDocs([]x.Doc{doc}, oneByOne(b.engine), b.retry)
+		doneAll(groups)
+		return
+	}
+	b.ch <- pendingDoc{doc: doc, groups: groups}
+}
+
+func (b *batcher) run() {
+	defer close(b.done)
+
+	var pending []pendingDoc
+	timer := time.NewTimer(b.wait)
+	timer.Stop()
+	for {
+		select {
+		case doc, ok := <-b.ch:
+			if !ok {
+				b.flush(pending)
+				return
+			}
+			pending = append(pending, doc)
+			if len(pending) == 1 {
+				timer.Reset(b.wait)
+			}
+			if len(pending) >= b.size {
+				timer.Stop()
+				b.flush(pending)
+				pending = nil
+			}
+
+		case <-timer.C:
+			b.flush(pending)
+			pending = nil
+
+		case <-b.kick:
+			timer.Stop()
+			b.flush(pending)
+			pending = nil
+		}
+	}
+}
+
+func (b *batcher) flush(pending []pendingDoc) {
+	if len(pending) == 0 {
+		return
+	}
+	docs := make([]x.Doc, len(pending))
+	for i, pd := range pending {
+		docs[i] = pd.doc
+	}
+	indexDocs(docs, b.bulk.UpdateMany, b.retry)
+	for _, pd := range pending {
+		doneAll(pd.groups)
+	}
+	log.WithField("num_docs", len(docs)).Debug("Flushed batch")
+}
+
+// flushPending asks the batcher to flush pending docs, without waiting for
+// the batch to fill up.
+func (b *batcher) flushPending() {
+	if b.bulk == nil {
+		return
+	}
+	select {
+	case b.kick <- struct{}{}:
+	default: // Already asked.
+	}
+}
+
+// close flushes pending docs, and waits for the batcher to finish.
+func (b *batcher) close() {
+	if b.bulk == nil {
+		return
+	}
+	close(b.ch)
+	<-b.done
+}
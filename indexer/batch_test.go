@@ -0,0 +1,46 @@
+package indexer
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	_ "github.com/aslanides/gocrud/drivers/memsearch"
+	"github.com/aslanides/gocrud/search"
+	"github.com/aslanides/gocrud/x"
+)
+
+func count(t *testing.T, kind string) int64 {
+	n, err := search.Get().NewQuery(kind).Count()
+	if err != nil {
+		t.Fatalf("While counting: %v", err)
+	}
+	return n
+}
+
+func TestBatcher(t *testing.T) {
+	search.Get().Init()
+	b := newBatcher(search.Get(), 3, 50*time.Millisecond, defaultRetry)
+	if b.bulk == nil {
+		t.Fatal("Expected batcher for memsearch")
+	}
+
+	for i := 0; i < 4; i++ {
+		b.index(x.Doc{Kind: "Batch", Id: fmt.Sprintf("b%d", i), NanoTs: 10}, nil)
+	}
+	// Conflicts with b0, and shouldn't fail the rest of the batch.
+	b.index(x.Doc{Kind: "Batch", Id: "b0", NanoTs: 5}, nil)
+	b.index(x.Doc{Kind: "Batch", Id: "b1", NanoTs: 20, Deleted: true}, nil)
+
+	// First batch is flushed once full, and the rest after waiting.
+	time.Sleep(200 * time.Millisecond)
+	if n := count(t, "Batch"); n != 3 {
+		t.Errorf("Expected 3 docs. Found: %v", n)
+	}
+
+	b.index(x.Doc{Kind: "Batch", Id: "b4", NanoTs: 10}, nil)
+	b.close()
+	if n := count(t, "Batch"); n != 4 {
+		t.Errorf("Expected 4 docs after close. Found: %v", n)
+	}
+}
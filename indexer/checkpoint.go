@@ -0,0 +1,118 @@
+package indexer
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/aslanides/gocrud/req"
+	"github.com/aslanides/gocrud/store"
+)
+
+// Checkpoint is the progress of Server through its cycles over all the
+// entities in the store, so a restarted server can resume where it left.
+type Checkpoint struct {
+	Cycles    uint64 `json:"cycles"`    // Number of cycles completed.
+	LastId    string `json:"last_id"`   // Last entity id iterated over. Empty at cycle start.
+	Processed uint64 `json:"processed"` // Entities processed in current cycle.
+	Started   int64  `json:"started"`   // Unix nano ts, when current cycle started.
+	Resumes   uint64 `json:"resumes"`   // Times current cycle was resumed.
+
+	// Stats for the last completed cycle.
+	PrevTotal    uint64 `json:"prev_total"`
+	PrevStarted  int64  `json:"prev_started"`
+	PrevFinished int64  `json:"prev_finished"`
+}
+
+// Checkpointer persists the checkpoint for Server.
+type Checkpointer interface {
+	// Load returns the zero Checkpoint, if none has been saved yet.
+	Load() (Checkpoint, error)
+	Save(cp Checkpoint) error
+}
+
+// FileCheckpointer stores the checkpoint as JSON, in the file at path.
+type FileCheckpointer struct {
+	sync.Mutex
+	path string
+}
+
+// NewFileCheckpointer returns a checkpointer writing to the file at path,
+// which gets created if missing.
+func NewFileCheckpointer(path string) *FileCheckpointer {
+	return &FileCheckpointer{path: path}
+}
+
+func (f *FileCheckpointer) Load() (cp Checkpoint, rerr error) {
+	f.Lock()
+	defer f.Unlock()
+	b, err := ioutil.ReadFile(f.path)
+	if os.IsNotExist(err) {
+		return cp, nil
+	}
+	if err != nil {
+		return cp, err
+	}
+	err = json.Unmarshal(b, &cp)
+	return cp, err
+}
+
+// Save writes the checkpoint to a temporary file first, and renames it over
+// the existing one, so a crash midway doesn't leave a corrupt checkpoint.
+func (f *FileCheckpointer) Save(cp Checkpoint) error {
+	b, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	f.Lock()
+	defer f.Unlock()
+	tmp := f.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path)
+}
+
+// StoreCheckpointer stores the checkpoint as the entity of given kind and
+// id in the store. Note that each save, done once per chunk of entities,
+// adds a new version to the entity.
+type StoreCheckpointer struct {
+	ctx  *req.Context
+	kind string
+	id   string
+}
+
+// NewStoreCheckpointer returns a checkpointer storing the checkpoint as the
+// entity kind, id. Don't register an indexer for the kind, to avoid loops.
+func NewStoreCheckpointer(c *req.Context, kind, id string) *StoreCheckpointer {
+	return &StoreCheckpointer{ctx: c, kind: kind, id: id}
+}
+
+func (s *StoreCheckpointer) Load() (cp Checkpoint, rerr error) {
+	result, err := store.NewQuery(s.id).UptoDepth(0).Run()
+	if err != nil {
+		return cp, err
+	}
+	versions, present := result.Columns["checkpoint"]
+	if !present {
+		return cp, nil
+	}
+	// Stored as a JSON string, to keep nano ts from losing precision as
+	// float64 values.
+	b, ok := versions.Latest().Value.(string)
+	if !ok {
+		return cp, nil
+	}
+	err = json.Unmarshal([]byte(b), &cp)
+	return cp, err
+}
+
+func (s *StoreCheckpointer) Save(cp Checkpoint) error {
+	b, err := json.Marshal(cp)
+	if err != nil {
+		return err
+	}
+	return store.NewUpdate(s.kind, s.id).SetSource("indexer").
+		Set("checkpoint", string(b)).Execute(s.ctx)
+}
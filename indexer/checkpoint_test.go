@@ -0,0 +1,130 @@
+package indexer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aslanides/gocrud/drivers/memsearch"
+	"github.com/aslanides/gocrud/req"
+	"github.com/aslanides/gocrud/store"
+)
+
+func TestCheckpointResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store.Get().Init(filepath.Join(dir, "ldb"))
+
+	c := req.NewContext(10)
+	for i := 0; i < 10; i++ {
+		if err := store.NewUpdate("K", fmt.Sprintf("k%d", i)).SetSource("t").
+			Set("v", i).Execute(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Server died after processing k0 to k4.
+	cp := NewFileCheckpointer(filepath.Join(dir, "checkpoint.json"))
+	if err := cp.Save(Checkpoint{LastId: "k4", Processed: 5, Started: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	engine := new(memsearch.MemSearch)
+	engine.Init()
+	p := NewPipeline(engine)
+	p.Register("K", echoIndexer{})
+	s := p.NewServer(100, 2)
+	s.SetCheckpointer(cp)
+	s.LoopOnce()
+	s.Finish()
+
+	// k4 is iterated over again, as iteration starts from the last id.
+	if n := len(engine.All()); n != 6 {
+		t.Errorf("Expected docs for k4 to k9. Found: %v", n)
+	}
+	got, err := cp.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Cycles != 1 || got.LastId != "" || got.PrevTotal != 11 || got.PrevStarted != 1 {
+		t.Errorf("Unexpected checkpoint after cycle: %+v", got)
+	}
+
+	sc := NewStoreCheckpointer(c, "Checkpoint", "indexer_server")
+	want := Checkpoint{Cycles: 2, LastId: "k3", Started: time.Now().UnixNano()}
+	if err := sc.Save(want); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := sc.Load(); err != nil || got != want {
+		t.Errorf("Expected %+v. Got: %+v, %v", want, got, err)
+	}
+}
+
+// indexedCheckpointer fails the test if a checkpoint is saved before the
+// doc for its last entity is indexed.
+type indexedCheckpointer struct {
+	t      *testing.T
+	engine *memsearch.MemSearch
+	saved  []Checkpoint
+}
+
+func (ic *indexedCheckpointer) Load() (Checkpoint, error) {
+	return Checkpoint{}, nil
+}
+
+func (ic *indexedCheckpointer) Save(cp Checkpoint) error {
+	ic.saved = append(ic.saved, cp)
+	if len(cp.LastId) == 0 {
+		return nil
+	}
+	for _, doc := range ic.engine.All() {
+		if doc.Id == cp.LastId {
+			return nil
+		}
+	}
+	ic.t.Errorf("Checkpoint saved before %v was indexed", cp.LastId)
+	return nil
+}
+
+func TestCheckpointAfterIndex(t *testing.T) {
+	dir, err := ioutil.TempDir("", "checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store.Get().Init(filepath.Join(dir, "ldb"))
+
+	c := req.NewContext(10)
+	for i := 0; i < 2500; i++ {
+		if err := store.NewUpdate("K", fmt.Sprintf("k%04d", i)).SetSource("t").
+			Set("v", i).Execute(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	engine := new(memsearch.MemSearch)
+	engine.Init()
+	p := NewPipeline(engine)
+	p.SetBatch(300, 50*time.Millisecond)
+	p.Register("K", echoIndexer{})
+	s := p.NewServer(100, 2)
+	cp := &indexedCheckpointer{t: t, engine: engine}
+	s.SetCheckpointer(cp)
+	s.LoopOnce()
+	s.Finish()
+
+	if n := len(engine.All()); n != 2500 {
+		t.Errorf("Expected 2500 docs. Found: %v", n)
+	}
+	// Chunks end at k0999 and k1998, as each one starts from the last id.
+	if len(cp.saved) != 3 || cp.saved[0].LastId != "k0999" ||
+		cp.saved[1].LastId != "k1998" || cp.saved[2].Cycles != 1 {
+		t.Errorf("Unexpected checkpoints: %+v", cp.saved)
+	}
+}
@@ -0,0 +1,121 @@
+package indexer
+
+import (
+	"sync"
+	"time"
+
+	"github.com/aslanides/gocrud/x"
+)
+
+// SetDebounce sets the debounce window of the Default pipeline.
+func SetDebounce(window time.Duration) {
+	Default.SetDebounce(window)
+}
+
+// SetDebounce sets the window for which dirty entities wait before being
+// regenerated. Any updates to the same entity within the window are
+// coalesced, so for e.g. a Post getting a burst of Likes is regenerated
+// once per window, instead of once per Like. Defaults to zero, in which
+// case entities are only coalesced while waiting for a free goroutine.
+// Must be called before Start.
+func (p *Pipeline) SetDebounce(window time.Duration) {
+	if window < 0 {
+		log.WithField("window", window).Fatal("Invalid debounce window")
+		return
+	}
+	p.conf.Lock()
+	defer p.conf.Unlock()
+	p.debounce = window
+}
+
+// coalescer de-duplicates dirty entities, from the time they're added,
+// until they're picked up for regeneration.
+type coalescer struct {
+	sync.Mutex
+	window  time.Duration
+	pending map[x.Entity][]*group    // Groups waiting on the entity.
+	timers  map[x.Entity]*time.Timer // Entities waiting for window to pass.
+	out     chan x.Entity
+	wg      sync.WaitGroup // Running timers.
+}
+
+func newCoalescer(buffer int, window time.Duration) *coalescer {
+	return &coalescer{
+		window:  window,
+		pending: make(map[x.Entity][]*group),
+		timers:  make(map[x.Entity]*time.Timer),
+		out:     make(chan x.Entity, buffer),
+	}
+}
+
+// add marks the entity dirty, unless it's already pending. The group, if
+// not nil, waits until the doc for the entity is indexed.
+func (c *coalescer) add(e x.Entity, g *group) {
+	c.Lock()
+	groups, present := c.pending[e]
+	if g != nil {
+		groups = append(groups, g)
+	}
+	c.pending[e] = groups
+	if present {
+		c.Unlock()
+		log.WithField("entity", e).Debug("Coalesced dirty entity")
+		return
+	}
+	if c.window <= 0 {
+		c.Unlock()
+		c.out <- e
+		return
+	}
+	c.wg.Add(1)
+	c.timers[e] = time.AfterFunc(c.window, func() { c.fire(e) })
+	c.Unlock()
+}
+
+func (c *coalescer) fire(e x.Entity) {
+	defer c.wg.Done()
+	c.Lock()
+	_, present := c.timers[e]
+	delete(c.timers, e)
+	c.Unlock()
+	if present { // Otherwise, already sent by flush.
+		c.out <- e
+	}
+}
+
+// take must be called when the entity is picked up from out, so later
+// updates mark it dirty again. Returns the groups waiting on the entity.
+func (c *coalescer) take(e x.Entity) []*group {
+	c.Lock()
+	defer c.Unlock()
+	groups := c.pending[e]
+	delete(c.pending, e)
+	return groups
+}
+
+// flushTimers sends out the entities still waiting for their window to
+// pass, without waiting any further.
+func (c *coalescer) flushTimers() {
+	c.Lock()
+	var waiting []x.Entity
+	for e, t := range c.timers {
+		if t.Stop() {
+			c.wg.Done()
+		}
+		delete(c.timers, e)
+		waiting = append(waiting, e)
+	}
+	c.Unlock()
+
+	for _, e := range waiting {
+		c.out <- e
+	}
+}
+
+// close flushes the timers, and closes out once no more timers are
+// running. No more entities should be added after this.
+func (c *coalescer) close() {
+	c.flushTimers()
+	c.wg.Wait()
+	close(c.out)
+}
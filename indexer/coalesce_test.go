@@ -0,0 +1,43 @@
+package indexer
+
+import (
+	"testing"
+	"time"
+
+	"github.com/aslanides/gocrud/x"
+)
+
+func TestCoalesce(t *testing.T) {
+	c := newCoalescer(10, 50*time.Millisecond)
+
+	post := x.Entity{Kind: "Post", Id: "p1"}
+	for i := 0; i < 100; i++ {
+		c.add(post, nil)
+	}
+	c.add(x.Entity{Kind: "Post", Id: "p2"}, nil)
+	if len(c.out) != 0 {
+		t.Errorf("Expected entities to wait for window. Found: %v", len(c.out))
+	}
+
+	time.Sleep(150 * time.Millisecond)
+	if len(c.out) != 2 {
+		t.Fatalf("Expected 2 entities after window. Found: %v", len(c.out))
+	}
+	// Still pending until taken.
+	c.add(post, nil)
+	for i := 0; i < 2; i++ {
+		c.take(<-c.out)
+	}
+
+	// Updates after being taken mark it dirty again, and close sends
+	// it out without waiting for the window.
+	c.add(post, nil)
+	c.close()
+	var found []x.Entity
+	for e := range c.out {
+		found = append(found, e)
+	}
+	if len(found) != 1 || found[0] != post {
+		t.Errorf("Expected only %v after close. Found: %v", post, found)
+	}
+}
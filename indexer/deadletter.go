@@ -0,0 +1,225 @@
+package indexer
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aslanides/gocrud/req"
+	"github.com/aslanides/gocrud/store"
+	"github.com/aslanides/gocrud/x"
+)
+
+// DeadLetter receives the docs which couldn't be indexed, even after all
+// the retries, so they can be inspected, and replayed later.
+type DeadLetter interface {
+	Add(doc x.Doc, err error) error
+}
+
+// DeadEntry is a doc which couldn't be indexed, along with the error.
+type DeadEntry struct {
+	Kind    string `json:"kind"`
+	Id      string `json:"id"`
+	NanoTs  int64  `json:"nano_ts"`
+	Deleted bool   `json:"deleted,omitempty"`
+	Error   string `json:"error"`
+	At      int64  `json:"at"` // Unix nano ts, when the doc was given up on.
+}
+
+// FileDeadLetter appends dead entries to a file, one JSON object per line.
+type FileDeadLetter struct {
+	sync.Mutex
+	path string
+}
+
+// NewFileDeadLetter returns a sink writing to the file at path, which gets
+// created if missing.
+func NewFileDeadLetter(path string) *FileDeadLetter {
+	return &FileDeadLetter{path: path}
+}
+
+func (f *FileDeadLetter) Add(doc x.Doc, err error) error {
+	e := DeadEntry{
+		Kind:    doc.Kind,
+		Id:      doc.Id,
+		NanoTs:  doc.NanoTs,
+		Deleted: doc.Deleted,
+		Error:   err.Error(),
+		At:      time.Now().UnixNano(),
+	}
+	b, merr := json.Marshal(e)
+	if merr != nil {
+		return merr
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	file, oerr := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if oerr != nil {
+		return oerr
+	}
+	if _, werr := file.Write(append(b, '\n')); werr != nil {
+		file.Close()
+		return werr
+	}
+	return file.Close()
+}
+
+// Entries reads back all the dead entries from the file.
+func (f *FileDeadLetter) Entries() (entries []DeadEntry, rerr error) {
+	f.Lock()
+	defer f.Unlock()
+	file, err := os.Open(f.path)
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return entries, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var e DeadEntry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			return entries, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// Truncate removes all the entries, for e.g. after a successful Replay.
+func (f *FileDeadLetter) Truncate() error {
+	f.Lock()
+	defer f.Unlock()
+	err := os.Remove(f.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// deadSource is the source of the instructions written by StoreDeadLetter.
+const deadSource = "indexer"
+
+// StoreDeadLetter stores dead entries as entities of the given kind in the
+// store, which can then be looked up via store.NewQuery, or read back via
+// Entries.
+type StoreDeadLetter struct {
+	ctx  *req.Context
+	kind string
+}
+
+// NewStoreDeadLetter returns a sink storing entries as entities of kind.
+// Don't register an indexer for the kind, to avoid loops. Only the length
+// of unique ids is used from c.
+func NewStoreDeadLetter(c *req.Context, kind string) *StoreDeadLetter {
+	return &StoreDeadLetter{ctx: c, kind: kind}
+}
+
+// Add commits the entry to the store directly. Sending it via the updates
+// channel of req.Context could block forever, as the workers draining the
+// channel are the ones waiting on the sink.
+func (s *StoreDeadLetter) Add(doc x.Doc, err error) error {
+	id := x.UniqueString(s.ctx.NumCharsUnique)
+	now := time.Now().UnixNano()
+	vals := map[string]interface{}{
+		"doc_kind": doc.Kind,
+		"doc_id":   doc.Id,
+		"nano_ts":  doc.NanoTs,
+		"deleted":  doc.Deleted,
+		"error":    err.Error(),
+	}
+	var its []*x.Instruction
+	for pred, val := range vals {
+		b, merr := json.Marshal(val)
+		if merr != nil {
+			return merr
+		}
+		its = append(its, &x.Instruction{
+			SubjectId:   id,
+			SubjectType: s.kind,
+			Predicate:   pred,
+			Object:      b,
+			Source:      deadSource,
+			NanoTs:      now,
+		})
+	}
+	return store.Get().Commit(its)
+}
+
+// Entries reads back all the dead entries from the store, in the order
+// added. The store must implement store.SourceIterator.
+func (s *StoreDeadLetter) Entries() (entries []DeadEntry, rerr error) {
+	acts, err := store.Activity(deadSource, 0, math.MaxInt64)
+	if err != nil {
+		return entries, err
+	}
+	for _, ea := range acts {
+		if ea.Kind != s.kind {
+			continue
+		}
+		its, err := store.Instructions(ea.Id)
+		if err != nil {
+			return entries, err
+		}
+
+		var e DeadEntry
+		for _, it := range its {
+			var v interface{}
+			switch it.Predicate {
+			case "doc_kind":
+				v = &e.Kind
+			case "doc_id":
+				v = &e.Id
+			case "nano_ts":
+				v = &e.NanoTs
+			case "deleted":
+				v = &e.Deleted
+			case "error":
+				v = &e.Error
+			default:
+				continue
+			}
+			if err := json.Unmarshal(it.Object, v); err != nil {
+				x.LogErr(log, err).WithField("id", ea.Id).Error("While unmarshal")
+				return entries, err
+			}
+			e.At = it.NanoTs
+		}
+		entries = append(entries, e)
+	}
+	return entries, nil
+}
+
+// Replay regenerates the docs for dead entries from the current state of
+// their entities, and indexes them. Entries which fail again are added back
+// to the dead letter sink, so read and truncate it before replaying.
+// Uses the indexers and search engine of the default pipeline.
+func Replay(entries []DeadEntry) {
+	Default.Replay(entries)
+}
+
+// Replay works like the package level Replay, using the indexers and
+// search engine of p.
+func (p *Pipeline) Replay(entries []DeadEntry) {
+	rc := p.retrySettings()
+	update := oneByOne(p.searchEngine())
+	for _, e := range entries {
+		idxr, ok := p.Get(e.Kind)
+		if !ok {
+			failed(x.Doc{Kind: e.Kind, Id: e.Id}, errors.New("No indexer found"), rc.deadLetter)
+			continue
+		}
+		doc, ok := regenerateDoc(idxr, x.Entity{Kind: e.Kind, Id: e.Id}, rc)
+		if !ok {
+			continue
+		}
+		indexDocs([]x.Doc{doc}, update, rc)
+	}
+}
@@ -0,0 +1,241 @@
+package indexer
+
+import (
+	"time"
+
+	"github.com/aslanides/gocrud/store"
+	"github.com/aslanides/gocrud/x"
+)
+
+// Declarative is an Indexer for the common case, where the doc for an entity
+// is generated from its store query, with some predicates dropped, a few
+// counts of children, and fields copied over from the parent. It's set up
+// via chained calls, for e.g.
+//
+//	indexer.Register("Post", indexer.NewDeclarative().Depth(1).
+//		Exclude("password").Count("Like", "likes").Ancestors("User"))
+type Declarative struct {
+	depth     int
+	include   map[string]bool
+	exclude   map[string]bool
+	counts    map[string]string // Child kind -> doc field.
+	parents   map[string]string // Parent predicate -> doc field.
+	ancestors map[string]bool
+	children  map[string]bool
+}
+
+// NewDeclarative returns an indexer which generates docs from the entity
+// alone, and only marks the entity itself dirty on updates.
+func NewDeclarative() *Declarative {
+	return &Declarative{
+		include:   make(map[string]bool),
+		exclude:   make(map[string]bool),
+		counts:    make(map[string]string),
+		parents:   make(map[string]string),
+		ancestors: make(map[string]bool),
+		children:  make(map[string]bool),
+	}
+}
+
+// Depth sets the levels of descendants to be included in the doc.
+func (d *Declarative) Depth(level int) *Declarative {
+	if level < 0 {
+		log.WithField("depth", level).Fatal("Invalid depth")
+		return d
+	}
+	d.depth = level
+	return d
+}
+
+// Include restricts the predicates in the doc to the ones given. Applies to
+// the entity, and its descendants.
+func (d *Declarative) Include(preds ...string) *Declarative {
+	for _, pred := range preds {
+		d.include[pred] = true
+	}
+	return d
+}
+
+// Exclude drops the given predicates from the doc. Applies to the entity,
+// and its descendants.
+func (d *Declarative) Exclude(preds ...string) *Declarative {
+	for _, pred := range preds {
+		d.exclude[pred] = true
+	}
+	return d
+}
+
+// Count stores the number of direct children of kind under field, for e.g.
+// so search results can be sorted by number of likes. Children are counted
+// irrespective of Depth.
+func (d *Declarative) Count(kind, field string) *Declarative {
+	d.counts[kind] = field
+	return d
+}
+
+// ParentField copies the latest value of pred from the parent entity to
+// field in the doc. The doc is only updated along with the parent, if the
+// indexer of the parent kind marks its children dirty, via Children.
+func (d *Declarative) ParentField(pred, field string) *Declarative {
+	d.parents[pred] = field
+	return d
+}
+
+// Ancestors marks the ancestors of the given kinds dirty, whenever the
+// entity is updated. For e.g. a Like marking the Post it's on dirty, so
+// the count of likes on the Post gets updated.
+func (d *Declarative) Ancestors(kinds ...string) *Declarative {
+	for _, kind := range kinds {
+		d.ancestors[kind] = true
+	}
+	return d
+}
+
+// Children marks the direct children of the given kinds dirty, whenever
+// the entity is updated. For e.g. a User marking its Posts dirty, so the
+// author name copied over via ParentField gets updated.
+func (d *Declarative) Children(kinds ...string) *Declarative {
+	for _, kind := range kinds {
+		d.children[kind] = true
+	}
+	return d
+}
+
+// OnUpdate marks the entity dirty, along with any of its ancestors of the
+// kinds set via Ancestors, and its children of the kinds set via Children.
+func (d *Declarative) OnUpdate(e x.Entity) (result []x.Entity) {
+	result = append(result, e)
+	result = append(result, d.dirtyChildren(e)...)
+	if len(d.ancestors) == 0 {
+		return
+	}
+
+	id := e.Id
+	for {
+		parentid, err := store.Parent(id)
+		if err == store.ErrNoParent {
+			return
+		}
+		if err != nil {
+			x.LogErr(log, err).WithField("id", id).Error("While retrieving parent")
+			return
+		}
+		r, err := store.NewQuery(parentid).UptoDepth(0).AllowDeleted().Run()
+		if err != nil {
+			x.LogErr(log, err).WithField("id", parentid).Error("While retrieving parent")
+			return
+		}
+		if len(r.Kind) == 0 {
+			return
+		}
+		if d.ancestors[r.Kind] {
+			result = append(result, x.Entity{Kind: r.Kind, Id: parentid})
+		}
+		id = parentid
+	}
+}
+
+// dirtyChildren returns the direct children of e, of the kinds set via
+// Children.
+func (d *Declarative) dirtyChildren(e x.Entity) (result []x.Entity) {
+	if len(d.children) == 0 {
+		return nil
+	}
+	r, err := store.NewQuery(e.Id).UptoDepth(1).Run()
+	if err != nil {
+		x.LogErr(log, err).WithField("id", e.Id).Error("While retrieving children")
+		return nil
+	}
+	for _, child := range r.Children {
+		if d.children[child.Kind] {
+			result = append(result, x.Entity{Kind: child.Kind, Id: child.Id})
+		}
+	}
+	return result
+}
+
+// Regenerate returns the doc from RegenerateE, so Declarative can be used
+// as a plain Indexer. A deleted entity gives a doc with Deleted set, while
+// other errors are logged.
+func (d *Declarative) Regenerate(e x.Entity) x.Doc {
+	doc, err := d.RegenerateE(e)
+	if err == ErrDeleted {
+		doc.Deleted = true
+	} else if err != nil {
+		x.LogErr(log, err).WithField("entity", e).Error("While regenerating doc")
+	}
+	return doc
+}
+
+// RegenerateE generates the doc from the current state of the entity,
+// returning ErrDeleted if the entity is no longer present.
+func (d *Declarative) RegenerateE(e x.Entity) (x.Doc, error) {
+	doc := x.Doc{Kind: e.Kind, Id: e.Id, NanoTs: time.Now().UnixNano()}
+
+	depth := d.depth
+	if len(d.counts) > 0 && depth == 0 {
+		depth = 1
+	}
+	result, err := store.NewQuery(e.Id).UptoDepth(depth).Run()
+	if err != nil {
+		return doc, err
+	}
+	if len(result.Id) == 0 {
+		return doc, ErrDeleted
+	}
+
+	counts := make(map[string]int)
+	for _, child := range result.Children {
+		counts[child.Kind] += 1
+	}
+	if d.depth == 0 {
+		result.Children = nil
+	}
+	d.filter(result)
+
+	data := result.ToMap()
+	for kind, field := range d.counts {
+		data[field] = counts[kind]
+	}
+	if err := d.copyParentFields(e.Id, data); err != nil {
+		return doc, err
+	}
+	doc.Data = data
+	return doc, nil
+}
+
+// filter drops the predicates not to be included in the doc, from r and
+// its descendants.
+func (d *Declarative) filter(r *store.Result) {
+	for pred := range r.Columns {
+		if d.exclude[pred] || (len(d.include) > 0 && !d.include[pred]) {
+			r.Drop(pred)
+		}
+	}
+	for _, child := range r.Children {
+		d.filter(child)
+	}
+}
+
+func (d *Declarative) copyParentFields(id string, data map[string]interface{}) error {
+	if len(d.parents) == 0 {
+		return nil
+	}
+	parentid, err := store.Parent(id)
+	if err == store.ErrNoParent {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	r, err := store.NewQuery(parentid).UptoDepth(0).Run()
+	if err != nil {
+		return err
+	}
+	for pred, field := range d.parents {
+		if versions, present := r.Columns[pred]; present {
+			data[field] = versions.Latest().Value
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package indexer
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	_ "github.com/aslanides/gocrud/drivers/leveldb"
+	"github.com/aslanides/gocrud/req"
+	"github.com/aslanides/gocrud/store"
+	"github.com/aslanides/gocrud/x"
+)
+
+func TestDeclarative(t *testing.T) {
+	dir, err := ioutil.TempDir("", "declarative")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store.Get().Init(dir)
+
+	c := req.NewContext(10)
+	uid := "uid_" + x.UniqueString(3)
+	if err := store.NewUpdate("User", uid).SetSource(uid).Set("name", "alice").
+		AddChild("Post").Set("body", "cat videos").Set("secret", "xyz").
+		Execute(c); err != nil {
+		t.Fatal(err)
+	}
+	ur, err := store.NewQuery(uid).UptoDepth(1).Run()
+	if err != nil || len(ur.Children) != 1 {
+		t.Fatalf("Expected one post. Found: %+v, %v", ur, err)
+	}
+	pid := ur.Children[0].Id
+	for i := 0; i < 2; i++ {
+		if err := store.NewUpdate("Post", pid).SetSource(uid).AddChild("Like").
+			Set("thumb", 1).Execute(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	pr, err := store.NewQuery(pid).UptoDepth(1).Run()
+	if err != nil || len(pr.Children) != 2 {
+		t.Fatalf("Expected two likes. Found: %+v, %v", pr, err)
+	}
+	lid := pr.Children[0].Id
+
+	d := NewDeclarative().Exclude("secret").Count("Like", "likes").
+		ParentField("name", "author").Ancestors("Post", "User")
+	doc, err := d.RegenerateE(x.Entity{Kind: "Post", Id: pid})
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := doc.Data.(map[string]interface{})
+	if data["body"] != "cat videos" || data["likes"] != 2 || data["author"] != "alice" {
+		t.Errorf("Unexpected doc: %+v", data)
+	}
+	if _, present := data["secret"]; present {
+		t.Errorf("Excluded predicate found: %+v", data)
+	}
+	if _, present := data["Like"]; present {
+		t.Errorf("Children beyond depth found: %+v", data)
+	}
+
+	dirty := d.OnUpdate(x.Entity{Kind: "Like", Id: lid})
+	if len(dirty) != 3 || dirty[1].Id != pid || dirty[2].Id != uid {
+		t.Errorf("Expected like, post and user. Found: %+v", dirty)
+	}
+	ud := NewDeclarative().Children("Post")
+	dirty = ud.OnUpdate(x.Entity{Kind: "User", Id: uid})
+	if len(dirty) != 2 || dirty[0].Id != uid || dirty[1].Id != pid {
+		t.Errorf("Expected user and post. Found: %+v", dirty)
+	}
+	if dirty = ud.OnUpdate(x.Entity{Kind: "Post", Id: pid}); len(dirty) != 1 {
+		t.Errorf("Expected likes not to be marked dirty. Found: %+v", dirty)
+	}
+
+	if err := store.NewUpdate("Post", pid).SetSource(uid).MarkDeleted().
+		Execute(c); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.RegenerateE(x.Entity{Kind: "Post", Id: pid}); err != ErrDeleted {
+		t.Errorf("Expected ErrDeleted. Found: %v", err)
+	}
+}
@@ -5,7 +5,8 @@
 // of dependency generation (for e.g. update parent entity if child entity
 // is modified), and document regeneration and reindexing (regenerate
 // search document for both parent and child entities, and update them
-// in search index).
+// in search index). For the common cases, NewDeclarative provides an
+// Indexer configured via chained calls, instead of writing one by hand.
 //
 // This methodology allows for real time incremental indexing systems. They
 // can be utilized as such:
@@ -1,8 +1,9 @@
 package indexer
 
 import (
-	"sort"
-	"sync"
+	"context"
+	"errors"
+	"time"
 
 	"github.com/aslanides/gocrud/req"
 	"github.com/aslanides/gocrud/search"
@@ -26,107 +27,123 @@ type Indexer interface {
 	// Regenerate would be called on entities which need to be reprocessed
 	// due to a change. The workflow is:
 	// store.Commit -> search.OnUpdate -> Regenerate
+	// If the entity is no longer present, or has been marked deleted, set
+	// Deleted on the returned doc, so it gets removed from search index.
 	Regenerate(x.Entity) x.Doc
 }
 
+// Errors which RegenerateE can return, to be handled by the indexer.
 var (
-	mutex    sync.RWMutex
-	indexers = make(map[string]Indexer)
+	// ErrSkip leaves the doc in search index as it is.
+	ErrSkip = errors.New("Skip regeneration")
 
-	// Block if we have more than 1000 pending entities for update.
-	updates = make(chan x.Entity, 1000)
-	wg      = new(sync.WaitGroup)
+	// ErrDeleted removes the doc from search index.
+	ErrDeleted = errors.New("Entity deleted")
 )
 
-func processUpdates(c *req.Context) {
-	defer wg.Done()
+// IndexerE can be implemented by indexers, which need to report failures
+// while regenerating docs, for e.g. when the store query fails. It's then
+// preferred over Regenerate. Any error other than ErrSkip and ErrDeleted
+// is retried, with the same settings as updates to search engine.
+type IndexerE interface {
+	Indexer
+
+	// RegenerateE works like Regenerate. Returned doc is ignored on error,
+	// except for ErrDeleted, when its NanoTs, if set, is used to version
+	// the delete.
+	RegenerateE(x.Entity) (x.Doc, error)
+}
 
-	for entity := range c.Updates {
-		idxr, pok := Get(entity.Kind)
-		if !pok {
-			continue
-		}
-		dirty := idxr.OnUpdate(entity)
-		for _, de := range dirty {
-			didxr, dok := Get(de.Kind)
-			if !dok {
-				continue
-			}
-			doc := didxr.Regenerate(de)
+// regenerateDoc regenerates the doc for entity, via RegenerateE if the
+// indexer implements it, retrying on errors. Returns false if there's
+// nothing to index.
+func regenerateDoc(idxr Indexer, e x.Entity, rc retryConf) (x.Doc, bool) {
+	ie, ok := idxr.(IndexerE)
+	if !ok {
+		doc := idxr.Regenerate(e)
+		log.WithField("doc", doc).Debug("Regenerated doc")
+		return doc, true
+	}
+
+	for attempt := 0; ; attempt++ {
+		doc, err := ie.RegenerateE(e)
+		switch {
+		case err == nil:
 			log.WithField("doc", doc).Debug("Regenerated doc")
-			if search.Get() == nil {
-				continue
-			}
-			err := search.Get().Update(doc)
-			if err != nil {
-				x.LogErr(log, err).WithField("doc", doc).
-					Error("While updating in search engine")
+			return doc, true
+
+		case err == ErrSkip:
+			log.WithField("entity", e).Debug("Skipped regeneration")
+			return doc, false
+
+		case err == ErrDeleted:
+			del := x.Doc{Kind: e.Kind, Id: e.Id, NanoTs: doc.NanoTs, Deleted: true}
+			if del.NanoTs == 0 {
+				del.NanoTs = time.Now().UnixNano()
 			}
+			return del, true
+
+		case attempt+1 >= rc.attempts:
+			failed(x.Doc{Kind: e.Kind, Id: e.Id}, err, rc.deadLetter)
+			return doc, false
 		}
+		x.LogErr(log, err).WithField("entity", e).
+			WithField("attempt", attempt+1).Warn("While regenerating doc")
+		time.Sleep(backoff(attempt, rc.initial, rc.max))
 	}
-	log.Info("Finished processing channel")
 }
 
-func Run(c *req.Context, numRoutines int) {
-	if numRoutines <= 0 {
-		log.WithField("num_routines", numRoutines).
-			Fatal("Invalid number of goroutines for Indexer.")
-		return
+// updateIndex updates the doc in search engine, or removes it, if the
+// doc has been marked deleted by the indexer.
+func updateIndex(engine search.Engine, doc x.Doc) error {
+	if doc.Deleted {
+		return engine.Delete(doc.Kind, doc.Id, doc.NanoTs)
 	}
+	return engine.Update(doc)
+}
 
-	for i := 0; i < numRoutines; i++ {
-		wg.Add(1)
-		go processUpdates(c)
-	}
+// Run starts the default pipeline, processing updates from c.
+func Run(c *req.Context, numRoutines int) {
+	Default.Start(c, numRoutines)
 }
 
+// WaitForDone waits for all the pending updates to be processed, and the
+// regenerated docs to be indexed, and then stops the default pipeline.
+// It can be started again via Run.
 func WaitForDone(c *req.Context) {
 	log.Debug("Waiting for indexer to finish.")
-	close(c.Updates)
-	wg.Wait()
+	Default.Stop()
+}
+
+// Flush blocks until the updates sent before the call are indexed by the
+// default pipeline, or ctx is done.
+func Flush(ctx context.Context) error {
+	return Default.Flush(ctx)
 }
 
+// WaitIndexed blocks until the updates sent before the call, to or marking
+// dirty any of the entities, are indexed by the default pipeline, or ctx
+// is done.
+func WaitIndexed(ctx context.Context, entities ...x.Entity) error {
+	return Default.WaitIndexed(ctx, entities...)
+}
+
+// Register registers the indexer for kind with the default pipeline.
 func Register(kind string, driver Indexer) {
-	mutex.Lock()
-	defer mutex.Unlock()
-	if driver == nil {
-		log.WithField("kind", kind).Fatal("nil indexer")
-		return
-	}
-	if _, dup := indexers[kind]; dup {
-		log.WithField("kind", kind).Fatal(
-			"Another driver is already handling the same entity kind")
-		return
-	}
-	indexers[kind] = driver
+	Default.Register(kind, driver)
 }
 
+// Get returns the indexer for kind from the default pipeline.
 func Get(kind string) (i Indexer, p bool) {
-	mutex.RLock()
-	defer mutex.RUnlock()
-
-	if driver, present := indexers[kind]; present {
-		return driver, true
-	} else {
-		return nil, false
-	}
+	return Default.Get(kind)
 }
 
+// Kinds returns the kinds registered with the default pipeline.
 func Kinds() []string {
-	mutex.RLock()
-	defer mutex.RUnlock()
-
-	var list []string
-	for kind := range indexers {
-		list = append(list, kind)
-	}
-	sort.Strings(list)
-	return list
+	return Default.Kinds()
 }
 
+// Num returns the number of kinds registered with the default pipeline.
 func Num() int {
-	mutex.RLock()
-	defer mutex.RUnlock()
-
-	return len(indexers)
+	return Default.Num()
 }
@@ -0,0 +1,59 @@
+package indexer
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aslanides/gocrud/x"
+)
+
+type flakyIndexer struct {
+	calls int
+	err   error // Returned after the first failure.
+}
+
+func (fi *flakyIndexer) OnUpdate(e x.Entity) []x.Entity {
+	return []x.Entity{e}
+}
+
+func (fi *flakyIndexer) Regenerate(e x.Entity) x.Doc {
+	return x.Doc{Kind: e.Kind, Id: e.Id}
+}
+
+func (fi *flakyIndexer) RegenerateE(e x.Entity) (x.Doc, error) {
+	fi.calls++
+	if fi.calls == 1 {
+		return x.Doc{}, errors.New("store unavailable")
+	}
+	return x.Doc{Kind: e.Kind, Id: e.Id, NanoTs: 10}, fi.err
+}
+
+func TestRegenerateE(t *testing.T) {
+	p := NewPipeline(nil)
+	p.SetRetry(3, time.Millisecond, time.Millisecond)
+	rc := p.retrySettings()
+	e := x.Entity{Kind: "Post", Id: "p1"}
+
+	fi := new(flakyIndexer)
+	doc, ok := regenerateDoc(fi, e, rc)
+	if !ok || fi.calls != 2 || doc.Id != "p1" || doc.Deleted {
+		t.Errorf("Expected doc after retry. Found: %+v, %v, %v", doc, ok, fi.calls)
+	}
+
+	fi = &flakyIndexer{err: ErrSkip}
+	if _, ok := regenerateDoc(fi, e, rc); ok {
+		t.Error("Expected skipped entity to not be indexed")
+	}
+
+	fi = &flakyIndexer{err: ErrDeleted}
+	doc, ok = regenerateDoc(fi, e, rc)
+	if !ok || !doc.Deleted || doc.NanoTs != 10 || doc.Data != nil {
+		t.Errorf("Expected deleted doc. Found: %+v, %v", doc, ok)
+	}
+
+	fi = &flakyIndexer{err: errors.New("store unavailable")}
+	if _, ok := regenerateDoc(fi, e, rc); ok || fi.calls != 3 {
+		t.Errorf("Expected failure after 3 attempts. Found: %v", fi.calls)
+	}
+}
@@ -0,0 +1,81 @@
+package indexer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/aslanides/gocrud/drivers/memsearch"
+	"github.com/aslanides/gocrud/req"
+	"github.com/aslanides/gocrud/store"
+	"github.com/aslanides/gocrud/x"
+)
+
+func TestLoopPartitioned(t *testing.T) {
+	dir, err := ioutil.TempDir("", "partition")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store.Get().Init(dir)
+
+	c := req.NewContext(10)
+	for i := 0; i < 50; i++ {
+		if err := store.NewUpdate("P", fmt.Sprintf("p%02d", i)).SetSource("t").
+			Set("v", i).Set("w", i).Execute(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	pr, ok := store.Get().(store.Partitioner)
+	if !ok {
+		t.Fatal("Expected leveldb to be a Partitioner")
+	}
+	parts, err := pr.Partitions(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) < 2 || len(parts) > 4 {
+		t.Fatalf("Unexpected partitions: %+v", parts)
+	}
+	seen := make(map[x.Entity]int)
+	for _, part := range parts {
+		ch := make(chan x.Entity, 100)
+		cursor := ""
+		for {
+			// Small chunks, to check that the cursor resumes correctly.
+			found, next, err := pr.IteratePartition(part, cursor, 3, ch)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if found == 0 {
+				break
+			}
+			cursor = next
+		}
+		close(ch)
+		for e := range ch {
+			seen[e] += 1
+		}
+	}
+	if len(seen) != 50 {
+		t.Errorf("Expected 50 entities. Found: %v", len(seen))
+	}
+	for e, n := range seen {
+		if n != 1 {
+			t.Errorf("Entity %v found in %v partitions", e, n)
+		}
+	}
+
+	engine := new(memsearch.MemSearch)
+	engine.Init()
+	p := NewPipeline(engine)
+	p.Register("P", echoIndexer{})
+	s := p.NewServer(100, 4)
+	s.LoopPartitioned(4)
+	s.Finish()
+	if n := len(engine.All()); n != 50 {
+		t.Errorf("Expected 50 docs. Found: %v", n)
+	}
+}
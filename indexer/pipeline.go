@@ -0,0 +1,330 @@
+package indexer
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aslanides/gocrud/req"
+	"github.com/aslanides/gocrud/search"
+	"github.com/aslanides/gocrud/x"
+)
+
+// Pipeline holds a registry of indexers, and the workers which process
+// updates from a req.Context, regenerate docs for dirty entities, and
+// index them into a search engine. Pipelines are independent of each
+// other, and can be stopped and started again.
+type Pipeline struct {
+	sync.RWMutex // Guards indexers.
+	indexers     map[string]Indexer
+	engine       search.Engine // Nil, to use search.Get().
+
+	conf      sync.RWMutex // Guards the settings below.
+	batchSize int
+	batchWait time.Duration
+	debounce  time.Duration
+	retry     retryConf
+
+	// Set while running, guarded by life.
+	life     sync.RWMutex
+	ctx      *req.Context
+	quit     chan struct{}
+	recv     sync.Mutex     // Keeps updates numbered in the order received.
+	wg       sync.WaitGroup // processUpdates routines.
+	rwg      sync.WaitGroup // regenerate routines.
+	dwg      sync.WaitGroup // drainSpill routine.
+	dirty    *coalescer
+	batch    *batcher
+	progress *progress
+}
+
+// Default is the pipeline used by the package level functions.
+var Default = NewPipeline(nil)
+
+// NewPipeline returns a pipeline indexing into engine. If engine is nil,
+// the one returned by search.Get at the time of Start is used.
+func NewPipeline(engine search.Engine) *Pipeline {
+	return &Pipeline{
+		indexers:  make(map[string]Indexer),
+		engine:    engine,
+		batchSize: 100,
+		batchWait: time.Second,
+		retry:     defaultRetry,
+	}
+}
+
+func (p *Pipeline) searchEngine() search.Engine {
+	if p.engine != nil {
+		return p.engine
+	}
+	return search.Get()
+}
+
+// Register sets the indexer for entities of kind.
+func (p *Pipeline) Register(kind string, driver Indexer) {
+	p.Lock()
+	defer p.Unlock()
+	if driver == nil {
+		log.WithField("kind", kind).Fatal("nil indexer")
+		return
+	}
+	if _, dup := p.indexers[kind]; dup {
+		log.WithField("kind", kind).Fatal(
+			"Another driver is already handling the same entity kind")
+		return
+	}
+	p.indexers[kind] = driver
+}
+
+// Get returns the indexer for kind, if registered.
+func (p *Pipeline) Get(kind string) (i Indexer, present bool) {
+	p.RLock()
+	defer p.RUnlock()
+	i, present = p.indexers[kind]
+	return
+}
+
+// Kinds returns the sorted list of kinds with an indexer registered.
+func (p *Pipeline) Kinds() []string {
+	p.RLock()
+	defer p.RUnlock()
+
+	var list []string
+	for kind := range p.indexers {
+		list = append(list, kind)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// Num returns the number of kinds with an indexer registered.
+func (p *Pipeline) Num() int {
+	p.RLock()
+	defer p.RUnlock()
+	return len(p.indexers)
+}
+
+// Start runs numRoutines goroutines each, to process updates from c, and to
+// regenerate and index docs.
+func (p *Pipeline) Start(c *req.Context, numRoutines int) {
+	if numRoutines <= 0 {
+		log.WithField("num_routines", numRoutines).
+			Fatal("Invalid number of goroutines for Indexer.")
+		return
+	}
+	p.life.Lock()
+	defer p.life.Unlock()
+	if p.ctx != nil {
+		log.Fatal("Pipeline already started")
+		return
+	}
+
+	p.ctx = c
+	p.quit = make(chan struct{})
+	p.progress = newProgress()
+	p.conf.RLock()
+	p.batch = newBatcher(p.searchEngine(), p.batchSize, p.batchWait, p.retry)
+	p.dirty = newCoalescer(1000, p.debounce)
+	p.conf.RUnlock()
+	p.dwg.Add(1)
+	go p.drainSpill()
+	for i := 0; i < numRoutines; i++ {
+		p.wg.Add(1)
+		go p.processUpdates()
+		p.rwg.Add(1)
+		go p.regenerate()
+	}
+}
+
+// Stop processes the updates pending in the channel, waits for their docs
+// to be indexed, and stops all the goroutines. The channel isn't closed,
+// so updates sent afterwards are processed once the pipeline is started
+// again.
+func (p *Pipeline) Stop() {
+	p.life.Lock()
+	defer p.life.Unlock()
+	if p.ctx == nil {
+		return
+	}
+	close(p.quit)
+	p.dwg.Wait()
+	p.wg.Wait()
+	p.dirty.close()
+	p.rwg.Wait()
+	p.batch.close()
+	p.ctx = nil
+}
+
+// Flush blocks until all the updates sent via req.Context.Enqueue before
+// the call have been processed, and the docs regenerated for them indexed,
+// without waiting for the debounce window, or the batches to fill up.
+// Returns the context error, if ctx is done before that. Returns right
+// away if the pipeline isn't running, and once it's stopped, as Stop
+// indexes the updates pending in the channel.
+func (p *Pipeline) Flush(ctx context.Context) error {
+	return p.waitIndexed(ctx, nil)
+}
+
+// WaitIndexed works like Flush, but only waits for the updates to, or
+// marking dirty any of the given entities. For e.g. to read back a Post
+// from search engine, right after a Like on it.
+func (p *Pipeline) WaitIndexed(ctx context.Context, entities ...x.Entity) error {
+	set := make(map[x.Entity]bool)
+	for _, e := range entities {
+		set[e] = true
+	}
+	if len(set) == 0 {
+		return nil
+	}
+	return p.waitIndexed(ctx, set)
+}
+
+func (p *Pipeline) waitIndexed(ctx context.Context, entities map[x.Entity]bool) error {
+	// Not held while waiting, so Stop isn't blocked by waiters.
+	p.life.RLock()
+	c, quit, progress := p.ctx, p.quit, p.progress
+	dirty, batch := p.dirty, p.batch
+	p.life.RUnlock()
+	if c == nil {
+		return nil
+	}
+
+	// Updates spilled before the call only get numbered once drained back
+	// into the channel, so wait for those first.
+	spilled := c.NumSpilled()
+	var seq uint64
+	draining := true
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		if draining && c.NumDrained() >= spilled {
+			draining = false
+			seq = c.NumEnqueued()
+		}
+		if !draining && c.NumDequeued() >= seq &&
+			!progress.pending(seq, entities) {
+			return nil
+		}
+
+		// Stop closes quit while holding life, after which the coalescer
+		// and batcher are closed.
+		p.life.RLock()
+		select {
+		case <-quit:
+			p.life.RUnlock()
+			return nil
+		default:
+		}
+		c.DrainSpill(drainChunk)
+		dirty.flushTimers()
+		batch.flushPending()
+		p.life.RUnlock()
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-quit:
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+// drainChunk is the max number of updates moved from the spill queue of
+// req.Context, per drainInterval.
+const drainChunk = 1000
+
+const drainInterval = 100 * time.Millisecond
+
+// drainSpill moves the updates spilled by req.Context back into the
+// channel, as space frees up. Updates still spilled on Stop are left in
+// the queue, for the next Start.
+func (p *Pipeline) drainSpill() {
+	defer p.dwg.Done()
+
+	ticker := time.NewTicker(drainInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.quit:
+			return
+		case <-ticker.C:
+			p.ctx.DrainSpill(drainChunk)
+		}
+	}
+}
+
+// receive returns the next update, and its group. Returns false once the
+// pipeline is stopped, and no updates are pending.
+func (p *Pipeline) receive() (*group, bool) {
+	p.recv.Lock()
+	defer p.recv.Unlock()
+
+	var entity x.Entity
+	var ok bool
+	select {
+	case entity, ok = <-p.ctx.Updates:
+	case <-p.quit:
+		// Process whatever is pending, before returning.
+		select {
+		case entity, ok = <-p.ctx.Updates:
+		default:
+		}
+	}
+	if !ok {
+		return nil, false
+	}
+	return p.progress.start(p.ctx.MarkDequeued(), entity), true
+}
+
+func (p *Pipeline) processUpdates() {
+	defer p.wg.Done()
+
+	for {
+		g, ok := p.receive()
+		if !ok {
+			log.Info("Finished processing channel")
+			return
+		}
+		p.process(g)
+	}
+}
+
+// process marks the entities returned by the indexer for the update dirty.
+func (p *Pipeline) process(g *group) {
+	defer g.done()
+
+	entity := g.entities[0]
+	idxr, pok := p.Get(entity.Kind)
+	if !pok {
+		return
+	}
+	for _, de := range idxr.OnUpdate(entity) {
+		if _, dok := p.Get(de.Kind); !dok {
+			continue
+		}
+		g.add(de)
+		p.dirty.add(de, g)
+	}
+}
+
+// regenerate regenerates docs for dirty entities, and indexes them.
+func (p *Pipeline) regenerate() {
+	defer p.rwg.Done()
+
+	for de := range p.dirty.out {
+		groups := p.dirty.take(de)
+		didxr, dok := p.Get(de.Kind)
+		if !dok {
+			doneAll(groups)
+			continue
+		}
+		doc, ok := regenerateDoc(didxr, de, p.batch.retry)
+		if !ok || p.batch.engine == nil {
+			doneAll(groups)
+			continue
+		}
+		p.batch.index(doc, groups)
+	}
+}
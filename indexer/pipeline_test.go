@@ -0,0 +1,158 @@
+package indexer
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aslanides/gocrud/drivers/memsearch"
+	"github.com/aslanides/gocrud/req"
+	"github.com/aslanides/gocrud/x"
+)
+
+type echoIndexer struct{}
+
+func (ei echoIndexer) OnUpdate(e x.Entity) []x.Entity {
+	return []x.Entity{e}
+}
+
+func (ei echoIndexer) Regenerate(e x.Entity) x.Doc {
+	return x.Doc{Kind: e.Kind, Id: e.Id, NanoTs: time.Now().UnixNano()}
+}
+
+func send(c *req.Context, kind string, from, to int) {
+	for i := from; i < to; i++ {
+		c.Enqueue(x.Entity{Kind: kind, Id: fmt.Sprintf("%s%d", kind, i)})
+	}
+}
+
+func TestPipelines(t *testing.T) {
+	var engines [2]*memsearch.MemSearch
+	var ctxs [2]*req.Context
+	var pipes [2]*Pipeline
+	for i := range pipes {
+		engines[i] = new(memsearch.MemSearch)
+		engines[i].Init()
+		ctxs[i] = req.NewContextWithUpdates(10, 100)
+		pipes[i] = NewPipeline(engines[i])
+		pipes[i].SetBatch(100, time.Hour)
+		pipes[i].Register("Post", echoIndexer{})
+		pipes[i].Start(ctxs[i], 2)
+	}
+
+	send(ctxs[0], "Post", 0, 5)
+	send(ctxs[1], "Post", 0, 3)
+	send(ctxs[1], "Like", 0, 3) // No indexer registered.
+	for i := range pipes {
+		// Batches would otherwise wait for an hour.
+		if err := pipes[i].Flush(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(engines[0].All()); n != 5 {
+		t.Errorf("Expected 5 docs in first engine. Found: %v", n)
+	}
+	if n := len(engines[1].All()); n != 3 {
+		t.Errorf("Expected 3 docs in second engine. Found: %v", n)
+	}
+
+	// Updates sent while stopped are processed after restart.
+	pipes[0].Stop()
+	send(ctxs[0], "Post", 5, 8)
+	if n := len(engines[0].All()); n != 5 {
+		t.Errorf("Expected no new docs while stopped. Found: %v", n)
+	}
+	pipes[0].Start(ctxs[0], 1)
+	pipes[0].Stop()
+	if n := len(engines[0].All()); n != 8 {
+		t.Errorf("Expected 8 docs after restart. Found: %v", n)
+	}
+	pipes[1].Stop()
+}
+
+// blockingIndexer waits for release, before regenerating Slow entities.
+type blockingIndexer struct {
+	echoIndexer
+	release chan struct{}
+}
+
+func (bi blockingIndexer) Regenerate(e x.Entity) x.Doc {
+	if e.Kind == "Slow" {
+		<-bi.release
+	}
+	return bi.echoIndexer.Regenerate(e)
+}
+
+func TestFlush(t *testing.T) {
+	engine := new(memsearch.MemSearch)
+	engine.Init()
+	c := req.NewContextWithUpdates(10, 100)
+	p := NewPipeline(engine)
+	p.SetDebounce(time.Hour)
+	bi := blockingIndexer{release: make(chan struct{})}
+	p.Register("Slow", bi)
+	p.Register("Fast", bi)
+	p.Start(c, 2)
+	defer p.Stop()
+
+	send(c, "Slow", 0, 1)
+	send(c, "Fast", 0, 2)
+	fast := x.Entity{Kind: "Fast", Id: "Fast1"}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := p.WaitIndexed(ctx, fast); err != nil {
+		t.Fatalf("Expected Fast1 to be indexed, despite debounce. Got: %v", err)
+	}
+	if n := len(engine.All()); n != 2 {
+		t.Errorf("Expected 2 docs. Found: %v", n)
+	}
+
+	short, scancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer scancel()
+	if err := p.Flush(short); err != context.DeadlineExceeded {
+		t.Errorf("Expected flush to time out on Slow. Got: %v", err)
+	}
+	close(bi.release)
+	if err := p.Flush(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(engine.All()); n != 3 {
+		t.Errorf("Expected 3 docs after flush. Found: %v", n)
+	}
+}
+
+func TestFlushSpilled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	engine := new(memsearch.MemSearch)
+	engine.Init()
+	c := req.NewContextWithUpdates(10, 1)
+	c.SetSpillQueue(req.NewFileSpillQueue(filepath.Join(dir, "spill")))
+	c.SetOverflow(req.OverflowSpill, 0)
+	send(c, "Post", 0, 5) // Indexer isn't running yet.
+	if s := c.Stats(); s.Spilled != 4 {
+		t.Fatalf("Expected 4 updates spilled. Found: %+v", s)
+	}
+
+	p := NewPipeline(engine)
+	p.Register("Post", echoIndexer{})
+	p.Start(c, 2)
+	defer p.Stop()
+	if err := p.Flush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(engine.All()); n != 5 {
+		t.Errorf("Expected 5 docs. Found: %v", n)
+	}
+	if s := c.Stats(); s.SpillDepth != 0 || s.Drained != 4 {
+		t.Errorf("Unexpected stats: %+v", s)
+	}
+}
@@ -0,0 +1,82 @@
+package indexer
+
+import (
+	"sync"
+
+	"github.com/aslanides/gocrud/x"
+)
+
+// progress keeps track of the updates received from req.Context, until the
+// docs for all the entities they marked dirty are indexed, so Flush and
+// WaitIndexed know when to return.
+type progress struct {
+	sync.Mutex
+	groups map[uint64]*group // Incomplete groups, by number of the update.
+}
+
+func newProgress() *progress {
+	return &progress{groups: make(map[uint64]*group)}
+}
+
+// group is the work resulting from a single update.
+type group struct {
+	prog     *progress
+	seq      uint64
+	entities []x.Entity // The updated entity, and the ones marked dirty.
+	n        int        // Pending entities, including the update itself.
+}
+
+// start returns the group for update number seq, which must be marked done
+// once the update has been processed.
+func (pr *progress) start(seq uint64, e x.Entity) *group {
+	g := &group{prog: pr, seq: seq, entities: []x.Entity{e}, n: 1}
+	pr.Lock()
+	defer pr.Unlock()
+	pr.groups[seq] = g
+	return g
+}
+
+// pending returns true if any update upto number seq is still being
+// processed. If entities isn't empty, only updates to, or marking dirty
+// one of those entities are considered.
+func (pr *progress) pending(seq uint64, entities map[x.Entity]bool) bool {
+	pr.Lock()
+	defer pr.Unlock()
+	for s, g := range pr.groups {
+		if s > seq {
+			continue
+		}
+		if len(entities) == 0 {
+			return true
+		}
+		for _, e := range g.entities {
+			if entities[e] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// add makes the group wait for the doc of dirty entity e to be indexed.
+func (g *group) add(e x.Entity) {
+	g.prog.Lock()
+	defer g.prog.Unlock()
+	g.n += 1
+	g.entities = append(g.entities, e)
+}
+
+func (g *group) done() {
+	g.prog.Lock()
+	defer g.prog.Unlock()
+	g.n -= 1
+	if g.n == 0 {
+		delete(g.prog.groups, g.seq)
+	}
+}
+
+func doneAll(groups []*group) {
+	for _, g := range groups {
+		g.done()
+	}
+}
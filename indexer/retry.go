@@ -0,0 +1,126 @@
+package indexer
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/aslanides/gocrud/search"
+	"github.com/aslanides/gocrud/x"
+)
+
+// retryConf holds the settings for retrying failed docs.
+type retryConf struct {
+	attempts   int
+	initial    time.Duration
+	max        time.Duration
+	deadLetter DeadLetter
+}
+
+var defaultRetry = retryConf{
+	attempts: 3,
+	initial:  100 * time.Millisecond,
+	max:      5 * time.Second,
+}
+
+// SetRetry sets the retry settings of the Default pipeline.
+func SetRetry(attempts int, initial, max time.Duration) {
+	Default.SetRetry(attempts, initial, max)
+}
+
+// SetDeadLetter sets the dead letter sink of the Default pipeline.
+func SetDeadLetter(dl DeadLetter) {
+	Default.SetDeadLetter(dl)
+}
+
+// SetRetry sets the max number of attempts to index a doc, and the
+// exponential backoff between them, starting at initial and capped at max.
+// Version conflicts aren't retried, as the doc in search engine is newer.
+func (p *Pipeline) SetRetry(attempts int, initial, max time.Duration) {
+	if attempts <= 0 || initial <= 0 || max < initial {
+		log.WithField("attempts", attempts).WithField("initial", initial).
+			WithField("max", max).Fatal("Invalid retry settings")
+		return
+	}
+	p.conf.Lock()
+	defer p.conf.Unlock()
+	p.retry.attempts = attempts
+	p.retry.initial = initial
+	p.retry.max = max
+}
+
+// SetDeadLetter sets the sink for docs which couldn't be indexed, even
+// after all the attempts. By default, they're only logged.
+func (p *Pipeline) SetDeadLetter(dl DeadLetter) {
+	p.conf.Lock()
+	defer p.conf.Unlock()
+	p.retry.deadLetter = dl
+}
+
+func (p *Pipeline) retrySettings() retryConf {
+	p.conf.RLock()
+	defer p.conf.RUnlock()
+	return p.retry
+}
+
+// backoff returns the duration to wait before the next attempt, doubling
+// each time, with jitter so failed docs don't all retry together.
+func backoff(attempt int, initial, max time.Duration) time.Duration {
+	d := initial
+	for i := 0; i < attempt && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// failed hands over the doc to the dead letter sink, if set.
+func failed(doc x.Doc, err error, dl DeadLetter) {
+	x.LogErr(log, err).WithField("doc", doc).
+		Error("While updating in search engine. Giving up")
+	if dl == nil {
+		return
+	}
+	if derr := dl.Add(doc, err); derr != nil {
+		x.LogErr(log, derr).WithField("doc", doc).Error("While adding to dead letter")
+	}
+}
+
+// indexDocs indexes the docs, retrying the ones which failed. Docs which
+// fail all attempts are sent to the dead letter sink.
+func indexDocs(docs []x.Doc, update func([]x.Doc) []error, rc retryConf) {
+	for attempt := 0; len(docs) > 0; attempt++ {
+		errs := update(docs)
+
+		var pending []x.Doc
+		for i, err := range errs {
+			switch {
+			case err == nil:
+			case err == search.ErrConflict:
+				log.WithField("doc", docs[i]).Debug("Newer doc found. Ignoring stale doc")
+			case attempt+1 >= rc.attempts:
+				failed(docs[i], err, rc.deadLetter)
+			default:
+				x.LogErr(log, err).WithField("doc", docs[i]).
+					WithField("attempt", attempt+1).Warn("While updating in search engine")
+				pending = append(pending, docs[i])
+			}
+		}
+		if len(pending) > 0 {
+			time.Sleep(backoff(attempt, rc.initial, rc.max))
+		}
+		docs = pending
+	}
+}
+
+// oneByOne is used for engines which don't support bulk updates.
+func oneByOne(engine search.Engine) func([]x.Doc) []error {
+	return func(docs []x.Doc) []error {
+		errs := make([]error, len(docs))
+		for i, doc := range docs {
+			errs[i] = updateIndex(engine, doc)
+		}
+		return errs
+	}
+}
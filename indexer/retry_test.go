@@ -0,0 +1,110 @@
+package indexer
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aslanides/gocrud/req"
+	"github.com/aslanides/gocrud/search"
+	"github.com/aslanides/gocrud/store"
+	"github.com/aslanides/gocrud/x"
+)
+
+func TestIndexDocsRetry(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadletter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dl := NewFileDeadLetter(filepath.Join(dir, "dead.json"))
+	p := NewPipeline(nil)
+	p.SetDeadLetter(dl)
+	p.SetRetry(3, time.Millisecond, 4*time.Millisecond)
+
+	// a succeeds on second attempt, b conflicts, and c always fails.
+	docs := []x.Doc{{Kind: "K", Id: "a"}, {Kind: "K", Id: "b"}, {Kind: "K", Id: "c"}}
+	calls := make(map[string]int)
+	indexDocs(docs, func(docs []x.Doc) []error {
+		errs := make([]error, len(docs))
+		for i, doc := range docs {
+			calls[doc.Id]++
+			switch {
+			case doc.Id == "a" && calls["a"] == 1:
+				errs[i] = errors.New("timeout")
+			case doc.Id == "b":
+				errs[i] = search.ErrConflict
+			case doc.Id == "c":
+				errs[i] = errors.New("unavailable")
+			}
+		}
+		return errs
+	}, p.retrySettings())
+
+	if calls["a"] != 2 || calls["b"] != 1 || calls["c"] != 3 {
+		t.Errorf("Unexpected number of attempts: %v", calls)
+	}
+	entries, err := dl.Entries()
+	if err != nil {
+		t.Fatalf("While reading entries: %v", err)
+	}
+	if len(entries) != 1 || entries[0].Id != "c" || entries[0].Error != "unavailable" {
+		t.Errorf("Expected only c in dead letter. Found: %+v", entries)
+	}
+	if err := dl.Truncate(); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := dl.Entries(); len(entries) != 0 {
+		t.Errorf("Expected no entries after truncate. Found: %+v", entries)
+	}
+}
+
+func TestStoreDeadLetter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "deadstore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store.Get().Init(dir)
+
+	// Full updates channel, which shouldn't block the sink.
+	c := req.NewContextWithUpdates(10, 1)
+	c.Enqueue(x.Entity{Kind: "Post", Id: "p0"})
+	dl := NewStoreDeadLetter(c, "DeadDoc")
+	docs := []x.Doc{
+		{Kind: "Post", Id: "p1", NanoTs: 1792398859637441253},
+		{Kind: "Post", Id: "p2", NanoTs: 5, Deleted: true},
+	}
+	for _, doc := range docs {
+		if err := dl.Add(doc, errors.New("unavailable")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	entries, err := dl.Entries()
+	if err != nil {
+		t.Fatalf("While reading entries: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 entries. Found: %+v", entries)
+	}
+	for i, e := range entries {
+		doc := docs[i]
+		if e.Kind != doc.Kind || e.Id != doc.Id || e.NanoTs != doc.NanoTs ||
+			e.Deleted != doc.Deleted || e.Error != "unavailable" || e.At == 0 {
+			t.Errorf("Expected entry for %+v. Found: %+v", doc, e)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt := 0; attempt < 10; attempt++ {
+		d := backoff(attempt, 10*time.Millisecond, 100*time.Millisecond)
+		if d < 5*time.Millisecond || d > 100*time.Millisecond {
+			t.Errorf("Backoff out of bounds for attempt %v: %v", attempt, d)
+		}
+	}
+}
@@ -2,10 +2,10 @@ package indexer
 
 import (
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/Sirupsen/logrus"
-	"github.com/aslanides/gocrud/search"
 	"github.com/aslanides/gocrud/store"
 	"github.com/aslanides/gocrud/x"
 )
@@ -13,8 +13,19 @@ import (
 // Incremental indexing server to continously regenerate
 // and index entities to keep store and search in-sync.
 type Server struct {
-	ch chan x.Entity
-	wg *sync.WaitGroup
+	p     *Pipeline
+	ch    chan pendingEntity
+	wg    *sync.WaitGroup
+	batch *batcher
+	cp    Checkpointer
+	prog  *progress // Chunks of LoopOnce, until their docs are indexed.
+}
+
+// pendingEntity is an entity waiting to be regenerated by the server,
+// along with the group of the chunk it was found in, if any.
+type pendingEntity struct {
+	e x.Entity
+	g *group
 }
 
 // NewServer returns back a server which runs continously in
@@ -22,13 +33,25 @@ type Server struct {
 // You can control the amount of memory consumed by the server
 // via buffer of pending entities in the channel, and the
 // rate of processing of these entities via numRoutines.
+// Uses the indexers and search engine of the default pipeline.
 func NewServer(buffer int, numRoutines int) *Server {
-	if search.Get() == nil {
+	return Default.NewServer(buffer, numRoutines)
+}
+
+// NewServer returns a server using the indexers and search engine of p.
+func (p *Pipeline) NewServer(buffer int, numRoutines int) *Server {
+	engine := p.searchEngine()
+	if engine == nil {
 		log.Fatal("No search engine found")
 	}
 	s := new(Server)
-	s.ch = make(chan x.Entity, buffer)
+	s.p = p
+	s.ch = make(chan pendingEntity, buffer)
 	s.wg = new(sync.WaitGroup)
+	s.prog = newProgress()
+	p.conf.RLock()
+	s.batch = newBatcher(engine, p.batchSize, p.batchWait, p.retry)
+	p.conf.RUnlock()
 	for i := 0; i < numRoutines; i++ {
 		s.wg.Add(1)
 		go s.regenerateAndIndex()
@@ -39,40 +62,134 @@ func NewServer(buffer int, numRoutines int) *Server {
 func (s *Server) regenerateAndIndex() {
 	defer s.wg.Done()
 
-	for entity := range s.ch {
-		idxr, ok := Get(entity.Kind)
+	for pe := range s.ch {
+		var groups []*group
+		if pe.g != nil {
+			groups = append(groups, pe.g)
+		}
+		idxr, ok := s.p.Get(pe.e.Kind)
 		if !ok {
+			doneAll(groups)
 			continue
 		}
 
-		doc := idxr.Regenerate(entity)
-		log.WithField("doc", doc).Debug("Regenerated doc")
-		if err := search.Get().Update(doc); err != nil {
-			x.LogErr(log, err).WithField("doc", doc).
-				Error("While updating in search engine")
+		if doc, ok := regenerateDoc(idxr, pe.e, s.batch.retry); ok {
+			s.batch.index(doc, groups)
+		} else {
+			doneAll(groups)
+		}
+	}
+}
+
+// forward sends the entities found by the store to the workers, making
+// g, if set, wait for their docs to be indexed.
+func (s *Server) forward(ch chan x.Entity, g *group) {
+	for len(ch) > 0 {
+		e := <-ch
+		if g != nil {
+			g.add(e)
+		}
+		s.ch <- pendingEntity{e: e, g: g}
+	}
+}
+
+// waitChunk blocks until the docs for chunk number seq, and the ones
+// before it, are indexed. If flush is set, pending batches are flushed
+// instead of waiting for them to fill up.
+func (s *Server) waitChunk(seq uint64, flush bool) {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	for s.prog.pending(seq, nil) {
+		if flush {
+			s.batch.flushPending()
 		}
+		<-ticker.C
+	}
+}
+
+// SetCheckpointer sets where the server persists its progress through a
+// cycle. LoopOnce then resumes from the last checkpoint saved, instead of
+// starting over. Must be called before LoopOnce.
+func (s *Server) SetCheckpointer(cp Checkpointer) {
+	s.cp = cp
+}
+
+func (s *Server) loadCheckpoint() (cp Checkpoint) {
+	if s.cp == nil {
+		return cp
+	}
+	cp, err := s.cp.Load()
+	if err != nil {
+		x.LogErr(log, err).Error("While loading checkpoint. Starting over")
+		return Checkpoint{}
+	}
+	return cp
+}
+
+func (s *Server) saveCheckpoint(cp Checkpoint) {
+	if s.cp == nil {
+		return
+	}
+	if err := s.cp.Save(cp); err != nil {
+		x.LogErr(log, err).WithField("checkpoint", cp).Error("While saving checkpoint")
 	}
 }
 
 // LoopOnce would cycle over all entities in the store, and re-index them.
+// If a checkpointer is set, progress is saved once the docs for a chunk
+// of entities are indexed, while the workers go over the next chunk, and
+// the cycle resumes from the last entity saved. So a server dying only
+// repeats the work since.
 func (s *Server) LoopOnce() {
-	var total uint64
-	from := ""
+	cp := s.loadCheckpoint()
+	if len(cp.LastId) > 0 {
+		cp.Resumes += 1
+		log.WithField("checkpoint", cp).Info("Resuming cycle")
+	} else {
+		cp.Processed = 0
+		cp.Started = time.Now().UnixNano()
+	}
+	from := cp.LastId
+	ch := make(chan x.Entity, 1000) // Iterate sends at most 1000 entities.
+	var seq uint64
 	for {
-		found, last, err := store.Get().Iterate(from, 1000, s.ch)
+		found, last, err := store.Get().Iterate(from, 1000, ch)
 		if err != nil {
 			x.LogErr(log, err).Error("While iterating")
+			s.forward(ch, nil)
 			return
 		}
-		if found == 0 {
-			log.WithField("total", total).Info("Reached end of cycle")
+		// Iteration starts from the last entity of the previous chunk.
+		if found == 0 || (found == 1 && len(from) > 0 && last.Id == from) {
+			s.forward(ch, nil)
+			s.waitChunk(seq, true)
+			log.WithField("total", cp.Processed).Info("Reached end of cycle")
+			cp.Cycles += 1
+			cp.PrevTotal = cp.Processed
+			cp.PrevStarted = cp.Started
+			cp.PrevFinished = time.Now().UnixNano()
+			cp.LastId = ""
+			cp.Processed = 0
+			cp.Started = 0
+			cp.Resumes = 0
+			s.saveCheckpoint(cp)
 			return
 		}
 		log.WithFields(logrus.Fields{
 			"num_processed": found,
 			"last":          last,
 		}).Debug("Iteration chunk done")
-		total += uint64(found)
+		seq += 1
+		g := s.prog.start(seq, last)
+		s.forward(ch, g)
+		g.done()
+		if seq > 1 {
+			// Previous chunk, saved as cp.
+			s.waitChunk(seq-1, false)
+			s.saveCheckpoint(cp)
+		}
+		cp.Processed += uint64(found)
+		cp.LastId = last.Id
 		from = last.Id
 	}
 	log.Fatal("This should never be reached.")
@@ -89,7 +206,122 @@ func (s *Server) InfiniteLoop(wait time.Duration) {
 	}
 }
 
+// LoopPartitioned does a single cycle over all the entities, like LoopOnce,
+// with n scanners covering disjoint partitions of the store at once, if the
+// store implements store.Partitioner. Otherwise, it falls back to LoopOnce.
+// Partitioned cycles aren't checkpointed, so an interrupted cycle has to be
+// started over.
+func (s *Server) LoopPartitioned(n int) {
+	pr, ok := store.Get().(store.Partitioner)
+	if !ok {
+		log.Warn("Store can't be partitioned. Looping over all entities")
+		s.LoopOnce()
+		return
+	}
+	parts, err := pr.Partitions(n)
+	if err != nil {
+		x.LogErr(log, err).Error("While partitioning store")
+		return
+	}
+
+	var total uint64
+	var wg sync.WaitGroup
+	for _, part := range parts {
+		wg.Add(1)
+		go func(part store.Partition) {
+			defer wg.Done()
+			n := s.scanPartition(pr, part)
+			atomic.AddUint64(&total, n)
+		}(part)
+	}
+	wg.Wait()
+	log.WithField("total", total).WithField("partitions", len(parts)).
+		Info("Reached end of partitioned cycle")
+}
+
+// scanPartition sends all the entities in part to the server, returning
+// the number of entities found.
+func (s *Server) scanPartition(pr store.Partitioner, part store.Partition) uint64 {
+	var total uint64
+	cursor := ""
+	ch := make(chan x.Entity, 1000)
+	for {
+		found, next, err := pr.IteratePartition(part, cursor, 1000, ch)
+		s.forward(ch, nil)
+		if err != nil {
+			x.LogErr(log, err).WithField("partition", part).
+				Error("While iterating partition")
+			return total
+		}
+		if found == 0 {
+			return total
+		}
+		log.WithFields(logrus.Fields{
+			"num_processed": found,
+			"partition":     part,
+			"cursor":        next,
+		}).Debug("Iteration chunk done")
+		total += uint64(found)
+		cursor = next
+	}
+}
+
+// LoopSince re-indexes only the entities with instructions committed after
+// nanoTs, if the store implements store.SinceIterator. Otherwise, it falls
+// back to LoopOnce. Returns the unix nano ts at which the loop started,
+// to be passed to the next call, less an allowance for commits in flight
+// and clock skew across servers. On errors, nanoTs is returned back, so
+// the next call covers the same entities again.
+func (s *Server) LoopSince(nanoTs int64) int64 {
+	start := time.Now().UnixNano()
+	si, ok := store.Get().(store.SinceIterator)
+	if !ok {
+		log.Warn("Store can't iterate since a ts. Looping over all entities")
+		s.LoopOnce()
+		return start
+	}
+
+	var total uint64
+	cursor := ""
+	ch := make(chan x.Entity, 1000)
+	for {
+		found, next, err := si.IterateSince(nanoTs, cursor, 1000, ch)
+		s.forward(ch, nil)
+		if err != nil {
+			x.LogErr(log, err).Error("While iterating since")
+			return nanoTs
+		}
+		if found == 0 {
+			log.WithField("total", total).WithField("since", nanoTs).
+				Info("Reached end of changes")
+			return start
+		}
+		log.WithFields(logrus.Fields{
+			"num_processed": found,
+			"cursor":        next,
+		}).Debug("Iteration chunk done")
+		total += uint64(found)
+		cursor = next
+	}
+}
+
+// InfiniteLoopSince does a full cycle over all the entities first, and
+// then only re-indexes the entities changed since the previous cycle
+// started, less overlap, waiting for wait duration after each cycle.
+func (s *Server) InfiniteLoopSince(wait, overlap time.Duration) {
+	since := time.Now().UnixNano()
+	s.LoopOnce()
+	for {
+		log.Debug("Sleeping...")
+		time.Sleep(wait)
+		since = s.LoopSince(since - int64(overlap))
+	}
+}
+
+// Finish waits for all the pending entities to be regenerated, and their
+// docs to be indexed.
 func (s *Server) Finish() {
 	close(s.ch)
 	s.wg.Wait()
+	s.batch.close()
 }
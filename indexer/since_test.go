@@ -0,0 +1,57 @@
+package indexer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aslanides/gocrud/drivers/memsearch"
+	"github.com/aslanides/gocrud/req"
+	"github.com/aslanides/gocrud/store"
+)
+
+func TestLoopSince(t *testing.T) {
+	dir, err := ioutil.TempDir("", "since")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store.Get().Init(dir)
+
+	c := req.NewContext(10)
+	put := func(from, to int) {
+		for i := from; i < to; i++ {
+			if err := store.NewUpdate("S", fmt.Sprintf("s%d", i)).SetSource("t").
+				Set("v", i).Execute(c); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	put(0, 5)
+	since := time.Now().UnixNano()
+	put(5, 8)
+	put(6, 7) // Modified again.
+
+	engine := new(memsearch.MemSearch)
+	engine.Init()
+	p := NewPipeline(engine)
+	p.Register("S", echoIndexer{})
+	s := p.NewServer(100, 2)
+	next := s.LoopSince(since)
+	s.Finish()
+
+	if next <= since {
+		t.Errorf("Expected next ts after %v. Found: %v", since, next)
+	}
+	docs := engine.All()
+	if len(docs) != 3 {
+		t.Fatalf("Expected docs for s5 to s7. Found: %+v", docs)
+	}
+	for _, doc := range docs {
+		if doc.Id < "s5" {
+			t.Errorf("Unexpected doc: %+v", doc)
+		}
+	}
+}
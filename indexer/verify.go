@@ -0,0 +1,233 @@
+package indexer
+
+import (
+	"encoding/json"
+	"errors"
+	"reflect"
+
+	"github.com/aslanides/gocrud/search"
+	"github.com/aslanides/gocrud/store"
+	"github.com/aslanides/gocrud/x"
+)
+
+// Report lists the entities whose docs were found inconsistent by Verify.
+type Report struct {
+	Checked   int        // Entities in store, with an indexer registered.
+	Skipped   int        // Entities whose docs couldn't be regenerated.
+	Missing   []x.Entity // Doc not found in search engine.
+	Stale     []x.Entity // Doc older than the latest instruction for entity.
+	Orphaned  []x.Entity // Doc found, but entity is deleted, or not in store.
+	Divergent []x.Entity // Doc up to date, but differs from regenerated doc.
+	Repaired  int
+}
+
+// Consistent returns true if no inconsistencies were found.
+func (r *Report) Consistent() bool {
+	return len(r.Missing) == 0 && len(r.Stale) == 0 &&
+		len(r.Orphaned) == 0 && len(r.Divergent) == 0
+}
+
+// Verify walks over all the entities in the store, regenerates their docs,
+// and compares them with the docs held by the search engine. Docs of the
+// kinds registered, for which no entity was found in the store, are
+// reported as orphaned. If repair is set, regenerated docs are indexed,
+// and orphaned docs deleted. Note that indexers adding values which change
+// on every regeneration, like the current time, would have their docs
+// reported as divergent. Uses the default pipeline.
+func Verify(repair bool) (*Report, error) {
+	return Default.Verify(repair)
+}
+
+// Verify works like the package level Verify, using the indexers and
+// search engine of p.
+func (p *Pipeline) Verify(repair bool) (*Report, error) {
+	engine := p.searchEngine()
+	if engine == nil {
+		return nil, errors.New("No search engine found")
+	}
+	r := new(Report)
+
+	ch := make(chan x.Entity, 1000) // Iterate sends at most 1000 entities.
+	from := ""
+	var prev map[x.Entity]bool // Entities of the previous chunk.
+	for {
+		found, last, err := store.Get().Iterate(from, 1000, ch)
+		if err != nil {
+			x.LogErr(log, err).Error("While iterating")
+			return r, err
+		}
+		chunk := make(map[x.Entity]bool)
+		for len(ch) > 0 {
+			e := <-ch
+			if prev[e] || chunk[e] {
+				continue
+			}
+			chunk[e] = true
+			if err := p.verify(engine, e, r, repair); err != nil {
+				return r, err
+			}
+		}
+		prev = chunk
+		// Iteration starts from the last entity of the previous chunk.
+		if found == 0 || (found == 1 && len(from) > 0 && last.Id == from) {
+			break
+		}
+		from = last.Id
+	}
+
+	for _, kind := range p.Kinds() {
+		if err := p.findOrphans(engine, kind, r, repair); err != nil {
+			return r, err
+		}
+	}
+	log.WithField("report", r).Info("Verified search engine against store")
+	return r, nil
+}
+
+func (p *Pipeline) verify(engine search.Engine, e x.Entity, r *Report,
+	repair bool) error {
+
+	idxr, ok := p.Get(e.Kind)
+	if !ok {
+		return nil
+	}
+	r.Checked += 1
+	doc, ok := regenerateDoc(idxr, e, p.retrySettings())
+	if !ok {
+		r.Skipped += 1
+		return nil
+	}
+
+	cur, err := engine.Get(e.Kind, e.Id)
+	if err == search.ErrNotFound {
+		if doc.Deleted {
+			return nil
+		}
+		r.Missing = append(r.Missing, e)
+		if repair {
+			p.repair(engine, doc, cur, r)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if doc.Deleted {
+		r.Orphaned = append(r.Orphaned, e)
+		if repair {
+			p.repair(engine, doc, cur, r)
+		}
+		return nil
+	}
+
+	latest, err := latestTs(e.Id)
+	if err != nil {
+		return err
+	}
+	switch {
+	case cur.NanoTs < latest:
+		r.Stale = append(r.Stale, e)
+	case !sameData(cur.Data, doc.Data):
+		r.Divergent = append(r.Divergent, e)
+	default:
+		return nil
+	}
+	if repair {
+		p.repair(engine, doc, cur, r)
+	}
+	return nil
+}
+
+// findOrphans pages over all the docs of kind in search engine, looking up
+// their entities in the store, to find the docs whose entities are gone.
+func (p *Pipeline) findOrphans(engine search.Engine, kind string,
+	r *Report, repair bool) error {
+
+	cursor := ""
+	for {
+		q := engine.NewQuery(kind).Limit(1000)
+		if len(cursor) > 0 {
+			q = q.After(cursor)
+		}
+		docs, next, err := q.RunPage()
+		if err != nil {
+			return err
+		}
+		if len(docs) == 0 {
+			return nil
+		}
+		for _, cur := range docs {
+			e := x.Entity{Kind: cur.Kind, Id: cur.Id}
+			found, err := inStore(e)
+			if err != nil {
+				return err
+			}
+			if found {
+				continue // Checked by verify.
+			}
+			r.Orphaned = append(r.Orphaned, e)
+			if repair {
+				del := x.Doc{Kind: e.Kind, Id: e.Id, Deleted: true}
+				p.repair(engine, del, cur, r)
+			}
+		}
+		cursor = next
+	}
+}
+
+// repair indexes doc, with a version newer than the current doc, if any.
+func (p *Pipeline) repair(engine search.Engine, doc, cur x.Doc, r *Report) {
+	if doc.NanoTs <= cur.NanoTs {
+		doc.NanoTs = cur.NanoTs + 1
+	}
+	indexDocs([]x.Doc{doc}, oneByOne(engine), p.retrySettings())
+	r.Repaired += 1
+}
+
+// inStore returns true if the store holds instructions for entity.
+func inStore(e x.Entity) (bool, error) {
+	its, err := store.Instructions(e.Id)
+	if err != nil {
+		return false, err
+	}
+	for _, it := range its {
+		if it.SubjectType == e.Kind {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// latestTs returns the timestamp of the latest instruction for entity.
+func latestTs(id string) (int64, error) {
+	its, err := store.Instructions(id)
+	if err != nil {
+		return 0, err
+	}
+	var ts int64
+	for _, it := range its {
+		if it.NanoTs > ts {
+			ts = it.NanoTs
+		}
+	}
+	return ts, nil
+}
+
+// sameData compares doc data after a round trip via JSON, so numbers and
+// structs compare the same as they would once read back from the engine.
+func sameData(a, b interface{}) bool {
+	var na, nb interface{}
+	ba, err := json.Marshal(a)
+	if err != nil {
+		return false
+	}
+	bb, err := json.Marshal(b)
+	if err != nil {
+		return false
+	}
+	if json.Unmarshal(ba, &na) != nil || json.Unmarshal(bb, &nb) != nil {
+		return false
+	}
+	return reflect.DeepEqual(na, nb)
+}
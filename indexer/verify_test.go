@@ -0,0 +1,110 @@
+package indexer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aslanides/gocrud/drivers/memsearch"
+	"github.com/aslanides/gocrud/req"
+	"github.com/aslanides/gocrud/store"
+	"github.com/aslanides/gocrud/x"
+)
+
+func TestVerify(t *testing.T) {
+	dir, err := ioutil.TempDir("", "verify")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store.Get().Init(dir)
+
+	c := req.NewContext(10)
+	for i := 0; i < 5; i++ {
+		if err := store.NewUpdate("V", fmt.Sprintf("v%d", i)).SetSource("t").
+			Set("n", i).Execute(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	engine := new(memsearch.MemSearch)
+	engine.Init()
+	p := NewPipeline(engine)
+	d := NewDeclarative()
+	p.Register("V", d)
+	regen := func(id string) x.Doc {
+		doc, err := d.RegenerateE(x.Entity{Kind: "V", Id: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return doc
+	}
+
+	// v0 is in sync, and v1 missing.
+	engine.Update(regen("v0"))
+	stale := regen("v2")
+	stale.NanoTs = 1
+	engine.Update(stale)
+	divergent := regen("v3")
+	divergent.Data.(map[string]interface{})["n"] = 99
+	engine.Update(divergent)
+	engine.Update(regen("v4"))
+	if err := store.NewUpdate("V", "v4").SetSource("t").MarkDeleted().
+		Execute(c); err != nil {
+		t.Fatal(err)
+	}
+	engine.Update(x.Doc{Kind: "V", Id: "ghost", NanoTs: time.Now().UnixNano()})
+
+	r, err := p.Verify(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(name string, found []x.Entity, ids ...string) {
+		if len(found) != len(ids) {
+			t.Errorf("Expected %v: %v. Found: %v", name, ids, found)
+			return
+		}
+		for i, id := range ids {
+			if found[i].Id != id {
+				t.Errorf("Expected %v: %v. Found: %v", name, ids, found)
+			}
+		}
+	}
+	check("missing", r.Missing, "v1")
+	check("stale", r.Stale, "v2")
+	check("divergent", r.Divergent, "v3")
+	check("orphaned", r.Orphaned, "v4", "ghost")
+	if r.Checked != 5 || r.Repaired != 5 {
+		t.Errorf("Unexpected report: %+v", r)
+	}
+
+	r, err = p.Verify(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !r.Consistent() {
+		t.Errorf("Expected consistent after repair. Found: %+v", r)
+	}
+	if n := len(engine.All()); n != 4 {
+		t.Errorf("Expected docs for v0 to v3. Found: %v", n)
+	}
+
+	// Instructions of v00 are matched by prefix in leveldb.
+	if err := store.NewUpdate("V", "v00").SetSource("t").Set("n", 0).
+		Execute(c); err != nil {
+		t.Fatal(err)
+	}
+	ts0, err := latestTs("v0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts00, err := latestTs("v00")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts0 >= ts00 {
+		t.Errorf("Expected v0 to be older than v00. Found: %v, %v", ts0, ts00)
+	}
+}
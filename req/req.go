@@ -5,7 +5,13 @@
 // to assign to new entities, and setting the storage system.
 package req
 
-import "github.com/aslanides/gocrud/x"
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aslanides/gocrud/x"
+)
 
 var log = x.Log("req")
 
@@ -13,6 +19,48 @@ type Context struct {
 	NumCharsUnique int // 62^num unique strings
 	Updates        chan x.Entity
 	HasIndexer     bool
+
+	overflow Overflow
+	timeout  time.Duration
+	spill    SpillQueue
+
+	sendOnce sync.Once
+	sendLock chan struct{} // Held while sending, so numbering follows order.
+	enqueued uint64
+	dequeued uint64
+	dropped  uint64
+	spilled  uint64
+	drained  uint64
+}
+
+// Overflow decides what Enqueue does, when Updates is full because the
+// indexer has fallen behind.
+type Overflow int
+
+const (
+	// OverflowBlock blocks until there's space in Updates. This is the
+	// default.
+	OverflowBlock Overflow = iota
+
+	// OverflowDrop blocks for up to the timeout, and then drops the update.
+	// Dropped entities are only re-indexed by indexer.Server.
+	OverflowDrop
+
+	// OverflowSpill blocks for up to the timeout, and then pushes the update
+	// to the spill queue, from which the indexer drains it later.
+	OverflowSpill
+)
+
+// Stats are the metrics for the updates sent via Enqueue.
+type Stats struct {
+	Depth      int    // Updates waiting in the channel.
+	Capacity   int    // Buffer size of the channel.
+	SpillDepth int    // Updates waiting in the spill queue.
+	Enqueued   uint64 // Sent over the channel, including the drained ones.
+	Dequeued   uint64 // Received by the indexer.
+	Dropped    uint64
+	Spilled    uint64
+	Drained    uint64 // Moved from the spill queue to the channel.
 }
 
 func NewContext(numChars int) *Context {
@@ -30,3 +78,180 @@ func NewContextWithUpdates(numChars, buffer int) *Context {
 	ctx.HasIndexer = true
 	return ctx
 }
+
+// SetOverflow sets what Enqueue does when Updates is full, and how long it
+// blocks for before doing so. The timeout is ignored for OverflowBlock, and
+// can be zero to not block at all. Call SetSpillQueue before setting
+// OverflowSpill. Should be called before any updates are sent.
+func (c *Context) SetOverflow(o Overflow, timeout time.Duration) {
+	if o == OverflowSpill && c.spill == nil {
+		log.Fatal("No spill queue set")
+		return
+	}
+	if timeout < 0 {
+		log.WithField("timeout", timeout).Fatal("Invalid overflow timeout")
+		return
+	}
+	c.overflow = o
+	c.timeout = timeout
+}
+
+// SetSpillQueue sets the queue which takes the updates that don't fit in
+// Updates, for OverflowSpill.
+func (c *Context) SetSpillQueue(q SpillQueue) {
+	c.spill = q
+}
+
+func (c *Context) lock() {
+	c.lockBefore(nil)
+}
+
+// lockBefore acquires the send lock, unless the timer fires first. A nil
+// timer waits for the lock.
+func (c *Context) lockBefore(timer <-chan time.Time) bool {
+	c.sendOnce.Do(func() {
+		c.sendLock = make(chan struct{}, 1)
+	})
+	select {
+	case c.sendLock <- struct{}{}:
+		return true
+	case <-timer:
+		return false
+	}
+}
+
+func (c *Context) unlock() {
+	<-c.sendLock
+}
+
+// Enqueue sends the entity over Updates, for the indexer to process.
+// Entities are numbered in the order they're sent, so the indexer can
+// tell when all the updates sent before a point have been processed.
+// If Updates is full, the overflow setting decides whether to block, drop
+// or spill the update.
+func (c *Context) Enqueue(e x.Entity) {
+	if c.overflow == OverflowBlock {
+		c.lock()
+		defer c.unlock()
+		c.Updates <- e
+		atomic.AddUint64(&c.enqueued, 1)
+		return
+	}
+
+	if c.send(e) {
+		return
+	}
+	if c.overflow == OverflowSpill {
+		err := c.spill.Push(e)
+		if err == nil {
+			atomic.AddUint64(&c.spilled, 1)
+			return
+		}
+		x.LogErr(log, err).WithField("entity", e).Error("While spilling update")
+	}
+	atomic.AddUint64(&c.dropped, 1)
+	log.WithField("entity", e).Warn("Dropped update")
+}
+
+// send tries to send the entity over Updates, for up to the timeout.
+func (c *Context) send(e x.Entity) bool {
+	var timer <-chan time.Time // Nil, with no timeout.
+	if c.timeout > 0 {
+		t := time.NewTimer(c.timeout)
+		defer t.Stop()
+		timer = t.C
+	}
+	// Holders of the lock don't block indefinitely, so wait for it even
+	// with no timeout.
+	if !c.lockBefore(timer) {
+		return false
+	}
+	defer c.unlock()
+
+	if timer == nil {
+		select {
+		case c.Updates <- e:
+		default:
+			return false
+		}
+	} else {
+		select {
+		case c.Updates <- e:
+		case <-timer:
+			return false
+		}
+	}
+	atomic.AddUint64(&c.enqueued, 1)
+	return true
+}
+
+// DrainSpill moves up to max updates from the spill queue to Updates, for
+// as long as there's space in the channel. Returns the number moved. This
+// is run periodically by the indexer.
+func (c *Context) DrainSpill(max int) (moved int) {
+	if c.spill == nil {
+		return 0
+	}
+	c.lock()
+	defer c.unlock()
+	for moved < max && len(c.Updates) < cap(c.Updates) {
+		e, ok, err := c.spill.Pop()
+		if err != nil {
+			x.LogErr(log, err).Error("While draining spill queue")
+			return moved
+		}
+		if !ok {
+			return moved
+		}
+		// Only this routine sends while the lock is held, so this won't block.
+		c.Updates <- e
+		atomic.AddUint64(&c.enqueued, 1)
+		atomic.AddUint64(&c.drained, 1)
+		moved += 1
+	}
+	return moved
+}
+
+// NumSpilled returns the number of entities pushed to the spill queue.
+func (c *Context) NumSpilled() uint64 {
+	return atomic.LoadUint64(&c.spilled)
+}
+
+// NumDrained returns the number of entities moved from the spill queue to
+// Updates.
+func (c *Context) NumDrained() uint64 {
+	return atomic.LoadUint64(&c.drained)
+}
+
+// Stats returns the current queue depths and counters.
+func (c *Context) Stats() Stats {
+	s := Stats{
+		Depth:    len(c.Updates),
+		Capacity: cap(c.Updates),
+		Enqueued: c.NumEnqueued(),
+		Dequeued: c.NumDequeued(),
+		Dropped:  atomic.LoadUint64(&c.dropped),
+		Spilled:  c.NumSpilled(),
+		Drained:  c.NumDrained(),
+	}
+	if c.spill != nil {
+		s.SpillDepth = c.spill.Len()
+	}
+	return s
+}
+
+// NumEnqueued returns the number of entities sent via Enqueue.
+func (c *Context) NumEnqueued() uint64 {
+	return atomic.LoadUint64(&c.enqueued)
+}
+
+// MarkDequeued must be called by the receiver of Updates, for each entity
+// received, in the order received. Returns the number of the entity.
+func (c *Context) MarkDequeued() uint64 {
+	return atomic.AddUint64(&c.dequeued, 1)
+}
+
+// NumDequeued returns the number of entities received from Updates.
+func (c *Context) NumDequeued() uint64 {
+	return atomic.LoadUint64(&c.dequeued)
+}
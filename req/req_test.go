@@ -0,0 +1,79 @@
+package req
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aslanides/gocrud/x"
+)
+
+func TestOverflowDrop(t *testing.T) {
+	c := NewContextWithUpdates(10, 2)
+	c.SetOverflow(OverflowDrop, 10*time.Millisecond)
+	for _, id := range []string{"a", "b", "c"} {
+		c.Enqueue(x.Entity{Kind: "K", Id: id})
+	}
+	s := c.Stats()
+	if s.Depth != 2 || s.Capacity != 2 || s.Enqueued != 2 || s.Dropped != 1 {
+		t.Errorf("Unexpected stats: %+v", s)
+	}
+
+	// Space freed up before the timeout.
+	go func() {
+		time.Sleep(time.Millisecond)
+		<-c.Updates
+	}()
+	c.SetOverflow(OverflowDrop, time.Second)
+	c.Enqueue(x.Entity{Kind: "K", Id: "d"})
+	if s := c.Stats(); s.Enqueued != 3 || s.Dropped != 1 {
+		t.Errorf("Unexpected stats: %+v", s)
+	}
+}
+
+func TestOverflowSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "spill")
+
+	c := NewContextWithUpdates(10, 1)
+	c.SetSpillQueue(NewFileSpillQueue(path))
+	c.SetOverflow(OverflowSpill, 0)
+	ids := []string{"a", "b", "c"}
+	for _, id := range ids {
+		c.Enqueue(x.Entity{Kind: "K", Id: id})
+	}
+	s := c.Stats()
+	if s.Depth != 1 || s.Spilled != 2 || s.SpillDepth != 2 || s.Dropped != 0 {
+		t.Errorf("Unexpected stats: %+v", s)
+	}
+
+	// Left over by a previous process.
+	if n := NewFileSpillQueue(path).Len(); n != 2 {
+		t.Errorf("Expected 2 entries in file. Found: %v", n)
+	}
+
+	var got []string
+	for len(got) < len(ids) {
+		e := <-c.Updates
+		got = append(got, e.Id)
+		c.DrainSpill(10)
+	}
+	for i, id := range ids {
+		if got[i] != id {
+			t.Errorf("Expected %v. Found: %v", ids, got)
+		}
+	}
+	s = c.Stats()
+	if s.SpillDepth != 0 || s.Drained != 2 || s.Enqueued != 3 {
+		t.Errorf("Unexpected stats: %+v", s)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Size() != 0 {
+		t.Errorf("Expected truncated spill file. Found: %v, %v", fi, err)
+	}
+}
@@ -0,0 +1,136 @@
+package req
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/aslanides/gocrud/x"
+)
+
+// SpillQueue holds the updates which didn't fit in Context.Updates, until
+// they're drained by the indexer.
+type SpillQueue interface {
+	Push(e x.Entity) error
+	// Pop returns false if the queue is empty.
+	Pop() (x.Entity, bool, error)
+	Len() int
+}
+
+// FileSpillQueue keeps the spilled updates in a file, one JSON object per
+// line. The file is truncated once drained. Updates left in the file by a
+// previous process are drained too, though the ones already popped before
+// it stopped would be delivered again. That's harmless, as re-indexing an
+// entity regenerates its doc from the store.
+type FileSpillQueue struct {
+	sync.Mutex
+	path   string
+	offset int64 // Of the next entry to pop.
+	n      int
+	loaded bool
+}
+
+// NewFileSpillQueue returns a queue backed by the file at path, which gets
+// created if missing.
+func NewFileSpillQueue(path string) *FileSpillQueue {
+	return &FileSpillQueue{path: path}
+}
+
+// load counts the entries left in the file, on first use.
+func (f *FileSpillQueue) load() error {
+	if f.loaded {
+		return nil
+	}
+	file, err := os.Open(f.path)
+	if os.IsNotExist(err) {
+		f.loaded = true
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		f.n += 1
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	f.loaded = true
+	return nil
+}
+
+func (f *FileSpillQueue) Push(e x.Entity) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	if err := f.load(); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(b, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	f.n += 1
+	return nil
+}
+
+func (f *FileSpillQueue) Pop() (e x.Entity, ok bool, rerr error) {
+	f.Lock()
+	defer f.Unlock()
+	if err := f.load(); err != nil {
+		return e, false, err
+	}
+	if f.n == 0 {
+		return e, false, nil
+	}
+
+	file, err := os.Open(f.path)
+	if err != nil {
+		return e, false, err
+	}
+	defer file.Close()
+	if _, err := file.Seek(f.offset, io.SeekStart); err != nil {
+		return e, false, err
+	}
+	line, err := bufio.NewReader(file).ReadBytes('\n')
+	if err != nil {
+		return e, false, err
+	}
+	if err := json.Unmarshal(line, &e); err != nil {
+		return e, false, err
+	}
+	f.offset += int64(len(line))
+	f.n -= 1
+	if f.n == 0 {
+		f.offset = 0
+		if err := os.Truncate(f.path, 0); err != nil {
+			return e, true, err
+		}
+	}
+	return e, true, nil
+}
+
+func (f *FileSpillQueue) Len() int {
+	f.Lock()
+	defer f.Unlock()
+	if err := f.load(); err != nil {
+		x.LogErr(log, err).Error("While loading spill queue")
+	}
+	return f.n
+}
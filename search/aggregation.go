@@ -0,0 +1,89 @@
+package search
+
+import "time"
+
+// Aggregation types.
+const (
+	AggTerms         = "terms"
+	AggStats         = "stats"
+	AggHistogram     = "histogram"
+	AggDateHistogram = "date_histogram"
+)
+
+// Aggregation describes how docs matched by a query should be summarized.
+// Bucketing aggregations (terms, histogram, date_histogram) can hold
+// sub aggregations, which get computed over the docs in each bucket.
+type Aggregation struct {
+	Type     string
+	Field    string
+	Size     int           // Max number of term buckets. Defaults to 10.
+	Interval int64         // Bucket width for histogram.
+	Period   time.Duration // Bucket width for date_histogram.
+	Subs     map[string]*Aggregation
+}
+
+// Terms creates an aggregation with one bucket per distinct field value,
+// ordered by descending doc count. For e.g. posts per tag.
+func Terms(field string) *Aggregation {
+	return &Aggregation{Type: AggTerms, Field: field, Size: 10}
+}
+
+// Stats creates an aggregation computing count, min, max, avg and sum
+// over numeric field values.
+func Stats(field string) *Aggregation {
+	return &Aggregation{Type: AggStats, Field: field}
+}
+
+// Histogram creates an aggregation bucketing numeric field values into
+// intervals of the given width.
+func Histogram(field string, interval int64) *Aggregation {
+	return &Aggregation{Type: AggHistogram, Field: field, Interval: interval}
+}
+
+// DateHistogram creates an aggregation bucketing field values, stored as
+// milliseconds since epoch (like creation_ms), into periods of given length.
+func DateHistogram(field string, period time.Duration) *Aggregation {
+	return &Aggregation{Type: AggDateHistogram, Field: field, Period: period}
+}
+
+// Top limits the number of term buckets returned.
+func (a *Aggregation) Top(size int) *Aggregation {
+	a.Size = size
+	return a
+}
+
+// Sub adds a named sub aggregation, to be computed for each bucket.
+func (a *Aggregation) Sub(name string, sub *Aggregation) *Aggregation {
+	if a.Subs == nil {
+		a.Subs = make(map[string]*Aggregation)
+	}
+	a.Subs[name] = sub
+	return a
+}
+
+// AggregationResult holds the result of one aggregation. Stats is set for
+// stats aggregations, and Buckets for the bucketing ones.
+type AggregationResult struct {
+	Stats   *StatsResult
+	Buckets []Bucket
+}
+
+// StatsResult stores the result of a stats aggregation. All values are
+// zero if no numeric field values were found.
+type StatsResult struct {
+	Count int64
+	Min   float64
+	Max   float64
+	Avg   float64
+	Sum   float64
+}
+
+// Bucket stores the docs count, and sub aggregation results for a bucket.
+// Key is the field value for terms, with numbers as float64. It's the
+// lower bound of the interval for histogram, and the start of period
+// in milliseconds since epoch for date_histogram, both as int64.
+type Bucket struct {
+	Key   interface{}
+	Count int64
+	Subs  map[string]*AggregationResult
+}
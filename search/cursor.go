@@ -0,0 +1,48 @@
+package search
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+)
+
+var ErrInvalidCursor = errors.New("Invalid cursor")
+
+// ErrRelevanceCursor is returned for cursors over queries ordered by
+// relevance, as scores aren't stable enough to page over.
+var ErrRelevanceCursor = errors.New("Cursor over relevance ordering isn't supported")
+
+// Cursor marks the position of the last doc returned by Query.RunPage.
+// It stores the values the results were sorted by, along with kind and id
+// of the doc, which are used to break ties between docs with equal values.
+type Cursor struct {
+	Values []interface{} `json:"v,omitempty"`
+	Kind   string        `json:"k"`
+	Id     string        `json:"i"`
+}
+
+// Encode converts the cursor to an opaque string, safe to use in urls.
+func (c Cursor) Encode() string {
+	b, err := json.Marshal(c)
+	if err != nil {
+		log.WithField("cursor", c).Error("While encoding cursor")
+		return ""
+	}
+	return base64.URLEncoding.EncodeToString(b)
+}
+
+// DecodeCursor parses the string generated by Cursor.Encode. Note that
+// numeric values would be decoded as float64.
+func DecodeCursor(s string) (c Cursor, rerr error) {
+	b, err := base64.URLEncoding.DecodeString(s)
+	if err != nil {
+		return c, ErrInvalidCursor
+	}
+	if err := json.Unmarshal(b, &c); err != nil {
+		return c, ErrInvalidCursor
+	}
+	if len(c.Kind) == 0 || len(c.Id) == 0 {
+		return c, ErrInvalidCursor
+	}
+	return c, nil
+}
@@ -0,0 +1,32 @@
+package search
+
+import "strings"
+
+// Positions of docs missing a sort field, as set via Query.Missing.
+const (
+	MissingLast  = "_last"
+	MissingFirst = "_first"
+)
+
+// SortKey is one of the keys passed on to Query.Order.
+type SortKey struct {
+	Field string
+	Desc  bool
+}
+
+// ParseOrder converts keys of the form "field" or "-field" to sort keys.
+// Empty keys are skipped.
+func ParseOrder(keys ...string) (sks []SortKey) {
+	for _, key := range keys {
+		sk := SortKey{Field: key}
+		if strings.HasPrefix(key, "-") {
+			sk.Field = key[1:]
+			sk.Desc = true
+		}
+		if len(sk.Field) == 0 {
+			continue
+		}
+		sks = append(sks, sk)
+	}
+	return sks
+}
@@ -7,10 +7,22 @@
 // application level.
 package search
 
-import "github.com/aslanides/gocrud/x"
+import (
+	"errors"
+
+	"github.com/aslanides/gocrud/x"
+)
 
 var log = x.Log("search")
 
+// ErrConflict should be returned by engines when a doc isn't updated or
+// deleted, because the engine already has a newer version of it.
+var ErrConflict = errors.New("version conflict")
+
+// ErrNotFound should be returned by engines from Get, when there's no doc
+// with the given kind and id.
+var ErrNotFound = errors.New("doc not found")
+
 // All the search operations are run via this Search interface.
 // Implement this interface to add support for a search engine.
 // Note that the term Entity is being used interchangeably with
@@ -20,7 +32,8 @@ var log = x.Log("search")
 // generating the right query for the engine, and then running it.
 type Query interface {
 	// NewAndFilter would return a filter which would run AND operation
-	// among individual filter queries.
+	// among individual filter queries. It can be called multiple times,
+	// along with NewOrFilter; results must then match all of them.
 	NewAndFilter() FilterQuery
 
 	// NewOrFilter would return a filter which would run OR operation
@@ -34,17 +47,59 @@ type Query interface {
 	// Limit would limit the number of results to num.
 	Limit(num int) Query
 
-	// Order would sort the results by field in ascending order.
+	// Match would run full text search for text over field. Docs need to
+	// match at least one of the terms in text, and are ordered by
+	// relevance score, unless Order is set. Calling Match multiple times
+	// requires docs to match all of them, adding up their scores.
+	Match(field, text string) Query
+
+	// Order would sort the results by fields in ascending order.
 	// A "-field" can be provided to sort results in descending order.
-	Order(field string) Query
+	// Later fields are used to order docs with equal values for earlier
+	// ones. For e.g. Order("-activity", "creation_ms").
+	Order(fields ...string) Query
+
+	// Missing sets whether docs missing an Order field, or having a null
+	// value for it, are placed before (MissingFirst) or after (MissingLast)
+	// the rest, irrespective of sort direction. Defaults to MissingLast.
+	Missing(position string) Query
+
+	// After would continue results from the position marked by cursor, as
+	// returned by RunPage. Unlike From, this stays fast on deep pages, and
+	// isn't affected by docs being updated in between. Results are always
+	// ordered by doc id, after the Order fields, to keep pagination stable.
+	// Queries with Match, but no Order, are ordered by relevance, which
+	// can't be paged over. Running them returns ErrRelevanceCursor.
+	After(cursor string) Query
 
 	// Run the generated query, providing resulting documents and error, if any.
 	Run() ([]x.Doc, error)
 
+	// RunPage runs the query like Run, and also returns the cursor marking
+	// the last doc, to be passed on to After to fetch the next page. Cursor
+	// is empty if no docs were found.
+	RunPage() ([]x.Doc, string, error)
+
 	// Count the number of results that would be generated. Don't run the query.
 	Count() (int64, error)
+
+	// Aggregate adds a named aggregation, to be computed over all the docs
+	// matching the query, via RunAggregations.
+	Aggregate(name string, agg *Aggregation) Query
+
+	// RunAggregations runs the query, and returns the results of all the
+	// aggregations added, keyed by their names. From and Limit are ignored.
+	RunAggregations() (map[string]*AggregationResult, error)
 }
 
+// Range operators, to be used with FilterQuery.AddRange.
+const (
+	Gt  = "gt"
+	Gte = "gte"
+	Lt  = "lt"
+	Lte = "lte"
+)
+
 type FilterQuery interface {
 	// AddExact would do exact full string, int, etc. filtering. Also called
 	// term filtering by some engines.
@@ -53,6 +108,37 @@ type FilterQuery interface {
 	// AddRegex would do regular expression filtering.
 	// Naturally, requires value to be string.
 	AddRegex(field string, value string) FilterQuery
+
+	// AddRange would filter by comparing field against value, using one of
+	// the range operators Gt, Gte, Lt or Lte. Call it twice to bound the
+	// range on both sides.
+	AddRange(field string, op string, value interface{}) FilterQuery
+
+	// AddExists would only let through docs which have the field set.
+	AddExists(field string) FilterQuery
+
+	// AddMissing would only let through docs which don't have the field set.
+	AddMissing(field string) FilterQuery
+
+	// AddIn would match if field value is exactly equal to any of the values.
+	AddIn(field string, values ...interface{}) FilterQuery
+
+	// Not returns a FilterQuery which negates the next filter added to it,
+	// and hands back the original FilterQuery for further chaining. If the
+	// next call is And or Or instead, the returned group is negated. For e.g.
+	// AddRange("activity", Gt, 10).Not().AddExact("tags", "spam")
+	Not() FilterQuery
+
+	// And adds a nested filter group, which would run AND operation among
+	// the filters added to it, and returns that group. Groups can be nested
+	// to arbitrary depth. For e.g. kind = Post AND (tag = cat OR tag = dog):
+	//  f := q.NewAndFilter().AddExact("kind", "Post")
+	//  f.Or().AddExact("tag", "cat").AddExact("tag", "dog")
+	And() FilterQuery
+
+	// Or adds a nested filter group, which would run OR operation among
+	// the filters added to it, and returns that group.
+	Or() FilterQuery
 }
 
 // Engine provides the interface to be implemented to support search engines.
@@ -63,17 +149,42 @@ type Engine interface {
 
 	// Update doc into index. Note that doc.NanoTs should be utilized to implement
 	// any sort of versioning facility provided by the search engine, to avoid
-	// overwriting a newer doc by an older doc.
+	// overwriting a newer doc by an older doc. ErrConflict should be returned
+	// in that case.
 	Update(x.Doc) error
 
+	// Delete removes the doc from index. Similar to Update, nanoTs should be
+	// used for versioning, so a newer doc isn't deleted by an older delete,
+	// and an older doc updated after the delete doesn't resurface. Returns
+	// ErrConflict if a newer doc exists.
+	Delete(kind, id string, nanoTs int64) error
+
+	// DeleteByQuery removes all docs matched by the query, created via
+	// NewQuery. From, Limit and Order are ignored. Memsearch and bleve
+	// delete each doc as via Delete, with a version just past the one
+	// matched, so docs updated after the query ran are skipped. Elastic
+	// Search uses its delete by query api, which isn't versioned.
+	DeleteByQuery(q Query) error
+
+	// Get returns the doc with the given kind and id, as currently indexed,
+	// or ErrNotFound.
+	Get(kind, id string) (x.Doc, error)
+
 	// NewQuery creates the query encapsulator, restricting results by given kind.
 	NewQuery(kind string) Query
 }
 
-// Search docs where:
-// Where("field =", "something") or
-// Where("field >", "something") or
-// Where("field <", "something")
+// BulkEngine is implemented by engines which can index multiple docs in one
+// request. The indexer uses it when available, to batch regenerated docs.
+type BulkEngine interface {
+	Engine
+
+	// UpdateMany updates the docs, or deletes the ones marked Deleted, with
+	// the same versioning as Update and Delete. It returns one error per doc,
+	// nil if that doc succeeded, so one version conflict doesn't fail the
+	// rest of the batch.
+	UpdateMany(docs []x.Doc) []error
+}
 
 var dengine Engine
 
@@ -91,6 +202,11 @@ func Register(name string, driver Engine) {
 	dengine = driver
 }
 
+// Registered returns true if a search engine has been registered.
+func Registered() bool {
+	return dengine != nil
+}
+
 func Get() Engine {
 	if dengine == nil {
 		log.Fatal("No engine registered")
@@ -0,0 +1,109 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"sort"
+
+	"github.com/aslanides/gocrud/x"
+)
+
+// Change is a modification to a predicate of an entity.
+type Change struct {
+	Predicate string      `json:"predicate"`
+	Before    interface{} `json:"before,omitempty"` // Latest value before the change, if any.
+	After     interface{} `json:"after,omitempty"`
+	ObjectId  string      `json:"object_id,omitempty"` // Set for edges to children.
+	NanoTs    int64       `json:"nano_ts"`
+}
+
+// EntityActivity lists the changes made to an entity, in commit order.
+type EntityActivity struct {
+	Kind    string   `json:"kind"`
+	Id      string   `json:"id"`
+	Changes []Change `json:"changes"`
+}
+
+// Activity returns the entities modified by source, with nano ts in
+// [from, to), along with the before and after values of the predicates
+// changed. Entities are ordered by their first change. The before value is
+// the latest one set by any source, so it also reflects changes made by
+// others in between. The store must implement SourceIterator.
+func Activity(source string, from, to int64) ([]EntityActivity, error) {
+	si, ok := Get().(SourceIterator)
+	if !ok {
+		return nil, errors.New("Store can't iterate by source")
+	}
+
+	var order []string
+	changed := make(map[string][]x.Instruction)
+	ch := make(chan x.Instruction, 1000)
+	cursor := ""
+	for {
+		found, next, err := si.IterateSource(source, from, to, cursor, 1000, ch)
+		if err != nil {
+			x.LogErr(log, err).Error("While iterating by source")
+			return nil, err
+		}
+		for len(ch) > 0 {
+			it := <-ch
+			if _, present := changed[it.SubjectId]; !present {
+				order = append(order, it.SubjectId)
+			}
+			changed[it.SubjectId] = append(changed[it.SubjectId], it)
+		}
+		if found == 0 {
+			break
+		}
+		cursor = next
+	}
+
+	result := make([]EntityActivity, 0, len(order))
+	for _, id := range order {
+		its, err := Instructions(id)
+		if err != nil {
+			return nil, err
+		}
+		sort.Sort(x.Its(its))
+		mine := changed[id]
+		sort.Stable(x.Its(mine))
+
+		ea := EntityActivity{Kind: mine[0].SubjectType, Id: id}
+		for _, it := range mine {
+			c, err := toChange(it, its)
+			if err != nil {
+				return nil, err
+			}
+			ea.Changes = append(ea.Changes, c)
+		}
+		result = append(result, ea)
+	}
+	return result, nil
+}
+
+// toChange finds the value the predicate had before the instruction, from
+// all the instructions of the entity, sorted by nano ts.
+func toChange(it x.Instruction, its []x.Instruction) (c Change, rerr error) {
+	c.Predicate, c.ObjectId, c.NanoTs = it.Predicate, it.ObjectId, it.NanoTs
+	if len(it.ObjectId) > 0 {
+		return c, nil
+	}
+	if err := json.Unmarshal(it.Object, &c.After); err != nil {
+		x.LogErr(log, err).Error("While unmarshal")
+		return c, err
+	}
+	for _, prev := range its {
+		if prev.NanoTs >= it.NanoTs {
+			break
+		}
+		if prev.Predicate != it.Predicate || len(prev.ObjectId) > 0 {
+			continue
+		}
+		c.Before = nil
+		if err := json.Unmarshal(prev.Object, &c.Before); err != nil {
+			x.LogErr(log, err).Error("While unmarshal")
+			return c, err
+		}
+	}
+	return c, nil
+}
@@ -0,0 +1,262 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aslanides/gocrud/req"
+	"github.com/aslanides/gocrud/search"
+	"github.com/aslanides/gocrud/x"
+)
+
+// PurgeRecord is the audit record of a purge. It holds ids and counts
+// only, and none of the data removed.
+type PurgeRecord struct {
+	Source       string     `json:"source,omitempty"` // Set by Purge.
+	Root         string     `json:"root,omitempty"`   // Set by PurgeEntity.
+	Cascade      bool       `json:"cascade,omitempty"`
+	Entities     []x.Entity `json:"entities"` // Entities with instructions removed.
+	Instructions int        `json:"instructions"`
+	DocsDeleted  int        `json:"docs_deleted"`
+	Reindexed    int        `json:"reindexed"` // Entities sent to the indexer.
+	At           int64      `json:"at"`        // Unix nano ts, when the purge finished.
+}
+
+// Auditor keeps the audit records of purges.
+type Auditor interface {
+	Record(r PurgeRecord) error
+}
+
+var auditor struct {
+	sync.RWMutex
+	a Auditor
+}
+
+// SetAuditor sets where purges are recorded. Records are always logged,
+// whether an auditor is set or not.
+func SetAuditor(a Auditor) {
+	auditor.Lock()
+	defer auditor.Unlock()
+	auditor.a = a
+}
+
+// FileAuditor appends purge records to a file, one JSON object per line.
+type FileAuditor struct {
+	sync.Mutex
+	path string
+}
+
+// NewFileAuditor returns an auditor writing to the file at path, which gets
+// created if missing.
+func NewFileAuditor(path string) *FileAuditor {
+	return &FileAuditor{path: path}
+}
+
+func (f *FileAuditor) Record(r PurgeRecord) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	f.Lock()
+	defer f.Unlock()
+	file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(b, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Purge physically removes every instruction written by source, from all
+// the entities, unlike MarkDeleted which only hides them. Docs of the
+// entities left with no instructions are deleted from the registered
+// search engine, if any. The rest still have instructions from other
+// sources, and are sent over c to be regenerated by the indexer. The store
+// must implement SourcePurger, or Deleter and Partitioner.
+func Purge(c *req.Context, source string) (*PurgeRecord, error) {
+	if len(source) == 0 {
+		return nil, errors.New("Empty source")
+	}
+	r := &PurgeRecord{Source: source}
+	if sp, ok := Get().(SourcePurger); ok {
+		entities, n, err := sp.PurgeSource(source)
+		if err != nil {
+			x.LogErr(log, err).WithField("source", source).Error("While purging")
+			return nil, err
+		}
+		r.Entities, r.Instructions = entities, n
+		return r, finishPurge(c, r)
+	}
+
+	d, ok := Get().(Deleter)
+	if !ok {
+		return nil, errors.New("Store can't delete instructions")
+	}
+	err := scanEntities(func(e x.Entity) error {
+		its, err := Instructions(e.Id)
+		if err != nil {
+			return err
+		}
+		var drop []x.Instruction
+		for _, it := range its {
+			if it.Source == source {
+				drop = append(drop, it)
+			}
+		}
+		return r.remove(d, e, drop)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return r, finishPurge(c, r)
+}
+
+// PurgeEntity physically removes all the instructions of the entity, and
+// the edge to it from its parent. If cascade is set, its children are
+// purged too, recursively. Docs of the purged entities are deleted from the
+// registered search engine, if any, while the parent, and any children
+// left, are sent over c to be regenerated by the indexer. The store must
+// implement Deleter.
+func PurgeEntity(c *req.Context, id string, cascade bool) (*PurgeRecord, error) {
+	d, ok := Get().(Deleter)
+	if !ok {
+		return nil, errors.New("Store can't delete instructions")
+	}
+	its, err := Instructions(id)
+	if err != nil {
+		return nil, err
+	}
+	if len(its) == 0 {
+		return nil, errors.New("Entity not found")
+	}
+
+	r := &PurgeRecord{Root: id, Cascade: cascade}
+	for _, it := range its {
+		if it.Predicate != "_parent_" {
+			continue
+		}
+		pits, err := Instructions(it.ObjectId)
+		if err != nil {
+			return nil, err
+		}
+		var edges []x.Instruction
+		for _, pit := range pits {
+			if pit.ObjectId == id && pit.Predicate != "_parent_" {
+				edges = append(edges, pit)
+			}
+		}
+		if len(edges) > 0 {
+			parent := x.Entity{Kind: edges[0].SubjectType, Id: it.ObjectId}
+			if err := r.remove(d, parent, edges); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if err := r.purgeTree(d, its, cascade, make(map[string]bool)); err != nil {
+		return nil, err
+	}
+	return r, finishPurge(c, r)
+}
+
+// purgeTree removes the instructions of an entity, and those of its
+// children, if cascade is set.
+func (r *PurgeRecord) purgeTree(d Deleter, its []x.Instruction, cascade bool,
+	seen map[string]bool) error {
+
+	e := x.Entity{Kind: its[0].SubjectType, Id: its[0].SubjectId}
+	if seen[e.Id] {
+		return nil
+	}
+	seen[e.Id] = true
+	if err := r.remove(d, e, its); err != nil {
+		return err
+	}
+	if !cascade {
+		return nil
+	}
+	for _, it := range its {
+		if len(it.ObjectId) == 0 || it.Predicate == "_parent_" {
+			continue
+		}
+		cits, err := Instructions(it.ObjectId)
+		if err != nil {
+			return err
+		}
+		if len(cits) == 0 {
+			continue
+		}
+		if err := r.purgeTree(d, cits, cascade, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *PurgeRecord) remove(d Deleter, e x.Entity, its []x.Instruction) error {
+	if len(its) == 0 {
+		return nil
+	}
+	if err := d.Delete(e.Id, its); err != nil {
+		x.LogErr(log, err).WithField("entity", e).Error("While purging")
+		return err
+	}
+	r.Entities = append(r.Entities, e)
+	r.Instructions += len(its)
+	return nil
+}
+
+// finishPurge deletes the docs of the entities with no instructions left,
+// sends the rest to the indexer, and records the purge with the auditor.
+func finishPurge(c *req.Context, r *PurgeRecord) error {
+	var rerr error
+	now := time.Now().UnixNano()
+	done := make(map[x.Entity]bool)
+	for _, e := range r.Entities {
+		if done[e] {
+			continue
+		}
+		done[e] = true
+		its, err := Instructions(e.Id)
+		if err != nil {
+			x.LogErr(log, err).WithField("entity", e).Error("While retrieving entity")
+			rerr = err
+			continue
+		}
+		if len(its) > 0 {
+			if c.HasIndexer {
+				c.Enqueue(e)
+				r.Reindexed += 1
+			}
+			continue
+		}
+		if !search.Registered() {
+			continue
+		}
+		if err := search.Get().Delete(e.Kind, e.Id, now); err != nil {
+			x.LogErr(log, err).WithField("entity", e).Error("While deleting doc")
+			rerr = err
+			continue
+		}
+		r.DocsDeleted += 1
+	}
+	r.At = time.Now().UnixNano()
+
+	log.WithField("record", r).Info("Purged")
+	auditor.RLock()
+	a := auditor.a
+	auditor.RUnlock()
+	if a != nil {
+		if err := a.Record(*r); err != nil {
+			x.LogErr(log, err).Error("While recording purge")
+			rerr = err
+		}
+	}
+	return rerr
+}
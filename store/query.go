@@ -96,6 +96,23 @@ func Parent(id string) (parentid string, rerr error) {
 	return "", ErrNoParent
 }
 
+// Instructions returns the instructions of entity id. Some stores match
+// ids by prefix in GetEntity, so instructions of other entities are
+// filtered out.
+func Instructions(id string) ([]x.Instruction, error) {
+	its, err := Get().GetEntity(id)
+	if err != nil {
+		return nil, err
+	}
+	var result []x.Instruction
+	for _, it := range its {
+		if it.SubjectId == id {
+			result = append(result, it)
+		}
+	}
+	return result, nil
+}
+
 // NewQuery is the main entrypoint to data store queries. Returns back a Query
 // object pointer, to run read instructions on.
 func NewQuery(id string) *Query {
@@ -191,6 +208,7 @@ func (q *Query) doRun(level, max int, ch chan runResult) {
 				WithField("kind", result.Kind).
 				WithField("_delete_", true).
 				Debug("Discarding due to delete bit")
+			q.discard(childChan, waitTimes)
 			ch <- runResult{Result: new(Result), Err: nil}
 			return
 		}
@@ -208,6 +226,7 @@ func (q *Query) doRun(level, max int, ch chan runResult) {
 				WithField("kind", result.Kind).
 				WithField("predicate", it.Predicate).
 				Debug("Discarding due to predicate filter")
+			q.discard(childChan, waitTimes)
 			ch <- runResult{Result: new(Result), Err: nil}
 			return
 		}
@@ -216,6 +235,7 @@ func (q *Query) doRun(level, max int, ch chan runResult) {
 			o := Object{NanoTs: it.NanoTs, Source: it.Source}
 			if err := json.Unmarshal(it.Object, &o.Value); err != nil {
 				x.LogErr(log, err).Error("While unmarshal")
+				q.discard(childChan, waitTimes)
 				ch <- runResult{Result: nil, Err: err}
 				return
 			}
@@ -272,6 +292,14 @@ func (q *Query) doRun(level, max int, ch chan runResult) {
 	return
 }
 
+// discard waits for the num child routines already started, so they don't
+// block forever on sending their results.
+func (q *Query) discard(childChan chan runResult, num int) {
+	for i := 0; i < num; i++ {
+		<-childChan
+	}
+}
+
 // Run finds the root from the given Query pointer, recursively executes
 // the read operations, and returns back pointer to Result object.
 // Any errors encountered during these stpeps is returned as well.
@@ -0,0 +1,199 @@
+package store
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/aslanides/gocrud/x"
+)
+
+// Rule is a retention rule, deciding which versions of a predicate are kept
+// by Compact. A version is kept if it's one of the last KeepLast versions,
+// or newer than MaxAge. At least one of them must be set. The latest
+// version is always kept.
+type Rule struct {
+	Kind      string // Empty, to match all kinds.
+	Predicate string // Empty, to match all predicates.
+	KeepLast  int
+	MaxAge    time.Duration
+}
+
+var retention struct {
+	sync.RWMutex
+	rules []Rule
+}
+
+// SetRetention replaces the retention rules. For a predicate, the rule
+// matching both kind and predicate is used first, then the one matching
+// the predicate, and then the one matching the kind. Predicates with no
+// matching rule keep all their versions, which is the default.
+func SetRetention(rules ...Rule) {
+	for _, r := range rules {
+		if r.KeepLast < 0 || r.MaxAge < 0 || (r.KeepLast == 0 && r.MaxAge == 0) {
+			log.WithField("rule", r).Fatal("Invalid retention rule")
+			return
+		}
+	}
+	retention.Lock()
+	defer retention.Unlock()
+	retention.rules = append([]Rule(nil), rules...)
+}
+
+// ruleFor returns the most specific rule for the predicate of kind.
+func ruleFor(kind, pred string) (Rule, bool) {
+	retention.RLock()
+	defer retention.RUnlock()
+
+	best, score := Rule{}, 0
+	for _, r := range retention.rules {
+		if (len(r.Kind) > 0 && r.Kind != kind) ||
+			(len(r.Predicate) > 0 && r.Predicate != pred) {
+			continue
+		}
+		s := 1
+		if len(r.Kind) > 0 {
+			s += 1
+		}
+		if len(r.Predicate) > 0 {
+			s += 2
+		}
+		if s > score {
+			best, score = r, s
+		}
+	}
+	return best, score > 0
+}
+
+// expired returns the instructions to be removed as per retention rules.
+// Edges and internal predicates, like _delete_ and _parent_, are left out,
+// as their instructions aren't versions of the same value.
+func expired(its []x.Instruction, now time.Time) []x.Instruction {
+	versions := make(map[string][]x.Instruction)
+	for _, it := range its {
+		if len(it.ObjectId) > 0 || strings.HasPrefix(it.Predicate, "_") {
+			continue
+		}
+		versions[it.Predicate] = append(versions[it.Predicate], it)
+	}
+
+	var drop []x.Instruction
+	for pred, list := range versions {
+		rule, ok := ruleFor(list[0].SubjectType, pred)
+		if !ok {
+			continue
+		}
+		sort.Sort(sort.Reverse(x.Its(list)))
+		for i, it := range list[1:] {
+			if rule.KeepLast > 0 && i+1 < rule.KeepLast {
+				continue
+			}
+			if rule.MaxAge > 0 && now.Sub(time.Unix(0, it.NanoTs)) < rule.MaxAge {
+				continue
+			}
+			drop = append(drop, it)
+		}
+	}
+	return drop
+}
+
+// CompactEntity removes the versions of predicates of the entity, which
+// have expired as per the rules set via SetRetention. Returns the number
+// of instructions removed. The store must implement Deleter.
+func CompactEntity(id string) (int, error) {
+	d, ok := Get().(Deleter)
+	if !ok {
+		return 0, errors.New("Store can't delete instructions")
+	}
+	its, err := Instructions(id)
+	if err != nil {
+		return 0, err
+	}
+	drop := expired(its, time.Now())
+	if len(drop) == 0 {
+		return 0, nil
+	}
+	if err := d.Delete(id, drop); err != nil {
+		x.LogErr(log, err).WithField("id", id).Error("While deleting instructions")
+		return 0, err
+	}
+	return len(drop), nil
+}
+
+// Compact runs CompactEntity over all the entities in the store. Returns
+// the number of entities compacted, and instructions removed. The latest
+// values don't change, so docs in the search engine don't need updating.
+// The store must implement Partitioner, to be scanned over.
+func Compact() (entities, removed int, rerr error) {
+	if _, ok := Get().(Deleter); !ok {
+		return 0, 0, errors.New("Store can't delete instructions")
+	}
+	err := scanEntities(func(e x.Entity) error {
+		n, err := CompactEntity(e.Id)
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			entities += 1
+			removed += n
+		}
+		return nil
+	})
+	if err != nil {
+		return entities, removed, err
+	}
+	log.WithFields(logrus.Fields{
+		"entities": entities,
+		"removed":  removed,
+	}).Info("Compacted store")
+	return entities, removed, nil
+}
+
+// scanEntities calls fn for every entity in the store, via a single
+// Partitioner partition, as not all stores implement Iterate. An entity may
+// be passed more than once, if its instructions are spread over the store,
+// as only the ids of the previous chunk are kept to skip repeats.
+func scanEntities(fn func(e x.Entity) error) error {
+	pr, ok := Get().(Partitioner)
+	if !ok {
+		return errors.New("Store can't be scanned")
+	}
+	parts, err := pr.Partitions(1)
+	if err != nil {
+		x.LogErr(log, err).Error("While partitioning store")
+		return err
+	}
+
+	prev := make(map[string]bool)
+	ch := make(chan x.Entity, 1000) // At most 1000 entities per chunk.
+	for _, part := range parts {
+		cursor := ""
+		for {
+			found, next, err := pr.IteratePartition(part, cursor, 1000, ch)
+			if err != nil {
+				x.LogErr(log, err).Error("While iterating")
+				return err
+			}
+			cur := make(map[string]bool)
+			for len(ch) > 0 {
+				e := <-ch
+				if prev[e.Id] || cur[e.Id] {
+					continue
+				}
+				cur[e.Id] = true
+				if err := fn(e); err != nil {
+					return err
+				}
+			}
+			if found == 0 {
+				break
+			}
+			prev = cur
+			cursor = next
+		}
+	}
+	return nil
+}
@@ -39,6 +39,83 @@ type Store interface {
 	Iterate(fromId string, num int, ch chan x.Entity) (int, x.Entity, error)
 }
 
+// SinceIterator can be implemented by stores which keep an index of
+// instructions by commit time, to page over just the entities modified
+// recently, instead of the whole table.
+type SinceIterator interface {
+	// IterateSince works like Iterate, but only over the entities with
+	// instructions committed after nanoTs. Iteration continues after the
+	// cursor returned by the previous call, or from nanoTs if cursor is
+	// empty. An entity may be returned again, if modified more than once.
+	//
+	// Returns the number of entities found, the cursor to continue from,
+	// and error, if any. If no entities are found, we've reached the end.
+	IterateSince(nanoTs int64, cursor string, num int,
+		ch chan x.Entity) (int, string, error)
+}
+
+// Partition is a slice of the keyspace of a store, as returned by
+// Partitioner.Partitions. Start and End are bounds specific to the store,
+// and should be treated as opaque. Empty values leave that end of the
+// partition unbounded.
+type Partition struct {
+	Start string
+	End   string
+}
+
+// Partitioner can be implemented by stores, which can split their keyspace
+// into disjoint partitions, so multiple scanners can page over the
+// entities at once.
+type Partitioner interface {
+	// Partitions splits the keyspace into n partitions, which together
+	// cover all the entities. Fewer partitions can be returned, for e.g.
+	// if there aren't enough entities.
+	Partitions(n int) ([]Partition, error)
+
+	// IteratePartition works like Iterate, but only over the entities in
+	// partition p. Iteration continues after the cursor returned by the
+	// previous call, or from the start of p if cursor is empty. An entity
+	// may be returned more than once, if it spans partitions.
+	//
+	// Returns the number of entities found, the cursor to continue from,
+	// and error, if any. If no entities are found, we've reached the end.
+	IteratePartition(p Partition, cursor string, num int,
+		ch chan x.Entity) (int, string, error)
+}
+
+// Deleter can be implemented by stores which can remove instructions, for
+// e.g. to compact old versions of predicates via Compact.
+type Deleter interface {
+	// Delete removes the given instructions for the entity, as returned by
+	// GetEntity. Instructions are matched by predicate, object id, source
+	// and nano ts, so ones committed meanwhile aren't affected. Edges to
+	// children added in the same update share all but the object id.
+	Delete(entityId string, its []x.Instruction) error
+}
+
+// SourcePurger can be implemented by stores which can find the
+// instructions written by a source, without going over all the entities.
+// Stores which don't, are scanned over by Purge.
+type SourcePurger interface {
+	// PurgeSource removes all the instructions written by source. Returns
+	// the entities they belonged to, and the number of instructions removed.
+	PurgeSource(source string) ([]x.Entity, int, error)
+}
+
+// SourceIterator can be implemented by stores which index instructions by
+// source and commit time, as required by Activity.
+type SourceIterator interface {
+	// IterateSource sends the instructions written by source, with nano ts
+	// in [from, to), in the order committed. Iteration continues after the
+	// cursor returned by the previous call, or from the start if cursor is
+	// empty.
+	//
+	// Returns the number of instructions found, the cursor to continue
+	// from, and error, if any. If none are found, we've reached the end.
+	IterateSource(source string, from, to int64, cursor string, num int,
+		ch chan x.Instruction) (int, string, error)
+}
+
 var driver Store
 
 func Register(name string, store Store) {
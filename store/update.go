@@ -257,7 +257,7 @@ func (n *Update) Execute(c *req.Context) error {
 			if _, present := updates[e]; present { // find distinct entities
 				continue
 			}
-			c.Updates <- e
+			c.Enqueue(e)
 			updates[e] = true
 		}
 	}
@@ -3,11 +3,19 @@ package testx
 import (
 	"encoding/json"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
 	"testing"
+	"time"
 
 	_ "github.com/aslanides/gocrud/drivers/leveldb"
+	_ "github.com/aslanides/gocrud/drivers/memsearch"
 	"github.com/aslanides/gocrud/req"
+	"github.com/aslanides/gocrud/search"
 	"github.com/aslanides/gocrud/store"
+	"github.com/aslanides/gocrud/x"
 )
 
 func TestVersions(t *testing.T) {
@@ -69,3 +77,319 @@ func TestVersions(t *testing.T) {
 		t.Errorf("Source expected nasdaq. Got: %+v", jv)
 	}
 }
+
+func TestQueryDiscard(t *testing.T) {
+	path, err := ioutil.TempDir("", "gocrudldb_")
+	if err != nil {
+		t.Fatal("Opening leveldb file")
+		return
+	}
+	defer os.RemoveAll(path)
+	store.Get().Init(path) // leveldb
+
+	c := req.NewContext(10)
+	for _, id := range []string{"p1", "p2"} {
+		u := store.NewUpdate("Post", id).SetSource("a").Set("body", "Hello")
+		u.AddChild("Like").Set("thumb", 1)
+		u.AddChild("Like").Set("thumb", 1)
+		if err := u.Execute(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Committed after the edges, so the children are already being fetched
+	// once these are found.
+	if err := store.NewUpdate("Post", "p1").SetSource("a").Set("spam", true).
+		Execute(c); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.NewUpdate("Post", "p2").SetSource("a").MarkDeleted().
+		Execute(c); err != nil {
+		t.Fatal(err)
+	}
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 10; i++ {
+		r, err := store.NewQuery("p1").UptoDepth(1).FilterOut("spam").Run()
+		if err != nil || len(r.Id) > 0 {
+			t.Fatalf("Expected filtered out post. Got: %+v, %v", r, err)
+		}
+		r, err = store.NewQuery("p2").UptoDepth(1).Run()
+		if err != nil || len(r.Id) > 0 {
+			t.Fatalf("Expected deleted post. Got: %+v, %v", r, err)
+		}
+	}
+	time.Sleep(50 * time.Millisecond)
+	if n := runtime.NumGoroutine() - before; n > 5 {
+		t.Errorf("Expected child routines to finish. Found %v more", n)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	path, err := ioutil.TempDir("", "gocrudldb_")
+	if err != nil {
+		t.Fatal("Opening leveldb file")
+		return
+	}
+	store.Get().Init(path) // leveldb
+	defer store.SetRetention()
+
+	c := req.NewContext(10)
+	set := func(pred string, from, to int) {
+		for d := from; d < to; d++ {
+			if err := store.NewUpdate("Ticker", "AAPL").SetSource("nasdaq").
+				Set(pred, d).Execute(c); err != nil {
+				t.Fatalf("When updating store: %+v", err)
+			}
+		}
+	}
+	set("price", 0, 10)
+	set("volume", 0, 3)
+	set("open", 0, 3)
+	time.Sleep(100 * time.Millisecond)
+	set("volume", 3, 5)
+	if err := store.NewUpdate("Ticker", "AAPL").SetSource("nasdaq").
+		AddChild("Quote").Set("bid", 1).Execute(c); err != nil {
+		t.Fatal(err)
+	}
+
+	// Shares the id prefix, with a newer price.
+	if err := store.NewUpdate("Ticker", "AAPLX").SetSource("nasdaq").
+		Set("price", 100).Execute(c); err != nil {
+		t.Fatal(err)
+	}
+
+	store.SetRetention(
+		store.Rule{Kind: "Ticker", KeepLast: 1},
+		store.Rule{Predicate: "price", KeepLast: 3},
+		store.Rule{Kind: "Ticker", Predicate: "volume", MaxAge: 50 * time.Millisecond},
+	)
+	entities, removed, err := store.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 7 price, 3 volume and 2 open versions.
+	if entities != 1 || removed != 12 {
+		t.Errorf("Expected 12 removed from 1 entity. Got: %v, %v", removed, entities)
+	}
+
+	result, err := store.NewQuery("AAPL").UptoDepth(1).Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check := func(pred string, count int, latest float64) {
+		versions, present := result.Columns[pred]
+		if !present {
+			t.Errorf("Column %v should be present: %+v", pred, result)
+			return
+		}
+		if versions.Count() != count || versions.Latest().Value.(float64) != latest {
+			t.Errorf("Expected %v versions of %v, upto %v. Got: %+v",
+				count, pred, latest, versions)
+		}
+	}
+	// Query includes AAPLX as well, via the id prefix.
+	check("price", 4, 100)
+	its, err := store.Get().GetEntity("AAPL")
+	if err != nil {
+		t.Fatal(err)
+	}
+	prices := make(map[string]int)
+	for _, it := range its {
+		if it.Predicate == "price" {
+			prices[it.SubjectId] += 1
+		}
+	}
+	if prices["AAPL"] != 3 || prices["AAPLX"] != 1 {
+		t.Errorf("Expected 3 prices for AAPL, and 1 for AAPLX. Got: %v", prices)
+	}
+	check("volume", 2, 4)
+	check("open", 1, 2)
+	if len(result.Children) != 1 {
+		t.Errorf("Expected child to be kept. Got: %+v", result.Children)
+	}
+
+	if _, removed, _ := store.Compact(); removed != 0 {
+		t.Errorf("Expected nothing more to compact. Got: %v", removed)
+	}
+}
+
+func TestPurge(t *testing.T) {
+	path, err := ioutil.TempDir("", "gocrudldb_")
+	if err != nil {
+		t.Fatal("Opening leveldb file")
+		return
+	}
+	defer os.RemoveAll(path)
+	store.Get().Init(filepath.Join(path, "ldb")) // leveldb
+	search.Get().Init()
+	store.SetAuditor(store.NewFileAuditor(filepath.Join(path, "audit")))
+	defer store.SetAuditor(nil)
+
+	c := req.NewContextWithUpdates(10, 100)
+	u := store.NewUpdate("User", "alice").SetSource("alice").Set("name", "Alice")
+	p := u.AddChild("Post").Set("body", "Hello")
+	c1 := p.AddChild("Comment").SetSource("bob").Set("body", "Hi")
+	c2 := p.AddChild("Comment").Set("body", "Bye")
+	if err := u.Execute(c); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.NewUpdate("User", "alice").SetSource("bob").
+		Set("nickname", "Al").Execute(c); err != nil {
+		t.Fatal(err)
+	}
+	search.Get().Update(x.Doc{Kind: "User", Id: "alice", NanoTs: 1})
+	search.Get().Update(x.Doc{Kind: "Post", Id: p.Id(), NanoTs: 1})
+
+	// Entities sent to the indexer since the last call.
+	updated := func() map[x.Entity]bool {
+		m := make(map[x.Entity]bool)
+		for len(c.Updates) > 0 {
+			m[<-c.Updates] = true
+		}
+		return m
+	}
+	updated()
+
+	sources := func(id string) map[string]int {
+		its, err := store.Get().GetEntity(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := make(map[string]int)
+		for _, it := range its {
+			if it.SubjectId == id {
+				m[it.Source] += 1
+			}
+		}
+		return m
+	}
+
+	edges := func(id string) map[string]bool {
+		its, err := store.Get().GetEntity(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m := make(map[string]bool)
+		for _, it := range its {
+			if it.SubjectId == id && len(it.ObjectId) > 0 && it.Predicate != "_parent_" {
+				m[it.ObjectId] = true
+			}
+		}
+		return m
+	}
+
+	// Both edges from the post share predicate, source and nano ts.
+	r, err := store.PurgeEntity(c, c1.Id(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := edges(p.Id()); len(got) != 1 || !got[c2.Id()] {
+		t.Errorf("Expected only the edge to sibling to survive. Got: %v", got)
+	}
+	if len(r.Entities) != 2 || r.Instructions != 3 || r.Reindexed != 1 {
+		t.Errorf("Unexpected record: %+v", r)
+	}
+	post := x.Entity{Kind: "Post", Id: p.Id()}
+	if got := updated(); len(got) != 1 || !got[post] {
+		t.Errorf("Expected post to be reindexed. Got: %v", got)
+	}
+	if _, err := search.Get().Get("Post", p.Id()); err != nil {
+		t.Errorf("Expected doc of post to be kept. Got: %v", err)
+	}
+
+	r, err = store.PurgeEntity(c, p.Id(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Edge from alice, and Post with its remaining comment.
+	if len(r.Entities) != 3 || r.Root != p.Id() || !r.Cascade ||
+		r.Reindexed != 1 || r.DocsDeleted != 2 {
+		t.Errorf("Unexpected record: %+v", r)
+	}
+	if n := len(sources(p.Id())); n != 0 {
+		t.Errorf("Expected post to be purged. Found %v sources", n)
+	}
+	if got := sources("alice"); got["alice"] != 1 || got["bob"] != 1 {
+		t.Errorf("Expected edge to post removed from alice. Got: %v", got)
+	}
+	if _, err := search.Get().Get("Post", p.Id()); err != search.ErrNotFound {
+		t.Errorf("Expected doc to be deleted. Got: %v", err)
+	}
+
+	updated()
+	r, err = store.Purge(c, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Entities) != 1 || r.Instructions != 1 || r.Source != "alice" ||
+		r.Reindexed != 1 || r.DocsDeleted != 0 {
+		t.Errorf("Unexpected record: %+v", r)
+	}
+	if got := sources("alice"); len(got) != 1 || got["bob"] != 1 {
+		t.Errorf("Expected only bob's instructions. Got: %v", got)
+	}
+	// Still has bob's nickname, so is regenerated instead.
+	if _, err := search.Get().Get("User", "alice"); err != nil {
+		t.Errorf("Expected doc to be kept. Got: %v", err)
+	}
+	if got := updated(); !got[x.Entity{Kind: "User", Id: "alice"}] {
+		t.Errorf("Expected alice to be reindexed. Got: %v", got)
+	}
+
+	b, err := ioutil.ReadFile(filepath.Join(path, "audit"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(strings.Split(strings.TrimSpace(string(b)), "\n")); n != 3 {
+		t.Errorf("Expected 3 audit records. Got: %v", n)
+	}
+}
+
+func TestActivity(t *testing.T) {
+	path, err := ioutil.TempDir("", "gocrudldb_")
+	if err != nil {
+		t.Fatal("Opening leveldb file")
+		return
+	}
+	defer os.RemoveAll(path)
+	store.Get().Init(path) // leveldb
+
+	c := req.NewContext(10)
+	set := func(source, id string, pred string, val interface{}) {
+		if err := store.NewUpdate("Profile", id).SetSource(source).
+			Set(pred, val).Execute(c); err != nil {
+			t.Fatal(err)
+		}
+	}
+	set("carol", "p1", "bio", "old")
+	from := time.Now().UnixNano()
+	set("dave", "p1", "bio", "dave's")
+	set("carol", "p1", "bio", "new")
+	set("carol", "p2", "city", "Paris")
+	set("dave", "p2", "city", "Rome")
+	to := time.Now().UnixNano()
+	set("carol", "p1", "bio", "later")
+
+	acts, err := store.Activity("carol", from, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(acts) != 2 || acts[0].Id != "p1" || acts[1].Id != "p2" {
+		t.Fatalf("Expected activity on p1 and p2. Got: %+v", acts)
+	}
+	check := func(c store.Change, pred string, before, after interface{}) {
+		if c.Predicate != pred || c.Before != before || c.After != after {
+			t.Errorf("Expected %v from %v to %v. Got: %+v", pred, before, after, c)
+		}
+	}
+	if len(acts[0].Changes) != 1 || len(acts[1].Changes) != 1 {
+		t.Fatalf("Expected one change each. Got: %+v", acts)
+	}
+	check(acts[0].Changes[0], "bio", "dave's", "new")
+	check(acts[1].Changes[0], "city", nil, "Paris")
+
+	if acts, err := store.Activity("carol", to, time.Now().UnixNano()); err != nil ||
+		len(acts) != 1 || acts[0].Changes[0].After != "later" {
+		t.Errorf("Expected only the later change. Got: %+v, %v", acts, err)
+	}
+}
@@ -2,6 +2,7 @@ package testx
 
 import (
 	"log"
+	"strings"
 	"testing"
 	"time"
 
@@ -28,6 +29,9 @@ func AddDocs(e search.Engine) {
 		m := make(map[string]interface{})
 		m["name"] = name
 		m["pos"] = idx
+		if strings.Contains(name, "ngc") {
+			m["catalog"] = "ngc"
+		}
 		d.Data = m
 
 		if err := e.Update(d); err != nil {
@@ -138,3 +142,331 @@ func RunFromLimit(e search.Engine, t *testing.T) {
 	check(docs[0], "galaxy ngc 1512", t)
 	check(docs[1], "ngc 123", t)
 }
+
+func checkNames(docs []x.Doc, names []string, t *testing.T) {
+	if len(docs) != len(names) {
+		t.Errorf("Number of docs should be %v. Found: %v\n", len(names), len(docs))
+		return
+	}
+	for idx, doc := range docs {
+		check(doc, names[idx], t)
+	}
+}
+
+func RunRangeFilter(e search.Engine, t *testing.T) {
+	q := e.NewQuery("Galaxy").Order("pos")
+	q.NewAndFilter().AddRange("pos", search.Gte, 2).AddRange("pos", search.Lt, 5)
+	docs, err := q.Run()
+	if err != nil {
+		t.Fatalf("While running query: %v", err)
+		return
+	}
+	checkNames(docs, []string{"2masx", "whirlpool galaxy", "ngc 123"}, t)
+}
+
+func RunExistsFilter(e search.Engine, t *testing.T) {
+	q := e.NewQuery("Galaxy").Order("pos")
+	q.NewAndFilter().AddExists("catalog")
+	docs, err := q.Run()
+	if err != nil {
+		t.Fatalf("While running query: %v", err)
+		return
+	}
+	checkNames(docs, []string{"ngc 123", "galaxy ngc 1512", "ngc 3370"}, t)
+
+	q = e.NewQuery("Galaxy").Order("pos")
+	q.NewAndFilter().AddMissing("catalog").AddRange("pos", search.Gt, 4)
+	docs, err = q.Run()
+	if err != nil {
+		t.Fatalf("While running query: %v", err)
+		return
+	}
+	checkNames(docs, []string{"supernova", "m81"}, t)
+}
+
+func RunInFilter(e search.Engine, t *testing.T) {
+	q := e.NewQuery("Galaxy").Order("pos")
+	q.NewAndFilter().AddIn("name", "m81", "supernova", "andromeda")
+	docs, err := q.Run()
+	if err != nil {
+		t.Fatalf("While running query: %v", err)
+		return
+	}
+	checkNames(docs, []string{"supernova", "m81"}, t)
+}
+
+func RunNotFilter(e search.Engine, t *testing.T) {
+	q := e.NewQuery("Galaxy").Order("pos")
+	q.NewAndFilter().AddRegex("name", ".*galaxy.*").
+		Not().AddExact("catalog", "ngc")
+	docs, err := q.Run()
+	if err != nil {
+		t.Fatalf("While running query: %v", err)
+		return
+	}
+	checkNames(docs, []string{"sombrero galaxy", "whirlpool galaxy"}, t)
+}
+
+func RunNestedFilter(e search.Engine, t *testing.T) {
+	// name =~ galaxy AND (catalog = ngc OR pos < 1)
+	q := e.NewQuery("Galaxy").Order("pos")
+	f := q.NewAndFilter().AddRegex("name", ".*galaxy.*")
+	f.Or().AddExact("catalog", "ngc").AddRange("pos", search.Lt, 1)
+	docs, err := q.Run()
+	if err != nil {
+		t.Fatalf("While running query: %v", err)
+		return
+	}
+	checkNames(docs, []string{"sombrero galaxy", "galaxy ngc 1512"}, t)
+
+	// name = m81 OR (name =~ ngc AND NOT (pos >= 7 OR pos < 5))
+	q = e.NewQuery("Galaxy").Order("pos")
+	f = q.NewOrFilter().AddExact("name", "m81")
+	f.And().AddRegex("name", ".*ngc.*").
+		Not().Or().AddRange("pos", search.Gte, 7).AddRange("pos", search.Lt, 5)
+	docs, err = q.Run()
+	if err != nil {
+		t.Fatalf("While running query: %v", err)
+		return
+	}
+	checkNames(docs, []string{"galaxy ngc 1512", "m81"}, t)
+
+	// Both filters set on the query need to match.
+	q = e.NewQuery("Galaxy").Order("pos")
+	q.NewAndFilter().AddExists("catalog")
+	q.NewOrFilter().AddExact("pos", 4).AddExact("pos", 5)
+	docs, err = q.Run()
+	if err != nil {
+		t.Fatalf("While running query: %v", err)
+		return
+	}
+	checkNames(docs, []string{"ngc 123"}, t)
+}
+
+func RunMatch(e search.Engine, t *testing.T) {
+	q := e.NewQuery("Galaxy").Match("name", "Galaxy NGC")
+	docs, err := q.Run()
+	if err != nil {
+		t.Fatalf("While running query: %v", err)
+		return
+	}
+	if len(docs) != 5 {
+		t.Errorf("Number of docs should be %v. Found: %v\n", 5, len(docs))
+		return
+	}
+	// Only doc matching both terms.
+	check(docs[0], "galaxy ngc 1512", t)
+
+	q = e.NewQuery("Galaxy").Match("name", "galaxy").Order("pos")
+	docs, err = q.Run()
+	if err != nil {
+		t.Fatalf("While running query: %v", err)
+		return
+	}
+	checkNames(docs, []string{
+		"sombrero galaxy", "whirlpool galaxy", "galaxy ngc 1512"}, t)
+
+	count, err := e.NewQuery("Galaxy").Match("name", "supernova").Count()
+	if err != nil {
+		t.Fatalf("While running query: %v", err)
+		return
+	}
+	if count != 1 {
+		t.Errorf("Count of results should be %v. Found: %v\n", 1, count)
+	}
+}
+
+func RunCursor(e search.Engine, t *testing.T) {
+	var names []string
+	var cursor string
+	for i := 0; i < 10; i++ {
+		q := e.NewQuery("Galaxy").Order("-pos").Limit(4)
+		q.NewOrFilter().AddRegex("name", ".*galaxy.*").
+			AddRegex("name", ".*ngc.*").AddExact("name", "m81")
+		if len(cursor) > 0 {
+			q.After(cursor)
+		}
+		docs, next, err := q.RunPage()
+		if err != nil {
+			t.Fatalf("While running query: %v", err)
+			return
+		}
+		if len(docs) == 0 {
+			break
+		}
+		if len(next) == 0 {
+			t.Fatal("Expected cursor for non-empty page")
+			return
+		}
+		for _, doc := range docs {
+			m := doc.Data.(map[string]interface{})
+			names = append(names, m["name"].(string))
+		}
+		cursor = next
+	}
+	if len(names) != len(soln) {
+		t.Fatalf("Number of docs should be %v. Found: %v\n", len(soln), names)
+		return
+	}
+	for idx, name := range names {
+		if name != soln[idx] {
+			t.Errorf("Expected: %v. Found: %v\n", soln[idx], name)
+		}
+	}
+
+	if _, err := e.NewQuery("Galaxy").After("invalid").Run(); err == nil {
+		t.Error("Expected error for invalid cursor")
+	}
+
+	// Relevance ordering can't be paged over, in any engine.
+	_, next, err := e.NewQuery("Galaxy").Match("name", "galaxy").Limit(1).RunPage()
+	if err != nil {
+		t.Fatalf("While running query: %v", err)
+		return
+	}
+	_, err = e.NewQuery("Galaxy").Match("name", "galaxy").After(next).Run()
+	if err != search.ErrRelevanceCursor {
+		t.Errorf("Expected ErrRelevanceCursor. Found: %v", err)
+	}
+}
+
+func RunMultiOrder(e search.Engine, t *testing.T) {
+	// Only ngc docs have catalog set, and all others are missing it.
+	docs, err := e.NewQuery("Galaxy").Order("catalog", "-pos").Run()
+	if err != nil {
+		t.Fatalf("While running query: %v", err)
+		return
+	}
+	checkNames(docs, []string{
+		"ngc 3370", "galaxy ngc 1512", "ngc 123", "m81", "supernova",
+		"whirlpool galaxy", "2masx", "messier 64", "sombrero galaxy"}, t)
+
+	// Page through the same, with missing values placed first.
+	names := []string{
+		"m81", "supernova", "whirlpool galaxy", "2masx", "messier 64",
+		"sombrero galaxy", "ngc 3370", "galaxy ngc 1512", "ngc 123"}
+	var cursor string
+	for i := 0; i < 3; i++ {
+		q := e.NewQuery("Galaxy").Order("catalog", "-pos").
+			Missing(search.MissingFirst).Limit(3)
+		if len(cursor) > 0 {
+			q.After(cursor)
+		}
+		docs, cursor, err = q.RunPage()
+		if err != nil {
+			t.Fatalf("While running query: %v", err)
+			return
+		}
+		checkNames(docs, names[3*i:3*i+3], t)
+	}
+}
+
+// RunDelete checks versioning of deletes, using docs of kind Star, so
+// the Galaxy docs used by other tests are left untouched.
+func RunDelete(e search.Engine, t *testing.T) {
+	id := x.UniqueString(5)
+	d := x.Doc{Kind: "Star", Id: id, NanoTs: 10}
+	d.Data = map[string]interface{}{"name": "sun"}
+	if err := e.Update(d); err != nil {
+		t.Fatalf("While updating: %v", err)
+		return
+	}
+	if err := e.Delete("Star", id, 5); err == nil {
+		t.Error("Older delete should fail with version conflict")
+	}
+	if err := e.Delete("Star", id, 20); err != nil {
+		t.Errorf("While deleting: %v", err)
+	}
+	d.NanoTs = 15
+	if err := e.Update(d); err == nil {
+		t.Error("Update older than delete should fail with version conflict")
+	}
+	d.NanoTs = 30
+	if err := e.Update(d); err != nil {
+		t.Errorf("Update newer than delete should succeed: %v", err)
+	}
+}
+
+// RunGet checks looking up docs by id, using docs of kind Planet.
+func RunGet(e search.Engine, t *testing.T) {
+	id := x.UniqueString(5)
+	d := x.Doc{Kind: "Planet", Id: id, NanoTs: 10}
+	d.Data = map[string]interface{}{"name": "earth"}
+	if err := e.Update(d); err != nil {
+		t.Fatalf("While updating: %v", err)
+		return
+	}
+	doc, err := e.Get("Planet", id)
+	if err != nil {
+		t.Fatalf("While getting: %v", err)
+		return
+	}
+	if doc.Id != id || doc.NanoTs != 10 {
+		t.Errorf("Unexpected doc: %+v", doc)
+	}
+	if m, ok := doc.Data.(map[string]interface{}); !ok || m["name"] != "earth" {
+		t.Errorf("Unexpected doc data: %+v", doc.Data)
+	}
+
+	if _, err := e.Get("Planet", "missing"); err != search.ErrNotFound {
+		t.Errorf("Expected ErrNotFound. Got: %v", err)
+	}
+	if err := e.Delete("Planet", id, 20); err != nil {
+		t.Fatalf("While deleting: %v", err)
+	}
+	if _, err := e.Get("Planet", id); err != search.ErrNotFound {
+		t.Errorf("Expected ErrNotFound after delete. Got: %v", err)
+	}
+}
+
+func RunAggregate(e search.Engine, t *testing.T) {
+	q := e.NewQuery("Galaxy").
+		Aggregate("catalogs", search.Terms("catalog")).
+		Aggregate("pos_stats", search.Stats("pos")).
+		Aggregate("pos_hist", search.Histogram("pos", 3).
+			Sub("catalogs", search.Terms("catalog")))
+	aggs, err := q.RunAggregations()
+	if err != nil {
+		t.Fatalf("While running aggregations: %v", err)
+		return
+	}
+
+	terms := aggs["catalogs"]
+	if terms == nil || len(terms.Buckets) != 1 {
+		t.Fatalf("Expected 1 term bucket. Found: %+v", terms)
+		return
+	}
+	if terms.Buckets[0].Key != "ngc" || terms.Buckets[0].Count != 3 {
+		t.Errorf("Expected 3 docs for ngc. Found: %+v", terms.Buckets[0])
+	}
+
+	stats := aggs["pos_stats"].Stats
+	if stats == nil {
+		t.Fatal("Expected stats to be set")
+		return
+	}
+	if stats.Count != 9 || stats.Min != 0 || stats.Max != 8 ||
+		stats.Sum != 36 || stats.Avg != 4 {
+		t.Errorf("Unexpected stats: %+v", stats)
+	}
+
+	hist := aggs["pos_hist"]
+	if hist == nil || len(hist.Buckets) != 3 {
+		t.Fatalf("Expected 3 histogram buckets. Found: %+v", hist)
+		return
+	}
+	ngcs := []int64{0, 1, 2}
+	for idx, b := range hist.Buckets {
+		if b.Key != int64(3*idx) || b.Count != 3 {
+			t.Errorf("Unexpected bucket: %+v", b)
+		}
+		var count int64
+		if sub := b.Subs["catalogs"]; sub != nil && len(sub.Buckets) > 0 {
+			count = sub.Buckets[0].Count
+		}
+		if count != ngcs[idx] {
+			t.Errorf("Expected %v ngc docs in bucket %v. Found: %v",
+				ngcs[idx], b.Key, count)
+		}
+	}
+}
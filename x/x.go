@@ -40,6 +40,11 @@ type Doc struct {
 	Id     string
 	NanoTs int64
 	Data   interface{}
+
+	// Deleted should be set by indexers, if the entity no longer exists,
+	// or has been marked deleted. The doc is then removed from the search
+	// engine, instead of being updated. It isn't stored itself.
+	Deleted bool `json:"-"`
 }
 
 // Instruction is the format data gets stored in the underlying data stores.